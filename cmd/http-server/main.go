@@ -0,0 +1,25 @@
+package main
+
+import (
+	. "db"
+	"flag"
+	"log"
+	"net/http"
+)
+
+// serve the tables of a database file over HTTP
+func main() {
+	path := flag.String("db", "data.db", "the database file")
+	addr := flag.String("addr", "127.0.0.1:8080", "the address to listen on")
+	flag.Parse()
+
+	db := &DB{Path: *path}
+	if err := db.Open(); err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	log.Printf("listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, NewHttpServer(db)); err != nil {
+		log.Print(err)
+	}
+}
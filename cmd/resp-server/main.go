@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	. "server"
+)
+
+// serve a KV file over the Redis protocol
+func main() {
+	path := flag.String("db", "kv.db", "the database file")
+	addr := flag.String("addr", "127.0.0.1:6379", "the address to listen on")
+	flag.Parse()
+
+	kv := NewKv(*path)
+	if err := kv.Open(); err != nil {
+		log.Fatal(err)
+	}
+	defer kv.Close()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := NewRespServer(kv)
+	// shut down on ctrl-c so that the master page is stored
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+	log.Printf("listening on %s", ln.Addr())
+	if err := srv.Serve(ln); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Aggregation.
+//
+// The rows of a scan are grouped by the values of the grouping columns,
+// and each aggregate function is computed per group. The NULL inputs are
+// ignored; COUNT of no values is 0, and the others are NULL. Without
+// grouping columns there is exactly one group, even for no rows.
+//
+// When the grouping columns are a prefix of the primary key and the rows
+// come in the primary key order, the rows of a group are adjacent, so each
+// group is finished when the next one starts. Otherwise the groups are kept
+// in a hash table until the end of the scan.
+
+const (
+	AGG_COUNT = iota + 1 // COUNT(col), COUNT(*) if Col is empty
+	AGG_SUM
+	AGG_MIN
+	AGG_MAX
+	AGG_AVG
+)
+
+var aggNames = map[string]int{
+	"count": AGG_COUNT, "sum": AGG_SUM, "min": AGG_MIN, "max": AGG_MAX, "avg": AGG_AVG,
+}
+
+// an aggregate function of a column
+type AggFunc struct {
+	Func int    // AGG_*
+	Col  string // the input column, empty for COUNT(*)
+	Name string // the output column
+}
+
+// an aggregation over the rows of a table
+type AggQuery struct {
+	GroupBy []string
+	Funcs   []AggFunc
+	Filter  func(rec *Record) bool // optional
+}
+
+// the running state of an aggregate function in a group
+type aggState struct {
+	fn    int
+	count int64 // the non-NULL inputs
+	acc   Value // the sum, the min or the max
+}
+
+func (s *aggState) add(val Value) error {
+	if val.Type == TYPE_NULL {
+		return nil
+	}
+	s.count++
+	switch s.fn {
+	case AGG_COUNT:
+		return nil
+	case AGG_SUM, AGG_AVG:
+		switch val.Type {
+		case TYPE_INT64, TYPE_FLOAT64, TYPE_DECIMAL:
+		default:
+			return fmt.Errorf("expect numbers, got %s", TypeName(val.Type))
+		}
+	}
+	if s.count == 1 {
+		s.acc = val
+		return nil
+	}
+	if err := qlUnify(&s.acc, &val); err != nil {
+		return err
+	}
+	if s.fn == AGG_SUM || s.fn == AGG_AVG {
+		var err error
+		s.acc, err = qlArith(QL_ADD, s.acc, val)
+		return err
+	}
+	r, err := qlCompare(&val, &s.acc)
+	if (s.fn == AGG_MIN && r < 0) || (s.fn == AGG_MAX && r > 0) {
+		s.acc = val
+	}
+	return err
+}
+
+func (s *aggState) result() Value {
+	switch {
+	case s.fn == AGG_COUNT:
+		return Value{Type: TYPE_INT64, I64: s.count}
+	case s.count == 0:
+		return Value{Type: TYPE_NULL}
+	case s.fn != AGG_AVG:
+		return s.acc
+	}
+	switch s.acc.Type {
+	case TYPE_INT64:
+		return Value{Type: TYPE_FLOAT64, F64: float64(s.acc.I64) / float64(s.count)}
+	case TYPE_FLOAT64:
+		return Value{Type: TYPE_FLOAT64, F64: s.acc.F64 / float64(s.count)}
+	default: // decimal, truncated
+		return Value{Type: TYPE_DECIMAL, I64: s.acc.I64 / s.count}
+	}
+}
+
+type aggGroup struct {
+	vals   []Value // the grouping values
+	states []aggState
+}
+
+// groups the rows and emits the aggregates of each group
+type aggregator struct {
+	funcs  []int
+	ngroup int
+	sorted bool // the rows of a group are adjacent
+	emit   func(group []Value, aggs []Value) error
+	// the open groups
+	keys   map[string]int
+	groups []*aggGroup
+	last   []byte // the key of the current group when sorted
+}
+
+func newAggregator(funcs []int, ngroup int, sorted bool) *aggregator {
+	return &aggregator{funcs: funcs, ngroup: ngroup, sorted: sorted, keys: map[string]int{}}
+}
+
+func (a *aggregator) newGroup(vals []Value) *aggGroup {
+	g := &aggGroup{vals: vals, states: make([]aggState, len(a.funcs))}
+	for i, fn := range a.funcs {
+		g.states[i].fn = fn
+	}
+	a.groups = append(a.groups, g)
+	return g
+}
+
+// add a row by its grouping values and the inputs of the functions
+func (a *aggregator) add(vals []Value, inputs []Value) error {
+	key := encodeCols(nil, vals, slices.Repeat([]bool{true}, len(vals)))
+	var g *aggGroup
+	if a.sorted {
+		if len(a.groups) == 0 || string(key) != string(a.last) {
+			if err := a.flush(); err != nil {
+				return err
+			}
+			g, a.last = a.newGroup(vals), key
+		} else {
+			g = a.groups[0]
+		}
+	} else if i, ok := a.keys[string(key)]; ok {
+		g = a.groups[i]
+	} else {
+		a.keys[string(key)] = len(a.groups)
+		g = a.newGroup(vals)
+	}
+	for i := range g.states {
+		if err := g.states[i].add(inputs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emit the open groups in the order they are started
+func (a *aggregator) flush() error {
+	for _, g := range a.groups {
+		aggs := make([]Value, len(g.states))
+		for i := range g.states {
+			aggs[i] = g.states[i].result()
+		}
+		if err := a.emit(g.vals, aggs); err != nil {
+			return err
+		}
+	}
+	a.groups = a.groups[:0]
+	clear(a.keys)
+	return nil
+}
+
+// emit the remaining groups after the last row
+func (a *aggregator) finish() error {
+	if a.ngroup == 0 && len(a.groups) == 0 {
+		a.newGroup(nil) // no rows
+	}
+	return a.flush()
+}
+
+// are the columns a prefix of the primary key, in any order?
+func isPKeyPrefix(tdef *TableDef, cols []string) bool {
+	if len(cols) > tdef.PKeys {
+		return false
+	}
+	for _, col := range cols {
+		if idx := colIndex(tdef, col); idx < 0 || idx >= len(cols) {
+			return false
+		}
+	}
+	return true
+}
+
+// compute the aggregates of the rows of a scan, sc is nil for the whole table.
+// each output row has the grouping columns followed by the functions.
+func (db *DB) Aggregate(table string, sc *Scanner, q *AggQuery) ([]Record, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	for _, col := range q.GroupBy {
+		if colIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("unknown column: %s", col)
+		}
+	}
+	funcs := make([]int, len(q.Funcs))
+	for i, f := range q.Funcs {
+		switch {
+		case f.Func < AGG_COUNT || f.Func > AGG_AVG:
+			return nil, fmt.Errorf("bad aggregate function: %d", f.Func)
+		case f.Col == "" && f.Func != AGG_COUNT:
+			return nil, fmt.Errorf("missing column: %s", f.Name)
+		case f.Col != "" && colIndex(tdef, f.Col) < 0:
+			return nil, fmt.Errorf("unknown column: %s", f.Col)
+		}
+		funcs[i] = f.Func
+	}
+	if sc != nil {
+		if err := dbScan(db, tdef, sc); err != nil {
+			return nil, err
+		}
+	}
+	sorted := (sc == nil || sc.index < 0) && isPKeyPrefix(tdef, q.GroupBy)
+	agg := newAggregator(funcs, len(q.GroupBy), sorted)
+	out := []Record{}
+	agg.emit = func(group []Value, aggs []Value) error {
+		rec := Record{Cols: slices.Clone(q.GroupBy), Vals: group}
+		for i, f := range q.Funcs {
+			rec.Cols = append(rec.Cols, f.Name)
+			rec.Vals = append(rec.Vals, aggs[i])
+		}
+		out = append(out, rec)
+		return nil
+	}
+	var err error
+	visit := func(rec *Record) bool {
+		if q.Filter != nil && !q.Filter(rec) {
+			return true
+		}
+		vals := make([]Value, len(q.GroupBy))
+		for i, col := range q.GroupBy {
+			vals[i] = *rec.Get(col)
+		}
+		inputs := make([]Value, len(q.Funcs))
+		for i, f := range q.Funcs {
+			if f.Col == "" {
+				inputs[i] = Value{Type: TYPE_INT64} // counts the row
+			} else {
+				inputs[i] = *rec.Get(f.Col)
+			}
+		}
+		err = agg.add(vals, inputs)
+		return err == nil
+	}
+	if sc == nil {
+		dbScanAll(db, tdef, visit)
+	} else {
+		for ; sc.Valid() && err == nil; sc.Next() {
+			rec := Record{}
+			sc.Deref(&rec)
+			visit(&rec)
+		}
+	}
+	if err == nil {
+		err = agg.finish()
+	}
+	return out, err
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregate(t *testing.T) {
+	os.Remove("test_agg.db")
+	defer os.Remove("test_agg.db")
+	db := &DB{Path: "test_agg.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:     "sales",
+		Types:    []uint32{TYPE_BYTES, TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64},
+		Cols:     []string{"region", "id", "item", "qty", "price"},
+		PKeys:    2,
+		Nullable: []bool{false, false, false, false, true},
+		Indexes:  [][]string{{"item"}},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	rows := []struct {
+		region string
+		id     int64
+		item   string
+		qty    int64
+		price  float64 // 0 for NULL
+	}{
+		{"east", 1, "pen", 10, 1.5},
+		{"east", 2, "ink", 3, 0},
+		{"east", 3, "pen", 5, 2.5},
+		{"north", 1, "ink", 7, 4},
+		{"west", 1, "pen", 1, 0},
+		{"west", 2, "cap", 2, 3},
+	}
+	for _, r := range rows {
+		rec := (&Record{}).AddStr("region", []byte(r.region)).AddInt64("id", r.id).
+			AddStr("item", []byte(r.item)).AddInt64("qty", r.qty)
+		if r.price == 0 {
+			rec.AddNull("price")
+		} else {
+			rec.AddFloat64("price", r.price)
+		}
+		_, err := db.Insert("sales", *rec)
+		assert.NoError(t, err)
+	}
+	funcs := []AggFunc{
+		{Func: AGG_COUNT, Name: "n"},
+		{Func: AGG_COUNT, Col: "price", Name: "priced"},
+		{Func: AGG_SUM, Col: "qty", Name: "qty"},
+		{Func: AGG_MIN, Col: "item", Name: "first"},
+		{Func: AGG_MAX, Col: "price", Name: "top"},
+		{Func: AGG_AVG, Col: "price", Name: "avg"},
+	}
+
+	// grouped by a key prefix, in the key order
+	out, err := db.Aggregate("sales", nil, &AggQuery{GroupBy: []string{"region"}, Funcs: funcs})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(out))
+	east := out[0]
+	assert.Equal(t, []string{"region", "n", "priced", "qty", "first", "top", "avg"}, east.Cols)
+	assert.Equal(t, "east", string(east.Get("region").Str))
+	assert.Equal(t, int64(3), east.Get("n").I64)
+	assert.Equal(t, int64(2), east.Get("priced").I64)
+	assert.Equal(t, int64(18), east.Get("qty").I64)
+	assert.Equal(t, "ink", string(east.Get("first").Str))
+	assert.Equal(t, 2.5, east.Get("top").F64)
+	assert.Equal(t, 2.0, east.Get("avg").F64)
+	assert.Equal(t, "west", string(out[2].Get("region").Str))
+	assert.Equal(t, int64(1), out[2].Get("priced").I64)
+
+	// grouped by another column, in the order of appearance
+	q := &AggQuery{
+		GroupBy: []string{"item"},
+		Funcs:   funcs[:3],
+		Filter:  func(rec *Record) bool { return rec.Get("qty").I64 > 1 },
+	}
+	out, err = db.Aggregate("sales", nil, q)
+	assert.NoError(t, err)
+	items := []string{}
+	for _, rec := range out {
+		items = append(items, string(rec.Get("item").Str))
+	}
+	assert.Equal(t, []string{"pen", "ink", "cap"}, items)
+	assert.Equal(t, int64(15), out[0].Get("qty").I64)
+
+	// over a scan, no groups
+	sc := &Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddStr("item", []byte("ink")), Key2: *(&Record{}).AddStr("item", []byte("ink")),
+	}
+	out, err = db.Aggregate("sales", sc, &AggQuery{Funcs: funcs})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, int64(2), out[0].Get("n").I64)
+	assert.Equal(t, 4.0, out[0].Get("avg").F64)
+	// no rows is still one group
+	out, err = db.Aggregate("sales", nil, &AggQuery{Funcs: funcs, Filter: func(*Record) bool { return false }})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), out[0].Get("n").I64)
+	assert.Equal(t, uint32(TYPE_NULL), out[0].Get("qty").Type)
+
+	_, err = db.Aggregate("sales", nil, &AggQuery{Funcs: []AggFunc{{Func: AGG_SUM, Col: "item", Name: "x"}}})
+	assert.Error(t, err)
+	_, err = db.Aggregate("sales", nil, &AggQuery{GroupBy: []string{"nope"}})
+	assert.Error(t, err)
+}
+
+func TestAggregateSQL(t *testing.T) {
+	os.Remove("test_agg_ql.db")
+	defer os.Remove("test_agg_ql.db")
+	db := &DB{Path: "test_agg_ql.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	exec("create table t (a int64, b int64, c int64, d decimal null, primary key (a, b))")
+	exec("insert into t values (1, 1, 5, '1.50'), (1, 2, 7, null), (2, 1, 1, '2.25'), (3, 1, 5, '0.10'), (3, 2, 9, '1.00')")
+
+	res := exec("select a, count(*) as n, sum(c), max(c) - min(c) as spread, avg(d) as d from t group by a")
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, []string{"a", "n", "sum ( c )", "spread", "d"}, res[0].Cols)
+	assert.Equal(t, int64(1), res[0].Get("a").I64)
+	assert.Equal(t, int64(2), res[0].Get("n").I64)
+	assert.Equal(t, int64(12), res[0].Get("sum ( c )").I64)
+	assert.Equal(t, int64(2), res[0].Get("spread").I64)
+	assert.Equal(t, "1.5", FormatValue(res[0].Get("d")))
+	assert.Equal(t, "0.55", FormatValue(res[2].Get("d")))
+
+	res = exec("select c, count(*) as n from t where a > 1 group by c")
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, int64(1), res[0].Get("c").I64)
+	assert.Equal(t, int64(5), res[1].Get("c").I64)
+
+	res = exec("select count(*) as n, count(d) as nd, sum(c) * 2 as s from t")
+	assert.Equal(t, int64(5), res[0].Get("n").I64)
+	assert.Equal(t, int64(4), res[0].Get("nd").I64)
+	assert.Equal(t, int64(54), res[0].Get("s").I64)
+	res = exec("select count(*) as n, sum(c) as s from t where a = 9")
+	assert.Equal(t, int64(0), res[0].Get("n").I64)
+	assert.Equal(t, uint32(TYPE_NULL), res[0].Get("s").Type)
+	assert.Equal(t, 0, len(exec("select a, count(*) from t where a = 9 group by a")))
+	// a column named like a function
+	exec("create table u (count int64, primary key (count))")
+	exec("insert into u values (1), (2)")
+	res = exec("select sum(count) as count from u")
+	assert.Equal(t, int64(3), res[0].Get("count").I64)
+
+	// a key prefix is not grouped in order under an index range
+	exec("create table w (g int64, id int64, v int64, primary key (g, id), index (v))")
+	rows := []string{}
+	for i := 0; i < 2000; i++ {
+		rows = append(rows, fmt.Sprintf("(%d, %d, %d)", i%2, i, i/2))
+	}
+	exec("insert into w values " + strings.Join(rows, ", "))
+	exec("analyze w")
+	sql := "select g, count(*) as n from w where v >= 10 and v <= 13 group by g"
+	assert.Equal(t, PLAN_INDEX_RANGE, string(exec("explain " + sql)[0].Get("access").Str))
+	res = exec(sql)
+	assert.Equal(t, 2, len(res))
+	for _, rec := range res {
+		assert.Equal(t, int64(4), rec.Get("n").I64)
+	}
+
+	for _, bad := range []string{
+		"select b, count(*) from t group by a",
+		"select *, count(*) from t",
+		"select sum(count(*)) from t",
+		"select a from t where count(*) > 1",
+		"select a from t group by nope",
+		"select sum(*) from t",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
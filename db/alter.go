@@ -0,0 +1,260 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	. "server"
+	"slices"
+	. "types"
+	. "utils"
+)
+
+// Schema changes.
+//
+// Each row value starts with the schema version it is written with. A
+// change of the non-key columns bumps the version and keeps the old
+// columns in TableDef.Schemas, so that the old rows are still decoded:
+// the dropped columns are skipped and the added columns get the default.
+// The old rows are converted when they are written again, or all at once
+// by a RowRewriter, after which the old schemas are forgotten.
+
+// add a non-key column, the existing rows read it as the default.
+// a column without a default must be nullable.
+func (db *DB) AddColumn(table string, col string, typ uint32, nullable bool, def Value) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	switch {
+	case col == "" || colIndex(tdef, col) >= 0:
+		return fmt.Errorf("bad column name: %q", col)
+	case TypeName(typ) == "?":
+		return fmt.Errorf("bad column type: %s", col)
+	case !nullable && def.Type == TYPE_ERROR:
+		return fmt.Errorf("a column without a default must be nullable: %s", col)
+	case def.Type != TYPE_ERROR && (def.Type != typ || checkValue(&def) != nil):
+		return fmt.Errorf("bad default: %s", col)
+	}
+	newSchemaVersion(tdef)
+	// the optional flags are filled up to the new column
+	for len(tdef.Nullable) < len(tdef.Cols) {
+		tdef.Nullable = append(tdef.Nullable, false)
+	}
+	for len(tdef.Defaults) < len(tdef.Cols) {
+		tdef.Defaults = append(tdef.Defaults, Value{})
+	}
+	tdef.Cols = append(tdef.Cols, col)
+	tdef.Types = append(tdef.Types, typ)
+	tdef.Nullable = append(tdef.Nullable, nullable)
+	tdef.Defaults = append(tdef.Defaults, def)
+	return tableDefSave(db, tdef)
+}
+
+// drop a non-key column that is not indexed
+func (db *DB) DropColumn(table string, col string) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	idx := colIndex(tdef, col)
+	switch {
+	case idx < 0:
+		return fmt.Errorf("unknown column: %s", col)
+	case idx < tdef.PKeys:
+		return fmt.Errorf("cannot drop the primary key: %s", col)
+	}
+	for _, index := range tdef.Indexes {
+		if slices.Contains(index, col) {
+			return fmt.Errorf("cannot drop an indexed column: %s", col)
+		}
+	}
+	if checkUsesCol(tdef, col) {
+		return fmt.Errorf("cannot drop a column used by a check: %s", col)
+	}
+	newSchemaVersion(tdef)
+	dropColumn(tdef, idx)
+	// the old values are skipped, even if the name is reused
+	for _, schema := range tdef.Schemas {
+		if i := slices.Index(schema.Cols, col); i >= 0 {
+			schema.Cols[i] = ""
+		}
+	}
+	return alterColumnSave(db, tdef, col, "")
+}
+
+// rename a column, the rows are unchanged
+func (db *DB) RenameColumn(table string, from string, to string) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	idx := colIndex(tdef, from)
+	switch {
+	case idx < 0:
+		return fmt.Errorf("unknown column: %s", from)
+	case to == "" || colIndex(tdef, to) >= 0:
+		return fmt.Errorf("bad column name: %q", to)
+	case checkUsesCol(tdef, from):
+		return fmt.Errorf("cannot rename a column used by a check: %s", from)
+	}
+	tdef.Cols[idx] = to
+	for _, index := range tdef.Indexes {
+		if i := slices.Index(index, from); i >= 0 {
+			index[i] = to
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if i := slices.Index(fk.Cols, from); i >= 0 {
+			fk.Cols[i] = to
+		}
+	}
+	for _, schema := range tdef.Schemas {
+		if i := slices.Index(schema.Cols, from); i >= 0 {
+			schema.Cols[i] = to
+		}
+	}
+	return alterColumnSave(db, tdef, from, to)
+}
+
+// save a table with a renamed or dropped column, the statistics of the
+// column are renamed to `to` or dropped if it is empty, in the same commit.
+func alterColumnSave(db *DB, tdef *TableDef, from string, to string) error {
+	stats := getTableStats(db, tdef)
+	if stats.column(from) == nil {
+		return tableDefSave(db, tdef)
+	}
+	moved := &TableStats{Rows: stats.Rows}
+	for _, col := range stats.Cols {
+		if col.Name == from && to == "" {
+			continue
+		}
+		if col.Name == from {
+			col.Name = to
+		}
+		moved.Cols = append(moved.Cols, col)
+	}
+	def, err := json.Marshal(tdef)
+	Assert(err == nil)
+	data, err := json.Marshal(moved)
+	Assert(err == nil)
+	b := &Batch{}
+	batchRow(b, TDEF_TABLE, []Value{{Type: TYPE_BYTES, Str: []byte(tdef.Name)}, {Type: TYPE_BYTES, Str: def}})
+	batchRow(b, TDEF_META, []Value{*statsKey(tdef.Name).Get("key"), {Type: TYPE_BYTES, Str: data}})
+	if _, err := db.kv.Commit(b); err != nil {
+		return err
+	}
+	db.stats[tdef.Name] = moved
+	db.refs = nil
+	tdef.exprs = nil
+	return nil
+}
+
+// keep the current non-key columns as an old schema and bump the version
+func newSchemaVersion(tdef *TableDef) {
+	cols := tdef.Cols[tdef.PKeys:]
+	tdef.Schemas = append(tdef.Schemas, TableSchema{
+		Version:  tdef.Version,
+		Cols:     append([]string{}, cols...),
+		Types:    append([]uint32{}, tdef.Types[tdef.PKeys:]...),
+		Nullable: nullableCols(tdef, cols),
+	})
+	tdef.Version++
+}
+
+func dropColumn(tdef *TableDef, idx int) {
+	tdef.Cols = slices.Delete(tdef.Cols, idx, idx+1)
+	tdef.Types = slices.Delete(tdef.Types, idx, idx+1)
+	if idx < len(tdef.Nullable) {
+		tdef.Nullable = slices.Delete(tdef.Nullable, idx, idx+1)
+	}
+	if idx < len(tdef.Defaults) {
+		tdef.Defaults = slices.Delete(tdef.Defaults, idx, idx+1)
+	}
+	if idx < len(tdef.DefaultExprs) {
+		tdef.DefaultExprs = slices.Delete(tdef.DefaultExprs, idx, idx+1)
+	}
+}
+
+// the conversion of the old rows to the current schema
+type RowRewriter struct {
+	db      *DB
+	tdef    *TableDef
+	version uint32 // the rows before this version are converted
+	prefix  uint32 // the table prefix when started
+	next    []byte // the scan resumes from here
+	done    bool
+}
+
+// start converting the old rows of a table, the returned rewriter
+// is run in steps like an IndexBuilder.
+func (db *DB) RewriteRows(table string) (*RowRewriter, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	next := encodeKey(nil, tdef.Prefix, nil)
+	return &RowRewriter{db: db, tdef: tdef, version: tdef.Version, prefix: tdef.Prefix, next: next}, nil
+}
+
+// convert up to n rows in one commit, returns true when no old rows are left.
+func (r *RowRewriter) Step(n int) (bool, error) {
+	if r.done {
+		return true, nil
+	}
+	if r.tdef = currentTableDef(r.db, r.tdef.Name, r.prefix); r.tdef == nil {
+		return false, ErrTableChanged
+	}
+	db, tdef := r.db, r.tdef
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	sc := Scanner{tdef: tdef, index: -1, iter: db.kv.GetTree().Seek(r.next, CMP_GE)}
+	batch := &Batch{}
+	count, more := 0, true
+	for ; count < n; sc.iter.Next() {
+		if !sc.iter.Valid() {
+			more = false
+			break
+		}
+		key, val := sc.iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			more = false
+			break
+		}
+		if version, _ := binary.Uvarint(val); uint32(version) != tdef.Version {
+			rec := Record{}
+			sc.Deref(&rec)
+			batch.Set(append([]byte{}, key...), encodeRow(tdef, rec.Vals))
+		}
+		r.next = append(append([]byte{}, key...), 0) // the next possible key
+		count++
+	}
+	if _, err := db.kv.Commit(batch); err != nil {
+		return false, err
+	}
+	if more {
+		return false, nil
+	}
+	// the rows are at least at the starting version now
+	tdef.Schemas = slices.DeleteFunc(tdef.Schemas, func(schema TableSchema) bool {
+		return schema.Version < r.version
+	})
+	if len(tdef.Schemas) == 0 {
+		tdef.Schemas = nil
+	}
+	if err := tableDefSave(db, tdef); err != nil {
+		return false, err
+	}
+	r.done = true
+	return true, nil
+}
+
+// convert the whole table, n rows per commit
+func (r *RowRewriter) Run(n int) error {
+	for {
+		done, err := r.Step(n)
+		if err != nil || done {
+			return err
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlterTable(t *testing.T) {
+	os.Remove("test_alter.db")
+	defer os.Remove("test_alter.db")
+	db := &DB{Path: "test_alter.db"}
+	assert.NoError(t, db.Open())
+
+	tdef := &TableDef{
+		Name:    "people",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	for i, name := range []string{"alice", "bob", "carol"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("name", []byte(name)).AddInt64("age", int64(20+i))
+		_, err := db.Insert("people", *rec)
+		assert.NoError(t, err)
+	}
+	get := func(id int64) *Record {
+		rec := (&Record{}).AddInt64("id", id)
+		ok, err := db.Get("people", rec)
+		assert.True(t, ok && err == nil)
+		return rec
+	}
+
+	// add a column, the old rows get the default
+	assert.Error(t, db.AddColumn("people", "city", TYPE_BYTES, false, Value{}))
+	assert.Error(t, db.AddColumn("people", "name", TYPE_BYTES, true, Value{}))
+	assert.Error(t, db.AddColumn("people", "city", TYPE_BYTES, false, Value{Type: TYPE_INT64}))
+	assert.NoError(t, db.AddColumn("people", "city", TYPE_BYTES, false, Value{Type: TYPE_BYTES, Str: []byte("paris")}))
+	assert.NoError(t, db.AddColumn("people", "score", TYPE_FLOAT64, true, Value{}))
+	assert.Equal(t, uint32(2), db.GetTableDef("people").Version)
+	rec := get(1)
+	assert.Equal(t, []string{"id", "name", "age", "city", "score"}, rec.Cols)
+	assert.Equal(t, "paris", string(rec.Get("city").Str))
+	assert.Equal(t, uint32(TYPE_NULL), rec.Get("score").Type)
+	// a new row omits the column with a default
+	rec = (&Record{}).AddInt64("id", 4).AddStr("name", []byte("dave")).AddInt64("age", 40).AddFloat64("score", 1.5)
+	_, err := db.Insert("people", *rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "paris", string(get(4).Get("city").Str))
+
+	// drop a column
+	assert.Error(t, db.DropColumn("people", "id"))
+	assert.Error(t, db.DropColumn("people", "age")) // indexed
+	assert.Error(t, db.DropColumn("people", "nope"))
+	assert.NoError(t, db.DropColumn("people", "name"))
+	rec = get(2)
+	assert.Equal(t, []string{"id", "age", "city", "score"}, rec.Cols)
+	assert.Equal(t, int64(21), rec.Get("age").I64)
+	// the name of a dropped column can be reused, the old values are gone
+	assert.NoError(t, db.AddColumn("people", "name", TYPE_BYTES, true, Value{}))
+	assert.Equal(t, uint32(TYPE_NULL), get(2).Get("name").Type)
+	assert.Equal(t, uint32(TYPE_NULL), get(4).Get("name").Type)
+
+	// rename a column, also in the index
+	assert.Error(t, db.RenameColumn("people", "age", "city"))
+	assert.NoError(t, db.RenameColumn("people", "age", "years"))
+	assert.NoError(t, db.RenameColumn("people", "city", "town"))
+	assert.Equal(t, [][]string{{"years", "id"}}, db.GetTableDef("people").Indexes)
+	rec = get(3)
+	assert.Equal(t, int64(22), rec.Get("years").I64)
+	assert.Equal(t, "paris", string(rec.Get("town").Str))
+	sc := Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddInt64("years", 21), Key2: *(&Record{}).AddInt64("years", 40),
+	}
+	assert.NoError(t, db.Scan("people", &sc))
+	ids := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		ids = append(ids, rec.Get("id").I64)
+	}
+	assert.Equal(t, []int64{2, 3, 4}, ids)
+
+	// the definition survives a reopen
+	before := get(1)
+	db.Close()
+	db = &DB{Path: "test_alter.db"}
+	assert.NoError(t, db.Open())
+	assert.Equal(t, before, get(1))
+
+	// rewrite the old rows
+	tdef = db.GetTableDef("people")
+	assert.Equal(t, 4, len(tdef.Schemas))
+	rw, err := db.RewriteRows("people")
+	assert.NoError(t, err)
+	done, err := rw.Step(2)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.NoError(t, rw.Run(2))
+	assert.Nil(t, tdef.Schemas)
+	for id := int64(1); id <= 4; id++ {
+		val, ok := db.kv.Get(encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_INT64, I64: id}}))
+		assert.True(t, ok)
+		version, _ := binary.Uvarint(val)
+		assert.Equal(t, uint64(tdef.Version), version)
+	}
+	assert.Equal(t, before, get(1))
+	db.Close()
+}
+
+func TestAlterSQL(t *testing.T) {
+	os.Remove("test_alter_ql.db")
+	defer os.Remove("test_alter_ql.db")
+	db := &DB{Path: "test_alter_ql.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) QLResult {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res
+	}
+	exec("create table t (id int64, a int64 default -1, b bytes)")
+	assert.Equal(t, int64(-1), db.GetTableDef("t").Defaults[1].I64)
+	exec("insert into t (id, b) values (1, 'x')")
+	exec("alter table t add column c float64 default 2")
+	exec("alter table t add d bytes null")
+	exec("alter table t drop column b")
+	exec("alter table t rename a to aa")
+	res := exec("select * from t")
+	assert.Equal(t, []string{"id", "aa", "c", "d"}, res.Records[0].Cols)
+	assert.Equal(t, int64(-1), res.Records[0].Get("aa").I64)
+	assert.Equal(t, 2.0, res.Records[0].Get("c").F64)
+	assert.Equal(t, uint32(TYPE_NULL), res.Records[0].Get("d").Type)
+
+	for _, bad := range []string{
+		"alter table t add e int64",
+		"alter table t add e int64 primary key default 1",
+		"alter table t add e int64 default 'x'",
+		"alter table t drop id",
+		"alter table t rename aa to c",
+		"alter table nope drop c",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Column defaults and CHECK constraints.
+//
+// A column missing in a written row gets its default: a constant in
+// TableDef.Defaults, filled by checkRecord, or an expression in
+// TableDef.DefaultExprs, computed for each row. The expression has no
+// columns and may call now(), or be a single nextval('sequence').
+//
+// TableDef.Checks are SQL conditions on the columns of a row, such as
+// `age >= 0 AND age < 200` or `length(name) > 0`. A row is rejected when a
+// condition is false; NULL is unknown and passes, as in SQL.
+
+// the parsed expressions of a table, cached in the definition
+type tableExprs struct {
+	defaults []*QLNode // by column, nil for none
+	checks   []*QLNode
+}
+
+func hasDefaultExpr(tdef *TableDef, col int) bool {
+	return col < len(tdef.DefaultExprs) && tdef.DefaultExprs[col] != ""
+}
+
+// a missing column can be filled in
+func hasDefault(tdef *TableDef, col int) bool {
+	return colDefault(tdef, col).Type != TYPE_ERROR || hasDefaultExpr(tdef, col)
+}
+
+// check and parse the default expressions and the conditions
+func parseTableExprs(tdef *TableDef) (*tableExprs, error) {
+	if len(tdef.DefaultExprs) > len(tdef.Cols) {
+		return nil, fmt.Errorf("bad column defaults: %s", tdef.Name)
+	}
+	out := &tableExprs{defaults: make([]*QLNode, len(tdef.DefaultExprs))}
+	for i, expr := range tdef.DefaultExprs {
+		if expr == "" {
+			continue
+		}
+		col := tdef.Cols[i]
+		if i < tdef.PKeys || i < len(tdef.Defaults) && tdef.Defaults[i].Type != TYPE_ERROR {
+			return nil, fmt.Errorf("bad default: %s", col)
+		}
+		node, err := ParseExpr(expr)
+		if err != nil {
+			return nil, fmt.Errorf("bad default: %s: %w", col, err)
+		}
+		if len(qlColumns(node, nil)) > 0 || qlHasAgg(*node) {
+			return nil, fmt.Errorf("bad default: %s: only constants and functions", col)
+		}
+		if qlHasNextval(*node) && !isNextval(node) {
+			return nil, fmt.Errorf("bad default: %s: nextval() must be the whole default", col)
+		}
+		out.defaults[i] = node
+	}
+	for _, cond := range tdef.Checks {
+		node, err := ParseExpr(cond)
+		if err != nil {
+			return nil, fmt.Errorf("bad check: %s: %w", cond, err)
+		}
+		for _, col := range qlColumns(node, nil) {
+			if colIndex(tdef, col) < 0 {
+				return nil, fmt.Errorf("bad check: %s: unknown column: %s", cond, col)
+			}
+		}
+		if qlHasAgg(*node) || qlHasNextval(*node) {
+			return nil, fmt.Errorf("bad check: %s", cond)
+		}
+		out.checks = append(out.checks, node)
+	}
+	return out, nil
+}
+
+func isNextval(node *QLNode) bool {
+	return node.Type == QL_FUNC && string(node.Str) == "nextval"
+}
+func qlHasNextval(node QLNode) bool {
+	return isNextval(&node) || slices.ContainsFunc(node.Kids, qlHasNextval)
+}
+
+// the cached expressions, checked by tableDefCheck
+func getTableExprs(tdef *TableDef) *tableExprs {
+	if tdef.exprs == nil {
+		exprs, err := parseTableExprs(tdef)
+		if err != nil {
+			panic(err) // a saved definition is valid
+		}
+		tdef.exprs = exprs
+	}
+	return tdef.exprs
+}
+
+// compute the missing columns that have a default expression,
+// the caller's record is not modified
+func fillDefaults(db *DB, tdef *TableDef, rec Record) (Record, error) {
+	if len(tdef.DefaultExprs) == 0 {
+		return rec, nil
+	}
+	out := Record{Cols: slices.Clone(rec.Cols), Vals: slices.Clone(rec.Vals)}
+	for i, node := range getTableExprs(tdef).defaults {
+		if node == nil || rec.Get(tdef.Cols[i]).Type != TYPE_ERROR {
+			continue
+		}
+		val, err := evalDefault(db, node)
+		if err == nil {
+			val, err = qlConvert(val, tdef.Types[i])
+		}
+		if err != nil {
+			return rec, fmt.Errorf("default of %s: %w", tdef.Cols[i], err)
+		}
+		out.Cols = append(out.Cols, tdef.Cols[i])
+		out.Vals = append(out.Vals, val)
+	}
+	return out, nil
+}
+
+func evalDefault(db *DB, node *QLNode) (Value, error) {
+	if !isNextval(node) {
+		return qlEval(nil, node)
+	}
+	name, err := qlEval(nil, &node.Kids[0])
+	if err != nil {
+		return name, err
+	}
+	if name.Type != TYPE_BYTES {
+		return Value{}, fmt.Errorf("nextval() expects a sequence name")
+	}
+	id, err := db.NextVal(string(name.Str))
+	return Value{Type: TYPE_INT64, I64: id}, err
+}
+
+// the row must pass the CHECK conditions
+func checkRow(tdef *TableDef, values []Value) error {
+	if len(tdef.Checks) == 0 {
+		return nil
+	}
+	rec := Record{Cols: tdef.Cols, Vals: values}
+	for i, node := range getTableExprs(tdef).checks {
+		val, err := qlEval(&rec, node)
+		if err != nil {
+			return fmt.Errorf("%w: check %s: %w", ErrInvalidRecord, tdef.Checks[i], err)
+		}
+		if val.Type == TYPE_NULL {
+			continue
+		}
+		if ok, err := qlTruth(&val); err != nil || !ok {
+			return &ConstraintError{
+				Table: tdef.Name, Kind: "check", Cols: qlColumns(node, nil), Detail: tdef.Checks[i],
+			}
+		}
+	}
+	return nil
+}
+
+// a column used by a CHECK condition
+func checkUsesCol(tdef *TableDef, col string) bool {
+	for _, node := range getTableExprs(tdef).checks {
+		if slices.Contains(qlColumns(node, nil), col) {
+			return true
+		}
+	}
+	return false
+}
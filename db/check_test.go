@@ -0,0 +1,97 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultsAndChecks(t *testing.T) {
+	os.Remove("test_check.db")
+	defer os.Remove("test_check.db")
+	db := &DB{Path: "test_check.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	isCheck := func(err error, detail string) {
+		var cerr *ConstraintError
+		if assert.ErrorAs(t, err, &cerr) {
+			assert.Equal(t, "check", cerr.Kind)
+			assert.Equal(t, detail, cerr.Detail)
+		}
+	}
+
+	assert.NoError(t, db.CreateSequence("tickets", 100))
+	exec(`create table t (
+		id int64,
+		name bytes check (length(name) > 0) check (length(name) <= 8),
+		age int64 null,
+		at timestamp default now(),
+		ticket int64 default nextval('tickets'),
+		score int64 default 7,
+		primary key (id),
+		check (age >= 0 and age < 200))`)
+	tdef := getTableDef(db, "t")
+	assert.Equal(t, []string{"", "", "", "now ( )", "nextval ( 'tickets' )", ""}, tdef.DefaultExprs)
+	assert.Equal(t, 3, len(tdef.Checks))
+
+	// the computed defaults
+	before := time.Now().UnixMicro()
+	exec("insert into t (id, name) values (1, 'a'), (2, 'b')")
+	_, err := db.Insert("t", *(&Record{}).AddInt64("id", 3).AddStr("name", []byte("c")).AddInt64("ticket", 5))
+	assert.NoError(t, err)
+	rows := exec("select id, at, ticket, score, age from t")
+	assert.Equal(t, 3, len(rows))
+	assert.GreaterOrEqual(t, rows[0].Get("at").I64, before)
+	assert.Equal(t, int64(100), rows[0].Get("ticket").I64)
+	assert.Equal(t, int64(101), rows[1].Get("ticket").I64)
+	assert.Equal(t, int64(5), rows[2].Get("ticket").I64)
+	assert.Equal(t, int64(7), rows[2].Get("score").I64)
+	assert.Equal(t, "NULL", FormatValue(rows[0].Get("age")))
+	assert.Equal(t, 3, len(exec("select id from t where at <= now()")))
+
+	// the checks
+	_, err = db.ExecSQL("insert into t (id, name) values (4, '')")
+	isCheck(err, "length ( name ) > 0")
+	assert.Contains(t, err.Error(), "check constraint violation: t (name): length ( name ) > 0")
+	_, err = db.ExecSQL("insert into t (id, name) values (4, 'too long name')")
+	isCheck(err, "length ( name ) <= 8")
+	_, err = db.ExecSQL("update t set age = 300 where id = 1")
+	isCheck(err, "age >= 0 and age < 200")
+	_, err = db.Upsert("t", *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("a")).AddInt64("age", -1))
+	isCheck(err, "age >= 0 and age < 200")
+	exec("update t set age = 30 where id = 1")
+
+	// the columns of the checks are kept
+	assert.Error(t, db.DropColumn("t", "age"))
+	assert.Error(t, db.RenameColumn("t", "name", "title"))
+	assert.NoError(t, db.DropColumn("t", "ticket"))
+	assert.Equal(t, []string{"", "", "", "now ( )", ""}, getTableDef(db, "t").DefaultExprs)
+	exec("insert into t (id, name) values (5, 'e')")
+
+	for _, bad := range []string{
+		"create table x (id int64, a int64 default id)",
+		"create table x (id int64, a int64 default nextval('tickets') + 1)",
+		"create table x (id int64, a int64 default count(*))",
+		"create table x (id int64 default now())",
+		"create table x (id int64, a int64, check (b > 0))",
+		"create table x (id int64, a int64, check (nextval('tickets') > 0))",
+		"create table x (id int64, a int64 default length())",
+		"alter table t add b timestamp null default now()",
+		"select nextval('tickets') from t",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+	// a missing sequence
+	exec("create table y (id int64, a int64 default nextval('nope'))")
+	_, err = db.ExecSQL("insert into y (id) values (1)")
+	assert.ErrorIs(t, err, ErrSequenceNotFound)
+}
@@ -0,0 +1,299 @@
+package db
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	. "types"
+	"unicode/utf8"
+)
+
+// CSV import and export.
+//
+// The first line is the header of the column names. A field is the text
+// form of the value, see FormatValue, and \N is NULL. Bytes can be
+// anything, so they are escaped to keep every row on one line: a backslash
+// is doubled, and the control characters and invalid UTF-8 are written as
+// \xHH. An empty field of a column that is not bytes is also NULL.
+//
+// The import maps the header to the columns of the table; the missing
+// columns get their defaults. A row that fails to parse or to be written
+// is reported with its line number and skipped, the others go on. The
+// rows are written in batches of CSVOptions.BatchSize, each flushed as a
+// single commit.
+
+const (
+	CSV_NULL       = `\N`
+	CSV_BATCH_SIZE = 1000
+)
+
+type CSVOptions struct {
+	Mode      int // MODE_UPSERT or MODE_INSERT_ONLY
+	BatchSize int // the rows per commit, CSV_BATCH_SIZE if 0
+	MaxErrors int // stop after so many bad rows, 0 for no limit
+}
+
+// a bad row of the import
+type CSVRowError struct {
+	Line int // the line of the row, from 1
+	Err  error
+}
+
+func (e *CSVRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+func (e *CSVRowError) Unwrap() error {
+	return e.Err
+}
+
+type CSVReport struct {
+	Rows   int // the rows written
+	Errors []CSVRowError
+}
+
+var ErrTooManyErrors = errors.New("too many bad rows")
+
+// escape the bytes of a field
+func csvEscape(data []byte) string {
+	out := strings.Builder{}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == '\\':
+			out.WriteString(`\\`)
+		case (r == utf8.RuneError && size == 1) || r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, `\x%02x`, data[0])
+		default:
+			out.Write(data[:size])
+		}
+		data = data[size:]
+	}
+	return out.String()
+}
+
+// the reverse of csvEscape
+func csvUnescape(str string) ([]byte, error) {
+	if !strings.Contains(str, `\`) {
+		return []byte(str), nil
+	}
+	out := []byte{}
+	for i := 0; i < len(str); i++ {
+		if str[i] != '\\' {
+			out = append(out, str[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(str[i:], `\\`):
+			out = append(out, '\\')
+			i++
+		case strings.HasPrefix(str[i:], `\x`) && i+4 <= len(str):
+			b, err := strconv.ParseUint(str[i+2:i+4], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad escape: %q", str[i:i+4])
+			}
+			out = append(out, byte(b))
+			i += 3
+		default:
+			return nil, fmt.Errorf("bad escape at %d", i)
+		}
+	}
+	return out, nil
+}
+
+// the field of a value
+func csvFormat(val *Value) string {
+	switch val.Type {
+	case TYPE_NULL:
+		return CSV_NULL
+	case TYPE_BYTES:
+		return csvEscape(val.Str)
+	default:
+		return FormatValue(val)
+	}
+}
+
+// the value of a field
+func csvParse(typ uint32, field string) (Value, error) {
+	if field == CSV_NULL || (field == "" && typ != TYPE_BYTES) {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	if typ == TYPE_BYTES {
+		str, err := csvUnescape(field)
+		return Value{Type: TYPE_BYTES, Str: str}, err
+	}
+	return ParseValue(typ, field)
+}
+
+// writes rows as CSV, the header first
+type CSVWriter struct {
+	w      *csv.Writer
+	cols   []string
+	fields []string
+}
+
+func NewCSVWriter(w io.Writer, cols []string) (*CSVWriter, error) {
+	cw := &CSVWriter{w: csv.NewWriter(w), cols: cols, fields: make([]string, len(cols))}
+	if err := cw.w.Write(cols); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// write the columns of the header from a row
+func (cw *CSVWriter) Write(rec *Record) error {
+	for i, col := range cw.cols {
+		val := rec.Get(col)
+		if val.Type == TYPE_ERROR {
+			return fmt.Errorf("missing column: %s", col)
+		}
+		cw.fields[i] = csvFormat(val)
+	}
+	return cw.w.Write(cw.fields)
+}
+
+func (cw *CSVWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// write the rows of a started scan, see DB.Scan
+func ExportScanCSV(w io.Writer, sc *Scanner) error {
+	cols := sc.Cols
+	if len(cols) == 0 {
+		cols = sc.tdef.Cols
+	}
+	cw, err := NewCSVWriter(w, cols)
+	if err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		if err := cw.Write(&rec); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// write every row of a table in primary key order
+func (db *DB) ExportCSV(table string, w io.Writer) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	cw, err := NewCSVWriter(w, tdef.Cols)
+	if err != nil {
+		return err
+	}
+	dbScanAll(db, tdef, func(rec *Record) bool {
+		err = cw.Write(rec)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// read the rows of a CSV into a table
+func (db *DB) ImportCSV(table string, r io.Reader, opts CSVOptions) (*CSVReport, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if opts.Mode != MODE_UPSERT && opts.Mode != MODE_INSERT_ONLY {
+		return nil, fmt.Errorf("bad import mode: %d", opts.Mode)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = CSV_BATCH_SIZE
+	}
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing CSV header")
+	} else if err != nil {
+		return nil, err
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff") // the byte order mark
+	types := make([]uint32, len(header))
+	for i, col := range header {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown column: %s", col)
+		}
+		if slices.Index(header, col) != i {
+			return nil, fmt.Errorf("duplicate column: %s", col)
+		}
+		types[i] = tdef.Types[idx]
+	}
+
+	// the writes are applied row by row, and flushed once per batch
+	db.batching = true
+	report, err := csvImport(db, tdef, cr, header, types, opts)
+	db.batching = false
+	if ferr := db.kv.Flush(); err == nil {
+		err = ferr
+	}
+	return report, err
+}
+
+func csvImport(db *DB, tdef *TableDef, cr *csv.Reader, header []string, types []uint32, opts CSVOptions) (*CSVReport, error) {
+	report := &CSVReport{}
+	pending := 0
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return report, nil
+		}
+		line := 0
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			line = perr.StartLine
+		} else if err != nil {
+			return report, err
+		} else {
+			line, _ = cr.FieldPos(0)
+			err = csvImportRow(db, tdef, header, types, fields, opts.Mode)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, CSVRowError{Line: line, Err: err})
+			if opts.MaxErrors > 0 && len(report.Errors) >= opts.MaxErrors {
+				return report, ErrTooManyErrors
+			}
+			continue
+		}
+		report.Rows++
+		if pending++; pending >= opts.BatchSize {
+			pending = 0
+			if err := db.kv.Flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+}
+
+// parse and write a row
+func csvImportRow(db *DB, tdef *TableDef, header []string, types []uint32, fields []string, mode int) error {
+	rec := Record{}
+	for i, field := range fields {
+		val, err := csvParse(types[i], field)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", header[i], err)
+		}
+		rec.Cols = append(rec.Cols, header[i])
+		rec.Vals = append(rec.Vals, val)
+	}
+	if _, err := autoIncrement(db, tdef, &rec); err != nil {
+		return err
+	}
+	_, err := dbUpdate(db, tdef, rec, mode)
+	return err
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	. "server"
+	"strings"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVEscape(t *testing.T) {
+	for _, data := range []string{"", "plain", `a\b`, "a,\"b\"\r\n", "\x00\x7f\xff", "héllo", `\N`, `\x41`} {
+		str := csvEscape([]byte(data))
+		assert.NotContains(t, str, "\n")
+		assert.NotContains(t, str, "\r")
+		out, err := csvUnescape(str)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(out), str)
+	}
+	assert.Equal(t, `a\\b\x0a\xff`, csvEscape([]byte("a\\b\n\xff")))
+	for _, bad := range []string{`\`, `\q`, `\x4`, `\xzz`} {
+		_, err := csvUnescape(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	os.Remove("test_csv.db")
+	defer os.Remove("test_csv.db")
+	db := &DB{Path: "test_csv.db"}
+	assert.NoError(t, db.Open())
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	exec(`create table t (
+		id int64 auto_increment,
+		name bytes,
+		score float64 null,
+		note bytes null,
+		rank int64 default 7,
+		primary key (id),
+		unique index (name))`)
+
+	input := "\ufeffname,score,note\n" +
+		"alice,1.5,\\N\n" +
+		"\"bob, jr\",,\"say \"\"hi\"\"\"\n" +
+		"carol,x,\n" + // a bad number
+		"alice,2,dup\n" + // a unique violation
+		"dave,3\n" + // a missing field
+		"erin,4,\\x00\\xff\\\\\n"
+	report, err := db.ImportCSV("t", strings.NewReader(input), CSVOptions{Mode: MODE_INSERT_ONLY, BatchSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Rows)
+	lines := []int{}
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	assert.Equal(t, []int{4, 5, 6}, lines)
+	assert.Contains(t, report.Errors[0].Error(), "line 4: column score")
+	var cerr *ConstraintError
+	assert.ErrorAs(t, &report.Errors[1], &cerr)
+
+	rows := exec("select id, name, score, note, rank from t")
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, int64(1), rows[0].Get("id").I64)
+	assert.Equal(t, "NULL", FormatValue(rows[0].Get("note")))
+	assert.Equal(t, int64(7), rows[0].Get("rank").I64)
+	assert.Equal(t, "bob, jr", string(rows[1].Get("name").Str))
+	assert.Equal(t, "NULL", FormatValue(rows[1].Get("score")))
+	assert.Equal(t, `say "hi"`, string(rows[1].Get("note").Str))
+	assert.Equal(t, "\x00\xff\\", string(rows[2].Get("note").Str))
+
+	// the export reads back the same
+	out := bytes.Buffer{}
+	assert.NoError(t, db.ExportCSV("t", &out))
+	assert.Equal(t, "id,name,score,note,rank\n"+
+		"1,alice,1.5,\\N,7\n"+
+		"2,\"bob, jr\",\\N,\"say \"\"hi\"\"\",7\n"+
+		"4,erin,4,\\x00\\xff\\\\,7\n", out.String())
+	exec("create table u (id int64, name bytes, score float64 null, note bytes null, rank int64, primary key (id))")
+	report, err = db.ImportCSV("u", bytes.NewReader(out.Bytes()), CSVOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Rows)
+	assert.Empty(t, report.Errors)
+	again := bytes.Buffer{}
+	assert.NoError(t, db.ExportCSV("u", &again))
+	assert.Equal(t, out.String(), again.String())
+
+	// upsert replaces, insert fails
+	report, err = db.ImportCSV("u", strings.NewReader("id,name,rank\n1,ann,1\n9,zed,2\n"), CSVOptions{Mode: MODE_UPSERT})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Rows)
+	assert.Equal(t, "ann", string(exec("select name from u where id = 1")[0].Get("name").Str))
+	report, err = db.ImportCSV("u", strings.NewReader("id,name,rank\n1,x,1\n2,y,1\n"), CSVOptions{Mode: MODE_INSERT_ONLY, MaxErrors: 2})
+	assert.ErrorIs(t, err, ErrTooManyErrors)
+	assert.Equal(t, 0, report.Rows)
+	assert.ErrorIs(t, &report.Errors[0], ErrKeyExist)
+
+	// a scan result
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Cols: []string{"name", "id"}}
+	sc.Key1.AddInt64("id", 2)
+	sc.Key2.AddInt64("id", 6)
+	assert.NoError(t, db.Scan("u", &sc))
+	out.Reset()
+	assert.NoError(t, ExportScanCSV(&out, &sc))
+	assert.Equal(t, "name,id\n\"bob, jr\",2\nerin,4\n", out.String())
+
+	// the writes are durable
+	db.Close()
+	db = &DB{Path: "test_csv.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, 4, len(exec("select id from u")))
+	_, err = db.Insert("t", *(&Record{}).AddStr("name", []byte("frank")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), exec("select id from t where name = 'frank'")[0].Get("id").I64)
+
+	for _, bad := range []string{"", "nope\n1\n", "id,id\n1,1\n"} {
+		_, err := db.ImportCSV("u", strings.NewReader(bad), CSVOptions{})
+		assert.Error(t, err, bad)
+	}
+	_, err = db.ImportCSV("u", strings.NewReader("id\n"), CSVOptions{Mode: MODE_UPDATE_ONLY})
+	assert.Error(t, err)
+	_, err = db.ImportCSV("nope", strings.NewReader("id\n"), CSVOptions{})
+	assert.ErrorIs(t, err, ErrTableNotFound)
+}
@@ -7,14 +7,25 @@ import (
 	"errors"
 	"fmt"
 	. "server"
+	"slices"
+	"strings"
+	"time"
 	. "utils"
 )
 
-const TABLE_PREFIX_MIN = 1
+// prefixes below are reserved for the internal tables, @meta and @table
+// take 1 and 2, the rest is room for more without moving the user tables.
+// a file whose prefix counter is lower moves it up on the next allocation.
+const TABLE_PREFIX_MIN = 100
 const (
 	TYPE_ERROR uint32 = iota
 	TYPE_BYTES
 	TYPE_INT64
+	TYPE_FLOAT64
+	TYPE_BOOL      // I64 is 0 or 1
+	TYPE_TIMESTAMP // I64 is microseconds since the Unix epoch
+	TYPE_DECIMAL   // I64 is in units of 10^-DECIMAL_SCALE
+	TYPE_NULL      // the missing value of a nullable column, not a column type
 )
 
 // table cell
@@ -22,6 +33,7 @@ type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
+	F64  float64
 }
 type Record struct {
 	Cols []string
@@ -38,6 +50,33 @@ func (rec *Record) AddInt64(key string, val int64) *Record {
 	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
 	return rec
 }
+func (rec *Record) AddFloat64(key string, val float64) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+	return rec
+}
+func (rec *Record) AddBool(key string, val bool) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BOOL, I64: boolToInt64(val)})
+	return rec
+}
+func (rec *Record) AddTime(key string, val time.Time) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_TIMESTAMP, I64: val.UnixMicro()})
+	return rec
+}
+
+// the decimal in units, see ParseDecimal
+func (rec *Record) AddDecimal(key string, units int64) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_DECIMAL, I64: units})
+	return rec
+}
+func (rec *Record) AddNull(key string) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_NULL})
+	return rec
+}
 func (rec *Record) Get(key string) *Value {
 	for i, col := range rec.Cols {
 		if col == key {
@@ -51,7 +90,44 @@ type DB struct {
 	Path string
 	// internals
 	kv     *KV
-	tables map[string]*TableDef // cached table definition
+	tables map[string]*TableDef   // cached table definition
+	seqs   map[string]*sequence   // the reserved sequence values
+	refs   map[string][]string    // the tables with foreign keys to a table
+	stats  map[string]*TableStats // loaded statistics, nil if not analyzed
+	// the row writes are applied but not flushed
+	batching bool
+}
+
+var (
+	ErrTableNotFound = errors.New("table not found")
+	ErrTableExists   = errors.New("table exists")
+	ErrInvalidRecord = errors.New("invalid record") // the values do not fit the table
+)
+
+// a row is rejected by a table constraint
+type ConstraintError struct {
+	Table  string
+	Kind   string   // "unique", "foreign key", "check"
+	Cols   []string // the constrained columns
+	Detail string   // optional, the condition of a check
+}
+
+func (e *ConstraintError) Error() string {
+	msg := fmt.Sprintf("%s constraint violation: %s (%s)", e.Kind, e.Table, strings.Join(e.Cols, ", "))
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (db *DB) Open() error {
+	db.kv = NewKv(db.Path)
+	db.tables = map[string]*TableDef{}
+	return db.kv.Open()
+}
+func (db *DB) Close() {
+	seqFlush(db) // best effort, a failure only leaves a gap
+	db.kv.Close()
 }
 
 // table definition
@@ -61,8 +137,79 @@ type TableDef struct {
 	Types []uint32 // column types
 	Cols  []string // column names
 	PKeys int      // the first PKeys columns are the primary key
-	// auto-assigned B-tree key prefixes for different tables
-	Prefix uint32
+	// secondary indexes, the missing primary key columns are appended
+	// except for the unique indexes, which store the primary key as value.
+	Indexes  [][]string
+	Unique   []bool  // optional, the indexes that reject duplicates
+	Building []bool  // optional, the indexes being backfilled, unused by queries
+	Nullable []bool  // optional, the non-key columns that accept NULL
+	Defaults []Value // optional, the values of the missing non-key columns
+	// optional, the defaults computed for each row, and the conditions on
+	// the rows, as SQL expressions. see check.go.
+	DefaultExprs []string
+	Checks       []string
+	// the single int64 primary key is assigned from a sequence if missing
+	AutoIncrement bool
+	ForeignKeys   []ForeignKey // optional, see foreign.go
+	// the schema version of the new rows, and the older versions that
+	// may still be in rows. see alter.go.
+	Version uint32
+	Schemas []TableSchema
+	// auto-assigned B-tree key prefixes for different tables and indexes
+	Prefix        uint32
+	IndexPrefixes []uint32
+	// internal
+	exprs *tableExprs // parsed DefaultExprs and Checks
+}
+
+// the non-key columns of an older schema version,
+// the dropped columns have an empty name.
+type TableSchema struct {
+	Version  uint32
+	Cols     []string
+	Types    []uint32
+	Nullable []bool
+}
+
+func isUnique(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Unique) && tdef.Unique[idx]
+}
+func isBuilding(tdef *TableDef, idx int) bool {
+	return idx < len(tdef.Building) && tdef.Building[idx]
+}
+func isNullable(tdef *TableDef, col int) bool {
+	return col < len(tdef.Nullable) && tdef.Nullable[col]
+}
+
+// the value of a column missing in a row: the default, or NULL.
+// TYPE_ERROR if the column has neither.
+func colDefault(tdef *TableDef, col int) Value {
+	if col < len(tdef.Defaults) && tdef.Defaults[col].Type != TYPE_ERROR {
+		return tdef.Defaults[col]
+	}
+	if isNullable(tdef, col) {
+		return Value{Type: TYPE_NULL}
+	}
+	return Value{}
+}
+
+// the nullable flags of the columns
+func nullableCols(tdef *TableDef, cols []string) []bool {
+	out := make([]bool, len(cols))
+	for i, col := range cols {
+		out[i] = isNullable(tdef, colIndex(tdef, col))
+	}
+	return out
+}
+
+// the position of a column in the table, -1 if not found
+func colIndex(tdef *TableDef, col string) int {
+	for i, name := range tdef.Cols {
+		if name == col {
+			return i
+		}
+	}
+	return -1
 }
 
 // internal table: metadata
@@ -97,10 +244,7 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	if !ok {
 		return false, nil
 	}
-	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
-		values[i].Type = tdef.Types[i]
-	}
-	decodeValues(val, values[tdef.PKeys:])
+	decodeRow(tdef, val, values)
 	rec.Cols = append(rec.Cols, tdef.Cols[tdef.PKeys:]...)
 	rec.Vals = append(rec.Vals, values[tdef.PKeys:]...)
 	return true, nil
@@ -130,7 +274,7 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 	// omitted...
 	if n < tdef.PKeys || n > len(tdef.Cols) {
-		return nil, errors.New("invalid record length")
+		return nil, fmt.Errorf("%w length", ErrInvalidRecord)
 	}
 
 	if n == tdef.PKeys {
@@ -139,7 +283,10 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 		for i := 0; i < tdef.PKeys; i++ {
 			values[i] = *rec.Get(tdef.Cols[i])
 			if values[i].Type != tdef.Types[i] {
-				return nil, errors.New("invalid type for primary key")
+				return nil, badColumnType(tdef, i, &values[i])
+			}
+			if err := checkValue(&values[i]); err != nil {
+				return nil, fmt.Errorf("%w: column %s: %w", ErrInvalidRecord, tdef.Cols[i], err)
 			}
 		}
 		return values, nil
@@ -148,14 +295,38 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 		values := make([]Value, len(tdef.Cols))
 		for i := 0; i < n; i++ {
 			values[i] = *rec.Get(tdef.Cols[i])
+			if values[i].Type == TYPE_ERROR {
+				values[i] = colDefault(tdef, i) // a missing column
+			}
+			if isNullable(tdef, i) && values[i].Type == TYPE_NULL {
+				continue
+			}
+			if values[i].Type == TYPE_NULL {
+				return nil, &ConstraintError{Table: tdef.Name, Kind: "not null", Cols: tdef.Cols[i : i+1]}
+			}
 			if values[i].Type != tdef.Types[i] {
-				return nil, errors.New("invalid type for primary key")
+				return nil, badColumnType(tdef, i, &values[i])
+			}
+			if err := checkValue(&values[i]); err != nil {
+				return nil, fmt.Errorf("%w: column %s: %w", ErrInvalidRecord, tdef.Cols[i], err)
 			}
 		}
 		return values, nil
 	}
 
-	return nil, errors.New("record must contain primary key columns only")
+	return nil, fmt.Errorf("%w: must contain primary key columns only", ErrInvalidRecord)
+}
+
+// a missing column or a value of another type
+func badColumnType(tdef *TableDef, i int, val *Value) error {
+	if val.Type == TYPE_ERROR {
+		return fmt.Errorf("%w: missing column: %s", ErrInvalidRecord, tdef.Cols[i])
+	}
+	got := TypeName(val.Type)
+	if val.Type == TYPE_NULL {
+		got = "NULL"
+	}
+	return fmt.Errorf("%w: column %s: expect %s, got %s", ErrInvalidRecord, tdef.Cols[i], TypeName(tdef.Types[i]), got)
 }
 
 //	func encodeValues(out []byte, vals []Value) []byte {
@@ -180,6 +351,16 @@ func encodeValues(out []byte, vals []Value) []byte {
 		case TYPE_BYTES:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0) // null-terminated
+		case TYPE_FLOAT64:
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], encodeFloat64(v.F64))
+			out = append(out, buf[:]...)
+		case TYPE_BOOL:
+			out = append(out, byte(v.I64))
+		case TYPE_TIMESTAMP, TYPE_DECIMAL:
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], uint64(v.I64)+(1<<63))
+			out = append(out, buf[:]...)
 		default:
 			panic("what?")
 		}
@@ -238,7 +419,8 @@ func unEscapeString(in []byte) []byte {
 
 }
 
-func decodeValues(in []byte, out []Value) {
+// returns the number of bytes consumed
+func decodeValues(in []byte, out []Value) int {
 	pos := 0
 	for i, val := range out {
 		switch val.Type {
@@ -270,10 +452,98 @@ func decodeValues(in []byte, out []Value) {
 
 			out[i].Str = unescapedStr
 			pos = nullPos + 1 // Skip past the null terminator
+		case TYPE_FLOAT64:
+			Assert(pos+8 <= len(in))
+			out[i].F64 = decodeFloat64(binary.BigEndian.Uint64(in[pos : pos+8]))
+			pos += 8
+		case TYPE_BOOL:
+			Assert(pos+1 <= len(in))
+			out[i].I64 = int64(in[pos])
+			pos += 1
+		case TYPE_TIMESTAMP, TYPE_DECIMAL:
+			Assert(pos+8 <= len(in))
+			out[i].I64 = int64(binary.BigEndian.Uint64(in[pos:pos+8]) - (1 << 63))
+			pos += 8
 		default:
 			panic("bad type")
 		}
 	}
+	return pos
+}
+
+// encode the values of columns, a nullable column has a tag byte before
+// the value: 0 for NULL and 1 otherwise, so that NULLs sort first.
+func encodeCols(out []byte, vals []Value, nullable []bool) []byte {
+	for i := range vals {
+		if nullable[i] {
+			if vals[i].Type == TYPE_NULL {
+				out = append(out, 0)
+				continue
+			}
+			out = append(out, 1)
+		}
+		out = encodeValues(out, vals[i:i+1])
+	}
+	return out
+}
+func decodeCols(in []byte, out []Value, nullable []bool) int {
+	pos := 0
+	for i := range out {
+		if nullable[i] {
+			Assert(pos < len(in))
+			pos++
+			if in[pos-1] == 0 {
+				out[i] = Value{Type: TYPE_NULL}
+				continue
+			}
+		}
+		pos += decodeValues(in[pos:], out[i:i+1])
+	}
+	return pos
+}
+
+// the row value: the schema version, then the non-key columns
+func encodeRow(tdef *TableDef, values []Value) []byte {
+	out := binary.AppendUvarint(nil, uint64(tdef.Version))
+	return encodeCols(out, values[tdef.PKeys:], nullableCols(tdef, tdef.Cols[tdef.PKeys:]))
+}
+
+// decode the non-key columns of a row value into values,
+// a row of an older schema version is converted to the current one.
+func decodeRow(tdef *TableDef, val []byte, values []Value) {
+	version, n := binary.Uvarint(val)
+	Assert(n > 0)
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		values[i] = Value{Type: tdef.Types[i]}
+	}
+	if uint32(version) == tdef.Version {
+		decodeCols(val[n:], values[tdef.PKeys:], nullableCols(tdef, tdef.Cols[tdef.PKeys:]))
+		return
+	}
+	schema := findSchema(tdef, uint32(version))
+	Assert(schema != nil)
+	old := make([]Value, len(schema.Cols))
+	for i := range old {
+		old[i].Type = schema.Types[i]
+	}
+	decodeCols(val[n:], old, schema.Nullable)
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		if j := slices.Index(schema.Cols, tdef.Cols[i]); j >= 0 {
+			values[i] = old[j]
+		} else {
+			values[i] = colDefault(tdef, i) // added after the row
+		}
+	}
+}
+
+// the older schema by version
+func findSchema(tdef *TableDef, version uint32) *TableSchema {
+	for i := range tdef.Schemas {
+		if tdef.Schemas[i].Version == version {
+			return &tdef.Schemas[i]
+		}
+	}
+	return nil
 }
 
 // for primary keys
@@ -287,7 +557,7 @@ func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 func (db *DB) Get(table string, rec *Record) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return dbGet(db, tdef, rec)
 }
@@ -319,3 +589,19 @@ func getTableDefDB(db *DB, name string) *TableDef {
 	Assert(err == nil)
 	return tdef
 }
+func (db *DB) GetKV() *KV {
+	return db.kv
+}
+func (db *DB) GetTableDef(name string) *TableDef {
+	return getTableDef(db, name)
+}
+
+// names of the user tables
+func (db *DB) ListTables() []string {
+	names := []string{}
+	dbScanAll(db, TDEF_TABLE, func(rec *Record) bool {
+		names = append(names, string(rec.Get("name").Str))
+		return true
+	})
+	return names
+}
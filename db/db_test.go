@@ -590,3 +590,208 @@ func TestEscape(t *testing.T) {
 	out := unEscapeString(in)
 	assert.Equal(t, test_str, out)
 }
+
+func TestScanFilter(t *testing.T) {
+	os.Remove("test_scan_filter.db")
+	defer os.Remove("test_scan_filter.db")
+	db := &DB{Path: "test_scan_filter.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:     "people",
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:     []string{"id", "name", "age", "city"},
+		PKeys:    1,
+		Nullable: []bool{false, false, false, true},
+		Indexes:  [][]string{{"age"}, {"name"}},
+		Unique:   []bool{false, true},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	for i, name := range []string{"alice", "bob", "anna", "carl", "alex", "bea"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("name", []byte(name)).AddInt64("age", int64(20+i*5))
+		if i%2 == 0 {
+			rec.AddStr("city", []byte("paris"))
+		} else {
+			rec.AddNull("city")
+		}
+		_, err := db.Insert("people", *rec)
+		assert.NoError(t, err)
+	}
+	scan := func(sc *Scanner, where string) []Record {
+		if where != "" {
+			var err error
+			sc.Filter, err = ParseExpr(where)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, db.Scan("people", sc))
+		out := []Record{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			sc.Deref(&rec)
+			out = append(out, rec)
+		}
+		assert.NoError(t, sc.Err())
+		return out
+	}
+	byID := func() *Scanner {
+		return &Scanner{
+			Cmp1: CMP_GE, Cmp2: CMP_LE,
+			Key1: *(&Record{}).AddInt64("id", 1), Key2: *(&Record{}).AddInt64("id", 100),
+		}
+	}
+	names := func(recs []Record) []string {
+		out := []string{}
+		for _, rec := range recs {
+			out = append(out, string(rec.Get("name").Str))
+		}
+		return out
+	}
+
+	// the filter skips rows, including the first one
+	assert.Equal(t, []string{"anna", "alex"}, names(scan(byID(), "name like 'a%' and city is not null and id > 1")))
+	assert.Equal(t, []string{"bob", "carl"}, names(scan(byID(), "id in (2, 4, 9)")))
+	assert.Equal(t, []string{"alice", "anna", "alex"}, names(scan(byID(), "not (city is null) or age in (null)")))
+	assert.Equal(t, []string{}, names(scan(byID(), "name like '%z'")))
+	assert.Equal(t, []string{"alex"}, names(scan(byID(), "name like '_le%x'")))
+
+	// the projection
+	sc := byID()
+	sc.Cols = []string{"name", "id"}
+	recs := scan(sc, "age >= 40")
+	assert.Equal(t, 2, len(recs))
+	assert.Equal(t, []string{"name", "id"}, recs[0].Cols)
+	assert.Equal(t, int64(5), recs[0].Get("id").I64)
+
+	// a covering index does not fetch the rows
+	byAge := &Scanner{
+		Cmp1: CMP_GT, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddInt64("age", 20), Key2: *(&Record{}).AddInt64("age", 40),
+		Cols: []string{"age", "id"},
+	}
+	recs = scan(byAge, "id % 2 = 0")
+	assert.True(t, byAge.covered)
+	assert.Equal(t, []Record{
+		*(&Record{}).AddInt64("age", 25).AddInt64("id", 2),
+		*(&Record{}).AddInt64("age", 35).AddInt64("id", 4),
+	}, recs)
+	byName := &Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LT,
+		Key1: *(&Record{}).AddStr("name", []byte("a")), Key2: *(&Record{}).AddStr("name", []byte("b")),
+		Cols: []string{"id", "name"},
+	}
+	assert.Equal(t, []string{"alex", "alice", "anna"}, names(scan(byName, "")))
+	assert.True(t, byName.covered)
+	byName.Cols = []string{"name", "city"}
+	assert.Equal(t, []string{"alice", "anna"}, names(scan(byName, "city = 'paris' and id < 5")))
+	assert.False(t, byName.covered)
+
+	// bad columns and a filter error
+	sc = byID()
+	sc.Cols = []string{"nope"}
+	assert.Error(t, db.Scan("people", sc))
+	sc = byID()
+	sc.Filter, _ = ParseExpr("nope = 1")
+	assert.Error(t, db.Scan("people", sc))
+	sc = byID()
+	sc.Filter, _ = ParseExpr("id > 2 and name > 1")
+	assert.NoError(t, db.Scan("people", sc))
+	assert.False(t, sc.Valid())
+	assert.Error(t, sc.Err())
+	_, err := ParseExpr("id > ")
+	assert.Error(t, err)
+}
+
+func TestScanPrefix(t *testing.T) {
+	os.Remove("test_scan_prefix.db")
+	defer os.Remove("test_scan_prefix.db")
+	db := &DB{Path: "test_scan_prefix.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	newTable := func(name string) {
+		tdef := &TableDef{
+			Name:    name,
+			Types:   []uint32{TYPE_BYTES, TYPE_INT64, TYPE_INT64},
+			Cols:    []string{"a", "b", "v"},
+			PKeys:   2,
+			Indexes: [][]string{{"v"}},
+		}
+		assert.NoError(t, db.TableNew(tdef))
+	}
+	// the tables before and after have rows
+	newTable("t0")
+	newTable("t")
+	newTable("t2")
+	for _, table := range []string{"t0", "t", "t2"} {
+		for _, a := range []string{"x", "y", "y\xff", "z"} {
+			for b := int64(1); b <= 3; b++ {
+				rec := (&Record{}).AddStr("a", []byte(a)).AddInt64("b", b).AddInt64("v", b*10)
+				_, err := db.Insert(table, *rec)
+				assert.NoError(t, err)
+			}
+		}
+	}
+	key := func(a string, b ...int64) Record {
+		rec := Record{}
+		if a != "" {
+			rec.AddStr("a", []byte(a))
+		}
+		for _, v := range b {
+			rec.AddInt64("b", v)
+		}
+		return rec
+	}
+	scan := func(table string, key1 Record, cmp1 int, key2 Record, cmp2 int) []string {
+		sc := Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: key1, Key2: key2}
+		assert.NoError(t, db.Scan(table, &sc))
+		out := []string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			sc.Deref(&rec)
+			out = append(out, fmt.Sprintf("%s%d", rec.Get("a").Str, rec.Get("b").I64))
+		}
+		return out
+	}
+
+	// the first key column
+	assert.Equal(t, []string{"y1", "y2", "y3"}, scan("t", key("y"), CMP_GE, key("y"), CMP_LE))
+	assert.Equal(t, []string{"y3", "y2", "y1"}, scan("t", key("y"), CMP_LE, key("y"), CMP_GE))
+	assert.Equal(t, []string{"y\xff1", "y\xff2", "y\xff3"}, scan("t", key("y"), CMP_GT, key("z"), CMP_LT))
+	assert.Equal(t, []string{"y2", "y3", "y\xff1"}, scan("t", key("y", 2), CMP_GE, key("y\xff", 1), CMP_LE))
+	// open-ended
+	assert.Equal(t, []string{"z1", "z2", "z3"}, scan("t", key("y\xff"), CMP_GT, Record{}, CMP_LE))
+	assert.Equal(t, []string{"x1", "x2", "x3"}, scan("t", Record{}, CMP_GE, key("x"), CMP_LE))
+	assert.Equal(t, []string{"x3", "x2", "x1"}, scan("t", key("x"), CMP_LE, Record{}, CMP_GT))
+	assert.Equal(t, 12, len(scan("t", Record{}, CMP_GT, Record{}, CMP_LT)))
+	all := scan("t", Record{}, CMP_LT, Record{}, CMP_GE)
+	assert.Equal(t, 12, len(all))
+	assert.Equal(t, "z3", all[0])
+	// an open-ended index scan
+	sc := Scanner{Cmp1: CMP_GT, Cmp2: CMP_LE, Key1: *(&Record{}).AddInt64("v", 20)}
+	assert.NoError(t, db.Scan("t", &sc))
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		n++
+	}
+	assert.Equal(t, 4, n)
+
+	// an empty table between others
+	newTable("e")
+	assert.Equal(t, []string{}, scan("e", Record{}, CMP_GE, Record{}, CMP_LE))
+	assert.Equal(t, []string{}, scan("e", Record{}, CMP_LE, Record{}, CMP_GE))
+
+	// not a prefix
+	sc = Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key("", 1), Key2: key("", 2)}
+	assert.Error(t, db.Scan("t", &sc))
+	sc = Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key("x"), Key2: key("", 2)}
+	assert.Error(t, db.Scan("t", &sc))
+
+	// SQL picks the prefix range
+	res, err := db.ExecSQL("select a, b from t where a = 'y' and b > 1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Records))
+	res, err = db.ExecSQL("select a, b from t where a > 'y'")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(res.Records))
+}
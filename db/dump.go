@@ -0,0 +1,301 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	. "types"
+)
+
+// Logical dump and restore.
+//
+// A dump is JSON Lines, independent of the file format. The first line is
+// {"format": DUMP_FORMAT}, then every table definition {"tdef": ...}, every
+// sequence {"seq": {"name": ..., "next": ...}}, and every row
+// {"table": ..., "row": [...]} with the values in the column order. A value
+// is null, a number, a boolean, or a string: base64 for bytes, and the text
+// form of FormatValue for timestamps, decimals and infinite floats.
+//
+// A restore recreates the tables with new prefixes and reloads the rows in
+// batches of DUMP_BATCH_SIZE, the writes of each flushed as a single
+// commit, like ImportCSV. The rows of a consistent dump need no checking
+// against the foreign keys, which are added back once all rows are loaded;
+// the rows may come in any order. A failed restore drops the tables and the
+// sequences it created, so that it can be retried.
+
+const (
+	DUMP_FORMAT     = 1
+	DUMP_BATCH_SIZE = 1000
+)
+
+// a line of a dump
+type dumpLine struct {
+	Format int               `json:"format,omitempty"`
+	TDef   *TableDef         `json:"tdef,omitempty"`
+	Seq    *dumpSeq          `json:"seq,omitempty"`
+	Table  string            `json:"table,omitempty"`
+	Row    []json.RawMessage `json:"row,omitempty"`
+}
+
+type dumpSeq struct {
+	Name string `json:"name"`
+	Next int64  `json:"next"`
+}
+
+// the JSON of a value
+func dumpValue(val *Value) any {
+	switch val.Type {
+	case TYPE_NULL:
+		return nil
+	case TYPE_BYTES:
+		return val.Str // base64
+	case TYPE_INT64:
+		return val.I64
+	case TYPE_BOOL:
+		return val.I64 != 0
+	case TYPE_FLOAT64:
+		if !math.IsInf(val.F64, 0) {
+			return val.F64
+		}
+	}
+	return FormatValue(val)
+}
+
+// the reverse of dumpValue
+func loadValue(typ uint32, data json.RawMessage) (Value, error) {
+	if string(data) == "null" {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		if typ == TYPE_BYTES {
+			val := Value{Type: TYPE_BYTES}
+			err := json.Unmarshal(data, &val.Str)
+			return val, err
+		}
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return Value{}, err
+		}
+		return ParseValue(typ, str)
+	}
+	switch typ {
+	case TYPE_INT64:
+		i64, err := strconv.ParseInt(string(data), 10, 64)
+		return Value{Type: typ, I64: i64}, err
+	case TYPE_FLOAT64:
+		val := Value{Type: typ}
+		err := json.Unmarshal(data, &val.F64)
+		return val, err
+	case TYPE_BOOL:
+		var b bool
+		err := json.Unmarshal(data, &b)
+		return Value{Type: typ, I64: boolToInt64(b)}, err
+	}
+	return Value{}, fmt.Errorf("bad %s value: %s", TypeName(typ), data)
+}
+
+// write the tables, sequences, and rows of the database
+func (db *DB) Dump(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(dumpLine{Format: DUMP_FORMAT}); err != nil {
+		return err
+	}
+	tables := db.ListTables()
+	for _, name := range tables {
+		// the storage details are reassigned by the restore
+		tdef := *getTableDef(db, name)
+		tdef.Prefix, tdef.IndexPrefixes = 0, nil
+		tdef.Building = nil
+		tdef.Version, tdef.Schemas = 0, nil
+		if err := enc.Encode(dumpLine{TDef: &tdef}); err != nil {
+			return err
+		}
+	}
+	seqs := []string{}
+	dbScanAll(db, TDEF_META, func(rec *Record) bool {
+		if name, ok := strings.CutPrefix(string(rec.Get("key").Str), "seq:"); ok {
+			seqs = append(seqs, name)
+		}
+		return true
+	})
+	for _, name := range seqs {
+		seq, err := seqGet(db, name, false)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(dumpLine{Seq: &dumpSeq{Name: name, Next: seq.next}}); err != nil {
+			return err
+		}
+	}
+	var err error
+	for _, name := range tables {
+		dbScanAll(db, getTableDef(db, name), func(rec *Record) bool {
+			line := dumpLine{Table: name, Row: make([]json.RawMessage, len(rec.Vals))}
+			for i := range rec.Vals {
+				if line.Row[i], err = json.Marshal(dumpValue(&rec.Vals[i])); err != nil {
+					return false
+				}
+			}
+			err = enc.Encode(line)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// recreate the tables of a dump, which must not exist
+func (db *DB) Restore(r io.Reader) error {
+	db.batching = true
+	created := &restored{}
+	err := dbRestore(db, bufio.NewReader(r), created)
+	db.batching = false
+	if err != nil {
+		restoreUndo(db, created)
+	}
+	if ferr := db.kv.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// what a restore created
+type restored struct {
+	tables []string
+	seqs   []string
+}
+
+// drop what a failed restore created. the foreign keys among the new
+// tables are removed first, they do not keep each other.
+func restoreUndo(db *DB, created *restored) {
+	for _, name := range created.tables {
+		if tdef := getTableDef(db, name); tdef != nil {
+			tdef.ForeignKeys = nil
+		}
+	}
+	db.refs = nil
+	for _, name := range created.tables {
+		_ = db.DropTable(name)
+	}
+	for _, name := range created.seqs {
+		_ = db.DropSequence(name)
+	}
+}
+
+func dbRestore(db *DB, in *bufio.Reader, created *restored) error {
+	fks := map[string][]ForeignKey{}
+	order := []string{} // the tables with foreign keys
+	pending := 0
+	started := false
+	for n := 1; ; n++ {
+		data, err := in.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		line := dumpLine{}
+		if err := json.Unmarshal(data, &line); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if !started && line.Format != DUMP_FORMAT {
+			return fmt.Errorf("line %d: unknown dump format: %d", n, line.Format)
+		}
+		switch {
+		case !started:
+			started = true
+		case line.TDef != nil:
+			tdef := line.TDef
+			if len(tdef.ForeignKeys) > 0 {
+				fks[tdef.Name] = tdef.ForeignKeys
+				order = append(order, tdef.Name)
+			}
+			tdef.ForeignKeys = nil
+			if err = db.TableNew(tdef); err == nil {
+				created.tables = append(created.tables, tdef.Name)
+			}
+		case line.Seq != nil:
+			err = restoreSeq(db, line.Seq)
+			if err == nil && !strings.HasPrefix(line.Seq.Name, "@") {
+				created.seqs = append(created.seqs, line.Seq.Name)
+			}
+		case line.Table != "":
+			err = restoreRow(db, line.Table, line.Row)
+			if pending++; err == nil && pending >= DUMP_BATCH_SIZE {
+				pending = 0
+				err = db.kv.Flush()
+			}
+		default:
+			err = errors.New("unknown dump line")
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if !started {
+		return errors.New("empty dump")
+	}
+	// the foreign keys, now that every parent is there
+	for _, name := range order {
+		tdef := getTableDef(db, name)
+		check := *tdef
+		check.ForeignKeys = fks[name]
+		if err := fkCheck(db, &check); err != nil {
+			return err
+		}
+		tdef.ForeignKeys = fks[name]
+		if err := tableDefSave(db, tdef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a named sequence is created, the one of a table is only moved forward
+func restoreSeq(db *DB, seq *dumpSeq) error {
+	if seq.Name == "" || seq.Name[0] != '@' {
+		return db.CreateSequence(seq.Name, seq.Next)
+	}
+	if getTableDef(db, seq.Name[1:]) == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, seq.Name[1:])
+	}
+	if seq.Next > 1 {
+		return seqAdvance(db, seq.Name, seq.Next-1)
+	}
+	return nil
+}
+
+func restoreRow(db *DB, table string, row []json.RawMessage) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if len(row) != len(tdef.Cols) {
+		return fmt.Errorf("expect %d values, got %d", len(tdef.Cols), len(row))
+	}
+	rec := Record{Cols: tdef.Cols, Vals: make([]Value, len(row))}
+	for i := range row {
+		val, err := loadValue(tdef.Types[i], row[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", tdef.Cols[i], err)
+		}
+		rec.Vals[i] = val
+	}
+	if _, err := autoIncrement(db, tdef, &rec); err != nil {
+		return err
+	}
+	_, err := dbUpdate(db, tdef, rec, MODE_INSERT_ONLY)
+	return err
+}
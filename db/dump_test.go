@@ -0,0 +1,143 @@
+package db
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpRestore(t *testing.T) {
+	os.Remove("test_dump.db")
+	os.Remove("test_restore.db")
+	defer os.Remove("test_dump.db")
+	defer os.Remove("test_restore.db")
+	defer os.Remove("test_restore2.db")
+	src := &DB{Path: "test_dump.db"}
+	assert.NoError(t, src.Open())
+	defer src.Close()
+
+	exec := func(db *DB, sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	assert.NoError(t, src.CreateSequence("tickets", 100))
+	exec(src, "create table users (id int64 auto_increment, name bytes, primary key (id), unique index (name))")
+	exec(src, `create table orders (id int64, user int64, total decimal, at timestamp, ok bool,
+		ratio float64 null, note bytes null, ticket int64 default nextval('tickets'),
+		primary key (id), index (user), foreign key (user) references users on delete cascade,
+		check (total >= 0))`)
+	exec(src, `create table emp (id int64, boss int64 null, primary key (id), index (boss),
+		foreign key (boss) references emp on delete set null)`)
+
+	exec(src, "insert into users (name) values ('ann'), ('bob'), ('cat')")
+	exec(src, "delete from users where id = 3")
+	assert.NoError(t, src.AddColumn("users", "email", TYPE_BYTES, true, Value{}))
+	exec(src, "insert into users (name, email) values ('dan', 'd@x')")
+	at := time.Date(2024, 5, 1, 12, 0, 0, 500000000, time.UTC)
+	orders := []*Record{
+		(&Record{}).AddInt64("id", 1).AddInt64("user", 1).AddDecimal("total", 1234).AddTime("at", at).
+			AddBool("ok", true).AddFloat64("ratio", math.Inf(1)).AddStr("note", []byte("\x00\xff\n\"")),
+		(&Record{}).AddInt64("id", 2).AddInt64("user", 4).AddDecimal("total", 0).AddTime("at", at).
+			AddBool("ok", false).AddFloat64("ratio", -0.25).AddNull("note"),
+	}
+	for _, rec := range orders {
+		_, err := src.Insert("orders", *rec)
+		assert.NoError(t, err)
+	}
+	// a row comes before its parent
+	exec(src, "insert into emp values (2, null), (1, 2), (3, 3)")
+
+	dump := bytes.Buffer{}
+	assert.NoError(t, src.Dump(&dump))
+	lines := strings.Split(strings.TrimSpace(dump.String()), "\n")
+	assert.Equal(t, `{"format":1}`, lines[0])
+	assert.Contains(t, dump.String(), `{"seq":{"name":"tickets","next":102}}`)
+	assert.Contains(t, dump.String(), `{"seq":{"name":"@users","next":5}}`)
+	assert.Contains(t, dump.String(), `{"table":"orders","row":[1,1,"0.001234","2024-05-01T12:00:00.5Z",true,"+Inf","AP8KIg==",100]}`)
+	assert.Contains(t, dump.String(), `{"table":"users","row":[1,"YW5u",null]}`)
+
+	// into a new file with other prefixes
+	dst := &DB{Path: "test_restore.db"}
+	assert.NoError(t, dst.Open())
+	defer dst.Close()
+	exec(dst, "create table other (id int64, primary key (id))")
+	assert.NoError(t, dst.Restore(bytes.NewReader(dump.Bytes())))
+	assert.NotEqual(t, getTableDef(src, "users").Prefix, getTableDef(dst, "users").Prefix)
+	again := bytes.Buffer{}
+	assert.NoError(t, dst.Dump(&again))
+	kept := []string{}
+	for _, line := range strings.SplitAfter(again.String(), "\n") {
+		if !strings.Contains(line, `"Name":"other"`) {
+			kept = append(kept, line)
+		}
+	}
+	assert.Equal(t, dump.String(), strings.Join(kept, ""))
+
+	// the constraints and sequences carry on
+	rows := exec(dst, "select id, name, email from users")
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, "d@x", string(rows[2].Get("email").Str))
+	id, err := dst.Insert("users", *(&Record{}).AddStr("name", []byte("eve")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), id)
+	val, err := dst.NextVal("tickets")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(102), val)
+	_, err = dst.Insert("users", *(&Record{}).AddStr("name", []byte("ann")))
+	assert.Error(t, err)
+	_, err = dst.ExecSQL("insert into emp values (4, 9)")
+	assert.Error(t, err)
+	exec(dst, "delete from users where id = 1")
+	assert.Equal(t, 1, len(exec(dst, "select id from orders")))
+	exec(dst, "delete from emp where id = 2")
+	assert.Equal(t, "NULL", FormatValue(exec(dst, "select boss from emp where id = 1")[0].Get("boss")))
+
+	// a table of the dump exists, the tables are kept
+	assert.Error(t, dst.Restore(bytes.NewReader(dump.Bytes())))
+	assert.Equal(t, 3, len(exec(dst, "select id from users")))
+
+	// a failed restore drops what it created and can be retried
+	badFK := strings.Replace(dump.String(), `"OnDelete":1`, `"OnDelete":9`, 1)
+	// the foreign key of orders is in place when the one of emp fails,
+	// and users is dropped before orders
+	moved := []string{lines[0]}
+	for _, name := range []string{"users", "orders", "emp"} {
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, `{"tdef":{"Name":"`+name+`"`) {
+				moved = append(moved, strings.Replace(line, `"OnDelete":2`, `"OnDelete":9`, 1))
+			}
+		}
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, `{"tdef"`) {
+			moved = append(moved, line)
+		}
+	}
+	assert.Equal(t, len(lines), len(moved))
+	for _, bad := range []string{dump.String() + "not json\n", badFK, strings.Join(moved, "\n")} {
+		db := &DB{Path: "test_restore2.db"}
+		os.Remove(db.Path)
+		assert.NoError(t, db.Open())
+		assert.Error(t, db.Restore(strings.NewReader(bad)))
+		assert.Empty(t, db.ListTables())
+		_, err := db.NextVal("tickets")
+		assert.ErrorIs(t, err, ErrSequenceNotFound)
+		assert.NoError(t, db.Restore(bytes.NewReader(dump.Bytes())))
+		assert.Equal(t, 3, len(exec(db, "select id from users")))
+		db.Close()
+	}
+	for _, bad := range []string{"", "\n", `{"format":2}`, `{"tdef":{"Name":"x"}}`, "{\"format\":1}\n{}\n",
+		"{\"format\":1}\n{\"table\":\"nope\",\"row\":[1]}\n", "{\"format\":1}\nnot json\n"} {
+		db := &DB{Path: "test_restore2.db"}
+		os.Remove(db.Path)
+		assert.NoError(t, db.Open())
+		assert.Error(t, db.Restore(strings.NewReader(bad)), bad)
+		db.Close()
+	}
+}
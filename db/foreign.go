@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	. "server"
+	"slices"
+	"strings"
+	. "types"
+)
+
+// Foreign keys.
+//
+// A foreign key makes some columns of a child table reference the primary
+// key of a parent table. A child row whose columns are not NULL needs the
+// parent row, which is checked by a point lookup on insert and update.
+// The child columns must be a prefix of the primary key or of an index, so
+// that the children of a deleted parent row are found by a seek. They are
+// then handled by the action of the foreign key: RESTRICT fails the delete,
+// CASCADE deletes them as well, and SET NULL clears their columns. The
+// delete and everything it cascades to are written in a single commit.
+//
+// A referenced table cannot be dropped or truncated.
+
+const (
+	FK_RESTRICT = 0
+	FK_CASCADE  = 1
+	FK_SET_NULL = 2
+)
+
+type ForeignKey struct {
+	Cols     []string // the child columns, pairwise matching the parent primary key
+	Table    string   // the parent table
+	OnDelete int      // FK_?
+}
+
+// check the foreign keys of a new table, the parent may be the table itself
+func fkCheck(db *DB, tdef *TableDef) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent := tdef
+		if fk.Table != tdef.Name {
+			parent = getTableDef(db, fk.Table)
+		}
+		if parent == nil {
+			return fmt.Errorf("%w: %s", ErrTableNotFound, fk.Table)
+		}
+		if len(fk.Cols) != parent.PKeys {
+			return fmt.Errorf("the foreign key does not match the primary key of %s", fk.Table)
+		}
+		for i, col := range fk.Cols {
+			idx := colIndex(tdef, col)
+			switch {
+			case idx < 0 || slices.Index(fk.Cols, col) != i:
+				return fmt.Errorf("bad foreign key column: %q", col)
+			case tdef.Types[idx] != parent.Types[i]:
+				return fmt.Errorf("mismatched types: %s and %s.%s", col, fk.Table, parent.Cols[i])
+			case fk.OnDelete == FK_SET_NULL && !isNullable(tdef, idx):
+				return fmt.Errorf("SET NULL on a column that is not nullable: %s", col)
+			}
+		}
+		if !isPKeyPrefix(tdef, fk.Cols) && findIndex(tdef, fk.Cols) < 0 {
+			return fmt.Errorf("the foreign key needs an index: (%s)", strings.Join(fk.Cols, ", "))
+		}
+		if fk.OnDelete < FK_RESTRICT || fk.OnDelete > FK_SET_NULL {
+			return fmt.Errorf("bad foreign key action: %d", fk.OnDelete)
+		}
+	}
+	return nil
+}
+
+// the values of the child columns, false if any is NULL
+func fkValues(tdef *TableDef, fk *ForeignKey, values []Value) ([]Value, bool) {
+	out := make([]Value, len(fk.Cols))
+	for i, col := range fk.Cols {
+		out[i] = values[colIndex(tdef, col)]
+		if out[i].Type == TYPE_NULL {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// the parent rows of a new or changed child row must exist, old is nil
+// for a new row
+func fkCheckParents(db *DB, tdef *TableDef, values []Value, old []Value) error {
+	for i := range tdef.ForeignKeys {
+		fk := &tdef.ForeignKeys[i]
+		vals, ok := fkValues(tdef, fk, values)
+		if !ok {
+			continue
+		}
+		if old != nil {
+			prev, ok := fkValues(tdef, fk, old)
+			if ok && bytes.Equal(encodeValues(nil, prev), encodeValues(nil, vals)) {
+				continue // unchanged
+			}
+		}
+		parent := getTableDef(db, fk.Table)
+		if parent == nil {
+			return fmt.Errorf("%w: %s", ErrTableNotFound, fk.Table)
+		}
+		if parent == tdef && bytes.Equal(encodeValues(nil, vals), encodeValues(nil, values[:tdef.PKeys])) {
+			continue // references itself
+		}
+		key := Record{Cols: parent.Cols[:parent.PKeys:parent.PKeys], Vals: vals}
+		found, err := dbGet(db, parent, &key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return &ConstraintError{Table: tdef.Name, Kind: "foreign key", Cols: fk.Cols}
+		}
+	}
+	return nil
+}
+
+// the tables with foreign keys to a table
+func fkChildren(db *DB, name string) []*TableDef {
+	if db.refs == nil {
+		db.refs = map[string][]string{}
+		for _, table := range db.ListTables() {
+			for _, fk := range getTableDef(db, table).ForeignKeys {
+				if !slices.Contains(db.refs[fk.Table], table) {
+					db.refs[fk.Table] = append(db.refs[fk.Table], table)
+				}
+			}
+		}
+	}
+	out := []*TableDef{}
+	for _, table := range db.refs[name] {
+		out = append(out, getTableDef(db, table))
+	}
+	return out
+}
+
+// a table referenced by another table, which blocks dropping it
+func fkReferenced(db *DB, name string) error {
+	for _, child := range fkChildren(db, name) {
+		if child.Name != name {
+			return fmt.Errorf("the table is referenced by a foreign key: %s", child.Name)
+		}
+	}
+	return nil
+}
+
+// the writes of a delete and of its cascades
+type fkDelete struct {
+	db      *DB
+	b       *Batch
+	deleted map[string]bool // the keys of the deleted rows
+	nulled  []*fkNulled     // the child rows to update
+}
+
+// a child row with some columns set to NULL
+type fkNulled struct {
+	tdef   *TableDef
+	key    []byte
+	old    []Value
+	values []Value
+}
+
+// delete a row, its index entries, and handle its children
+func (d *fkDelete) del(tdef *TableDef, key []byte, old []Value) error {
+	if d.deleted[string(key)] {
+		return nil
+	}
+	d.deleted[string(key)] = true
+	d.b.Del(key)
+	for i := range tdef.Indexes {
+		d.b.Del(encodeIndexKey(tdef, i, old))
+	}
+	for _, child := range fkChildren(d.db, tdef.Name) {
+		for i := range child.ForeignKeys {
+			fk := &child.ForeignKeys[i]
+			if fk.Table != tdef.Name {
+				continue
+			}
+			rows, err := fkFindChildren(d.db, child, fk, old[:tdef.PKeys])
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				ckey := encodeKey(nil, child.Prefix, row[:child.PKeys])
+				if d.deleted[string(ckey)] {
+					continue
+				}
+				switch fk.OnDelete {
+				case FK_CASCADE:
+					err = d.del(child, ckey, row)
+				case FK_SET_NULL:
+					d.setNull(child, ckey, row, fk.Cols)
+				default:
+					err = &ConstraintError{Table: child.Name, Kind: "foreign key", Cols: fk.Cols}
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// the rows of a child table referencing the parent primary key
+func fkFindChildren(db *DB, child *TableDef, fk *ForeignKey, pk []Value) ([][]Value, error) {
+	key := Record{Cols: fk.Cols, Vals: pk}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := dbScan(db, child, &sc); err != nil {
+		return nil, err
+	}
+	rows := [][]Value{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		rows = append(rows, rec.Vals)
+	}
+	return rows, nil
+}
+
+func (d *fkDelete) setNull(tdef *TableDef, key []byte, old []Value, cols []string) {
+	idx := slices.IndexFunc(d.nulled, func(n *fkNulled) bool { return bytes.Equal(n.key, key) })
+	if idx < 0 {
+		idx = len(d.nulled)
+		d.nulled = append(d.nulled, &fkNulled{tdef: tdef, key: key, old: old, values: slices.Clone(old)})
+	}
+	for _, col := range cols {
+		d.nulled[idx].values[colIndex(tdef, col)] = Value{Type: TYPE_NULL}
+	}
+}
+
+// add the updates of the child rows that are not deleted
+func (d *fkDelete) flush() error {
+	for _, n := range d.nulled {
+		if d.deleted[string(n.key)] {
+			continue
+		}
+		tdef := n.tdef
+		if err := checkRow(tdef, n.values); err != nil {
+			return err
+		}
+		d.b.Set(n.key, encodeRow(tdef, n.values))
+		for i := range tdef.Indexes {
+			oldKey, newKey := encodeIndexKey(tdef, i, n.old), encodeIndexKey(tdef, i, n.values)
+			if bytes.Equal(oldKey, newKey) {
+				continue
+			}
+			d.b.Del(oldKey)
+			var ival []byte
+			if isUnique(tdef, i) {
+				// a NULL key has the primary key appended, so it is free
+				ival = encodeValues(nil, n.values[:tdef.PKeys])
+			}
+			d.b.Set(newKey, ival)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForeignKey(t *testing.T) {
+	os.Remove("test_fk.db")
+	defer os.Remove("test_fk.db")
+	db := &DB{Path: "test_fk.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) QLResult {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res
+	}
+	count := func(table string) int {
+		n := 0
+		assert.NoError(t, db.ScanAll(table, func(rec *Record) bool {
+			n++
+			return true
+		}))
+		return n
+	}
+	isFK := func(err error) bool {
+		var cerr *ConstraintError
+		return assert.ErrorAs(t, err, &cerr) && cerr.Kind == "foreign key"
+	}
+
+	exec("create table users (id int64, name bytes, primary key (id))")
+	exec(`create table posts (id int64, user int64, title bytes, primary key (id),
+		index (user), foreign key (user) references users on delete cascade)`)
+	exec(`create table comments (post int64, n int64, user int64 null, primary key (post, n),
+		index (user), foreign key (post) references posts on delete cascade,
+		foreign key (user) references users on delete set null)`)
+	exec(`create table likes (user int64, post int64, primary key (user, post),
+		foreign key (user) references users)`)
+	for _, bad := range []string{
+		"create table x (id int64, u int64, foreign key (u) references users)",                               // no index
+		"create table x (id int64, u bytes, index (u), foreign key (u) references users)",                    // types
+		"create table x (id int64, u int64, index (u), foreign key (u) references nope)",                     // parent
+		"create table x (id int64, u int64, index (u), foreign key (u) references users on delete set null)", // not nullable
+		"create table x (id int64, u int64, index (u), foreign key (u, id) references users)",                // columns
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+
+	exec("insert into users values (1, 'a'), (2, 'b')")
+	exec("insert into posts values (10, 1, 'x'), (11, 1, 'y'), (20, 2, 'z')")
+	exec("insert into comments values (10, 1, 2), (10, 2, null), (11, 1, 1), (20, 1, 1), (20, 2, 2)")
+	exec("insert into likes values (2, 10)")
+
+	// the parent must exist
+	_, err := db.ExecSQL("insert into posts values (30, 3, 'w')")
+	isFK(err)
+	_, err = db.ExecSQL("update posts set user = 3 where id = 10")
+	isFK(err)
+	exec("update posts set user = 2 where id = 11")
+	exec("update posts set user = 1 where id = 11")
+
+	// RESTRICT
+	_, err = db.Delete("users", *(&Record{}).AddInt64("id", 2))
+	isFK(err)
+	assert.Equal(t, 2, count("users"))
+	assert.Equal(t, 5, count("comments"))
+	exec("delete from likes")
+
+	// CASCADE and SET NULL in one commit
+	ok, err := db.Delete("users", *(&Record{}).AddInt64("id", 1))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, count("posts"))
+	res := exec("select post, n, user from comments")
+	assert.Equal(t, 2, len(res.Records))
+	assert.Equal(t, "NULL", FormatValue(res.Records[0].Get("user")))
+	assert.Equal(t, int64(2), res.Records[1].Get("user").I64)
+	// the index is updated
+	res = exec("select n from comments where user = 2")
+	assert.Equal(t, 1, len(res.Records))
+	res = exec("select n from comments where user is null")
+	assert.Equal(t, 1, len(res.Records))
+
+	// the referenced tables are kept
+	assert.Error(t, db.DropTable("users"))
+	assert.Error(t, db.TruncateTable("posts"))
+	assert.NoError(t, db.DropTable("comments"))
+	assert.NoError(t, db.DropTable("likes"))
+	assert.NoError(t, db.TruncateTable("posts"))
+	assert.NoError(t, db.DropTable("posts"))
+	assert.NoError(t, db.DropTable("users"))
+
+	// a self reference
+	exec(`create table tree (id int64, parent int64 null, primary key (id), index (parent),
+		foreign key (parent) references tree on delete cascade)`)
+	exec("insert into tree values (1, 1), (2, 1), (3, 2), (4, null)")
+	_, err = db.ExecSQL("insert into tree values (5, 9)")
+	isFK(err)
+	exec("delete from tree where id = 2")
+	assert.Equal(t, 2, count("tree"))
+	exec("delete from tree where id = 1")
+	assert.Equal(t, 1, count("tree"))
+	assert.NoError(t, db.DropTable("tree"))
+}
@@ -0,0 +1,538 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	. "server"
+	"strconv"
+	"strings"
+	"sync"
+	. "types"
+	. "utils"
+)
+
+// An HTTP/JSON front-end for the DB.
+//
+//	POST   /tables                create a table from a JSON TableDef
+//	GET    /tables/{name}         the table definition
+//	POST   /tables/{name}/indexes add an index, {"Cols": [...], "Unique": false}
+//	POST   /tables/{name}/rows    insert a row, the AUTO_INCREMENT key is returned as "id"
+//	PUT    /tables/{name}/rows    upsert a row
+//	PATCH  /tables/{name}/rows    update a row
+//	GET    /tables/{name}/row     get a row by the primary key in the query
+//	DELETE /tables/{name}/row     delete a row by the primary key in the query
+//	GET    /tables/{name}/rows    range scan, streamed as JSON lines
+//
+// Rows are JSON objects keyed by the column name, bytes are base64 JSON
+// strings as in a dump, and int64 are JSON numbers. The keys in a query
+// are in the text form of ParseValue. A range scan takes cmp1 and cmp2 (ge, gt,
+// lt, le) and the primary key columns prefixed by key1. and key2., e.g.
+// /tables/t/rows?cmp1=ge&key1.id=1&cmp2=le&key2.id=9
+// a key may be a prefix of the primary key, or missing for the start or
+// the end of the table.
+// and optionally a filter and the returned columns, e.g.
+// &where=age>30&cols=id,name
+// a filter error after the first row ends the stream with {"error": "..."}.
+type HttpServer struct {
+	db *DB
+	mu sync.Mutex // the DB is not safe for concurrent use
+	// internals
+	mux *http.ServeMux
+}
+
+func NewHttpServer(db *DB) *HttpServer {
+	s := &HttpServer{db: db, mux: http.NewServeMux()}
+	s.mux.HandleFunc("POST /tables", s.tableNew)
+	s.mux.HandleFunc("GET /tables/{name}", s.tableGet)
+	s.mux.HandleFunc("DELETE /tables/{name}", s.tableDrop)
+	s.mux.HandleFunc("POST /tables/{name}/indexes", s.indexNew)
+	s.mux.HandleFunc("POST /tables/{name}/rows", s.rowSet(MODE_INSERT_ONLY))
+	s.mux.HandleFunc("PUT /tables/{name}/rows", s.rowSet(MODE_UPSERT))
+	s.mux.HandleFunc("PATCH /tables/{name}/rows", s.rowSet(MODE_UPDATE_ONLY))
+	s.mux.HandleFunc("GET /tables/{name}/row", s.rowGet)
+	s.mux.HandleFunc("DELETE /tables/{name}/row", s.rowDelete)
+	s.mux.HandleFunc("GET /tables/{name}/rows", s.rowScan)
+	s.mux.HandleFunc("DELETE /tables/{name}/rows", s.tableTruncate)
+	s.mux.HandleFunc("GET /tables/{name}/csv", s.csvExport)
+	s.mux.HandleFunc("POST /tables/{name}/csv", s.csvImport(MODE_INSERT_ONLY))
+	s.mux.HandleFunc("PUT /tables/{name}/csv", s.csvImport(MODE_UPSERT))
+	return s
+}
+
+func (s *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// map the DB errors to the HTTP status codes
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTableNotFound), errors.Is(err, ErrKeyNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTableExists), errors.Is(err, ErrKeyExist), errors.Is(err, ErrIndexExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrTableChanged):
+		return http.StatusConflict
+	case errors.As(err, new(*ConstraintError)):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidRecord), errors.Is(err, ErrTooManyErrors), errors.Is(err, ErrBadScan):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+func httpJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// convert a JSON value to a Value of the column type.
+// numbers and booleans are native JSON, timestamps are RFC 3339 strings,
+// decimals are strings or numbers.
+func valueFromJSON(typ uint32, data json.RawMessage) (Value, error) {
+	switch typ {
+	case TYPE_BYTES:
+		val := Value{Type: typ}
+		if err := json.Unmarshal(data, &val.Str); err != nil {
+			return Value{}, errors.New("expect a base64 string")
+		}
+		return val, nil
+	case TYPE_INT64:
+		var i64 int64
+		if err := json.Unmarshal(data, &i64); err != nil {
+			return Value{}, errors.New("expect an integer")
+		}
+		return Value{Type: typ, I64: i64}, nil
+	case TYPE_FLOAT64:
+		var f64 float64
+		if err := json.Unmarshal(data, &f64); err != nil {
+			var str string // the infinities
+			if json.Unmarshal(data, &str) != nil {
+				return Value{}, errors.New("expect a number")
+			}
+			return ParseValue(typ, str)
+		}
+		return Value{Type: typ, F64: f64}, nil
+	case TYPE_BOOL:
+		var b bool
+		if err := json.Unmarshal(data, &b); err != nil {
+			return Value{}, errors.New("expect a boolean")
+		}
+		return Value{Type: typ, I64: boolToInt64(b)}, nil
+	case TYPE_TIMESTAMP, TYPE_DECIMAL:
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			var num json.Number
+			if typ == TYPE_TIMESTAMP || json.Unmarshal(data, &num) != nil {
+				return Value{}, fmt.Errorf("expect a %s", TypeName(typ))
+			}
+			str = num.String()
+		}
+		return ParseValue(typ, str)
+	}
+	return Value{}, errors.New("bad column type")
+}
+
+// a JSON object to a record with the first n columns of the table.
+// a nullable column is null for NULL, a missing column gets the default.
+func recordFromJSON(tdef *TableDef, obj map[string]json.RawMessage, n int) (Record, error) {
+	rec := Record{}
+	for col := range obj {
+		if idx := colIndex(tdef, col); idx < 0 || idx >= n {
+			return rec, fmt.Errorf("unknown column: %s", col)
+		}
+	}
+	for i, col := range tdef.Cols[:n] {
+		data, ok := obj[col]
+		if !ok && hasDefault(tdef, i) {
+			continue // filled by dbUpdate
+		}
+		if !ok && i == 0 && tdef.AutoIncrement {
+			continue // filled by autoIncrement, or a missing key for updates
+		}
+		if !ok {
+			return rec, fmt.Errorf("missing column: %s", col)
+		}
+		if isNullable(tdef, i) && string(data) == "null" {
+			rec.AddNull(col)
+			continue
+		}
+		val, err := valueFromJSON(tdef.Types[i], data)
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, val)
+	}
+	return rec, nil
+}
+
+// the primary key from the query parameters, e.g. ?id=1 or ?key1.id=1
+func recordFromQuery(tdef *TableDef, r *http.Request, prefix string) (Record, error) {
+	rec := Record{}
+	for i, col := range tdef.Cols[:tdef.PKeys] {
+		if !r.URL.Query().Has(prefix + col) {
+			return rec, fmt.Errorf("missing key column: %s", prefix+col)
+		}
+		val, err := ParseValue(tdef.Types[i], r.URL.Query().Get(prefix+col))
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, val)
+	}
+	return rec, nil
+}
+
+// a prefix of the primary key, the missing columns are at the end
+func keyPrefixFromQuery(tdef *TableDef, r *http.Request, prefix string) (Record, error) {
+	rec := Record{}
+	for i, col := range tdef.Cols[:tdef.PKeys] {
+		if !r.URL.Query().Has(prefix + col) {
+			for _, rest := range tdef.Cols[i+1 : tdef.PKeys] {
+				if r.URL.Query().Has(prefix + rest) {
+					return rec, fmt.Errorf("missing key column: %s", prefix+col)
+				}
+			}
+			break
+		}
+		val, err := ParseValue(tdef.Types[i], r.URL.Query().Get(prefix+col))
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, val)
+	}
+	return rec, nil
+}
+
+func recordToJSON(rec *Record) map[string]any {
+	obj := map[string]any{}
+	for i, col := range rec.Cols {
+		obj[col] = dumpValue(&rec.Vals[i])
+	}
+	return obj
+}
+
+// look up the table of the request, the caller holds the lock.
+func (s *HttpServer) table(w http.ResponseWriter, r *http.Request) *TableDef {
+	name := r.PathValue("name")
+	tdef := getTableDef(s.db, name)
+	if tdef == nil {
+		httpError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrTableNotFound, name))
+	}
+	return tdef
+}
+
+func (s *HttpServer) tableNew(w http.ResponseWriter, r *http.Request) {
+	tdef := &TableDef{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(tdef); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := tableDefCheck(tdef); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.TableNew(tdef); err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	httpJSON(w, http.StatusCreated, tdef)
+}
+
+func (s *HttpServer) tableGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tdef := s.table(w, r); tdef != nil {
+		httpJSON(w, http.StatusOK, tdef)
+	}
+}
+
+func (s *HttpServer) tableDrop(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.DropTable(r.PathValue("name")); err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	httpJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// delete all the rows
+func (s *HttpServer) tableTruncate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.TruncateTable(r.PathValue("name")); err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	httpJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// the backfill releases the lock between batches, the writes go on.
+func (s *HttpServer) indexNew(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Cols   []string
+		Unique bool
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	tdef := s.table(w, r)
+	if tdef == nil {
+		s.mu.Unlock()
+		return
+	}
+	if _, err := checkIndexKeys(tdef, req.Cols, req.Unique); err != nil {
+		s.mu.Unlock()
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	builder, err := s.db.IndexNew(tdef.Name, req.Cols, req.Unique)
+	s.mu.Unlock()
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	for done := false; !done && err == nil; {
+		s.mu.Lock()
+		done, err = builder.Step(INDEX_BATCH_SIZE)
+		s.mu.Unlock()
+	}
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tdef = s.table(w, r); tdef != nil {
+		httpJSON(w, http.StatusCreated, tdef) // with the new index
+	}
+}
+
+func (s *HttpServer) rowSet(mode int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		obj := map[string]json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		tdef := s.table(w, r)
+		if tdef == nil {
+			return
+		}
+		rec, err := recordFromJSON(tdef, obj, len(tdef.Cols))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		if mode == MODE_INSERT_ONLY {
+			id, err := s.db.Insert(tdef.Name, rec)
+			if err != nil {
+				httpError(w, httpStatus(err), err)
+				return
+			}
+			out := map[string]any{"updated": true}
+			if tdef.AutoIncrement {
+				out["id"] = id
+			}
+			httpJSON(w, http.StatusCreated, out)
+			return
+		}
+		added, err := s.db.Set(tdef.Name, rec, mode)
+		if err != nil {
+			httpError(w, httpStatus(err), err)
+			return
+		}
+		httpJSON(w, http.StatusOK, map[string]any{"updated": added})
+	}
+}
+
+func (s *HttpServer) rowGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tdef := s.table(w, r)
+	if tdef == nil {
+		return
+	}
+	rec, err := recordFromQuery(tdef, r, "")
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	ok, err := dbGet(s.db, tdef, &rec)
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if !ok {
+		httpError(w, http.StatusNotFound, ErrKeyNotExist)
+		return
+	}
+	httpJSON(w, http.StatusOK, recordToJSON(&rec))
+}
+
+func (s *HttpServer) rowDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tdef := s.table(w, r)
+	if tdef == nil {
+		return
+	}
+	rec, err := recordFromQuery(tdef, r, "")
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	deleted, err := dbDelete(s.db, tdef, rec)
+	if err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if !deleted {
+		httpError(w, http.StatusNotFound, ErrKeyNotExist)
+		return
+	}
+	httpJSON(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+func parseCmp(str string) (int, error) {
+	switch str {
+	case "ge":
+		return CMP_GE, nil
+	case "gt":
+		return CMP_GT, nil
+	case "lt":
+		return CMP_LT, nil
+	case "le":
+		return CMP_LE, nil
+	}
+	return 0, fmt.Errorf("bad comparison: %q", str)
+}
+
+func (s *HttpServer) rowScan(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tdef := s.table(w, r)
+	if tdef == nil {
+		return
+	}
+	sc := Scanner{}
+	var err error
+	query := r.URL.Query()
+	if sc.Cmp1, err = parseCmp(query.Get("cmp1")); err == nil {
+		sc.Cmp2, err = parseCmp(query.Get("cmp2"))
+	}
+	if err == nil {
+		sc.Key1, err = keyPrefixFromQuery(tdef, r, "key1.")
+	}
+	if err == nil {
+		sc.Key2, err = keyPrefixFromQuery(tdef, r, "key2.")
+	}
+	if err == nil && query.Has("where") {
+		sc.Filter, err = ParseExpr(query.Get("where"))
+	}
+	if err == nil && query.Get("cols") != "" {
+		sc.Cols = strings.Split(query.Get("cols"), ",")
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := dbScan(s.db, tdef, &sc); err != nil {
+		httpError(w, httpStatus(err), err)
+		return
+	}
+	if err := sc.Err(); err != nil {
+		httpError(w, http.StatusBadRequest, err) // the filter
+		return
+	}
+	// one JSON object per line
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		line, err := json.Marshal(recordToJSON(&rec))
+		Assert(err == nil)
+		out.Write(line)
+		out.WriteByte('\n')
+		if out.Buffered() > 64<<10 {
+			out.Flush()
+		}
+	}
+	if err := sc.Err(); err != nil {
+		line, _ := json.Marshal(map[string]string{"error": err.Error()})
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+}
+
+// the table as CSV, see ExportCSV
+func (s *HttpServer) csvExport(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tdef := s.table(w, r)
+	if tdef == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	s.db.ExportCSV(tdef.Name, out) // the status is sent
+}
+
+// the rows of a CSV body, the bad rows are reported by line
+func (s *HttpServer) csvImport(mode int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := CSVOptions{Mode: mode}
+		if batch := r.URL.Query().Get("batch"); batch != "" {
+			n, err := strconv.Atoi(batch)
+			if err != nil || n <= 0 {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("bad batch size: %q", batch))
+				return
+			}
+			opts.BatchSize = n
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		tdef := s.table(w, r)
+		if tdef == nil {
+			return
+		}
+		report, err := s.db.ImportCSV(tdef.Name, r.Body, opts)
+		if report == nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			httpError(w, httpStatus(err), err)
+			return
+		}
+		errs := []map[string]any{}
+		for _, e := range report.Errors {
+			errs = append(errs, map[string]any{"line": e.Line, "error": e.Err.Error()})
+		}
+		httpJSON(w, http.StatusOK, map[string]any{"rows": report.Rows, "errors": errs})
+	}
+}
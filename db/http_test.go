@@ -0,0 +1,212 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeJSONLines(t *testing.T, data []byte) []map[string]any {
+	rows := []map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for dec.More() {
+		row := map[string]any{}
+		assert.NoError(t, dec.Decode(&row))
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestHttp(t *testing.T) {
+	os.Remove("test_http.db")
+	defer os.Remove("test_http.db")
+	db := &DB{Path: "test_http.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	srv := httptest.NewServer(NewHttpServer(db))
+	defer srv.Close()
+
+	do := func(method string, path string, body string) (int, []byte) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, data
+	}
+
+	tdef := `{"Name":"people","Types":[2,1,2],"Cols":["id","name","age"],"PKeys":1}`
+	code, _ := do("POST", "/tables", tdef)
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = do("POST", "/tables", tdef)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = do("POST", "/tables", `{"Name":"bad","Types":[2],"Cols":["a","b"],"PKeys":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, data := do("GET", "/tables/people", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, string(data), `"Prefix":100`)
+	code, _ = do("GET", "/tables/nope", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for i, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		body, _ := json.Marshal(map[string]any{"id": i + 1, "name": []byte(name), "age": 20 + i}) // base64
+		code, _ = do("POST", "/tables/people/rows", string(body))
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	code, _ = do("POST", "/tables/people/rows", `{"id":1,"name":"YWdhaW4=","age":1}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = do("PATCH", "/tables/people/rows", `{"id":9,"name":"bm9ib2R5","age":1}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("PATCH", "/tables/people/rows", `{"id":2,"name":"Ym9iYnk=","age":33}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("PUT", "/tables/people/rows", `{"id":6,"name":"ZnJhbms=","age":40}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("POST", "/tables/people/rows", `{"id":"x","name":"YmFk","age":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("POST", "/tables/people/rows", `{"id":7,"name":"not base64","age":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("POST", "/tables/nope/rows", `{"id":1}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, data = do("GET", "/tables/people/row?id=2", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"id":2,"name":"Ym9iYnk=","age":33}`, string(data))
+	code, _ = do("GET", "/tables/people/row?id=42", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("DELETE", "/tables/people/row?id=3", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("DELETE", "/tables/people/row?id=3", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, data = do("GET", "/tables/people/rows?cmp1=ge&key1.id=2&cmp2=lt&key2.id=6", "")
+	assert.Equal(t, http.StatusOK, code)
+	rows := decodeJSONLines(t, data)
+	ids := []string{}
+	for _, row := range rows {
+		ids = append(ids, string(row["id"].(json.Number)))
+	}
+	assert.Equal(t, []string{"2", "4", "5"}, ids)
+	// descending, past the last key
+	code, data = do("GET", "/tables/people/rows?cmp1=le&key1.id=100&cmp2=gt&key2.id=4", "")
+	assert.Equal(t, http.StatusOK, code)
+	rows = decodeJSONLines(t, data)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "ZnJhbms=", rows[0]["name"])
+	code, _ = do("GET", "/tables/people/rows?cmp1=ge&key1.id=2", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("GET", "/tables/people/rows?cmp1=ge&cmp2=gt", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("GET", "/tables/people/rows?cmp1=ge&cmp2=le&cols=nope", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	// a filter and a projection
+	code, data = do("GET", "/tables/people/rows?cmp1=ge&key1.id=2&cmp2=lt&key2.id=6&where=id%21%3D4&cols=id", "")
+	assert.Equal(t, http.StatusOK, code)
+	rows = decodeJSONLines(t, data)
+	assert.Equal(t, []map[string]any{{"id": json.Number("2")}, {"id": json.Number("5")}}, rows)
+	code, _ = do("GET", "/tables/people/rows?cmp1=ge&key1.id=2&cmp2=lt&key2.id=6&where=nope%3D1", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	// open-ended
+	code, data = do("GET", "/tables/people/rows?cmp1=ge&key1.id=4&cmp2=le", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, len(decodeJSONLines(t, data)))
+
+	code, data = do("POST", "/tables/people/indexes", `{"Cols":["age"]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Contains(t, string(data), `"Indexes":[["age","id"]]`)
+	assert.Contains(t, string(data), `"Building":[false]`)
+	code, _ = do("POST", "/tables/people/indexes", `{"Cols":["age"]}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = do("POST", "/tables/people/indexes", `{"Cols":["nope"]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// float64, bool, timestamp, decimal
+	code, _ = do("POST", "/tables", `{"Name":"m","Types":[5,3,4,6],"Cols":["at","v","ok","d"],"PKeys":1}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = do("POST", "/tables/m/rows", `{"at":"2024-05-01T12:00:00.5Z","v":-1.5,"ok":true,"d":"10.01"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = do("PUT", "/tables/m/rows", `{"at":"2024-05-02T00:00:00Z","v":"+Inf","ok":false,"d":3}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, data = do("GET", "/tables/m/row?at=2024-05-01T12:00:00.5Z", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"at":"2024-05-01T12:00:00.5Z","v":-1.5,"ok":true,"d":"10.01"}`, string(data))
+	code, data = do("GET", "/tables/m/row?at=2024-05-02T00:00:00Z", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"at":"2024-05-02T00:00:00Z","v":"+Inf","ok":false,"d":"3"}`, string(data))
+	code, _ = do("POST", "/tables/m/rows", `{"at":"yesterday","v":1,"ok":true,"d":"1"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// a check that fails to evaluate on the row is a bad request
+	code, _ = do("POST", "/tables", `{"Name":"c","Types":[2,2],"Cols":["id","n"],"PKeys":1,"Checks":["10 / n > 1"]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = do("POST", "/tables/c/rows", `{"id":1,"n":2}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, data = do("POST", "/tables/c/rows", `{"id":2,"n":0}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, string(data), "division by zero")
+	code, _ = do("POST", "/tables/c/rows", `{"id":3,"n":20}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// AUTO_INCREMENT
+	code, _ = do("POST", "/tables", `{"Name":"a","Types":[2,1],"Cols":["id","s"],"PKeys":1,"AutoIncrement":true}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, data = do("POST", "/tables/a/rows", `{"s":"eA=="}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.JSONEq(t, `{"updated":true,"id":1}`, string(data))
+	code, _ = do("PATCH", "/tables/a/rows", `{"s":"eQ=="}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// CSV
+	code, data = do("PUT", "/tables/a/csv?batch=1", "s\nz\n\"a,b\"\n")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"rows":2,"errors":[]}`, string(data))
+	code, data = do("POST", "/tables/a/csv", "id,s\n1,dup\n9,w\n")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"rows":1,"errors":[{"line":2,"error":"key exist"}]}`, string(data))
+	code, data = do("GET", "/tables/a/csv", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "id,s\n1,x\n2,z\n3,\"a,b\"\n9,w\n", string(data))
+	code, _ = do("POST", "/tables/a/csv", "nope\n1\n")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("PUT", "/tables/a/csv?batch=x", "s\n")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("GET", "/tables/nope/csv", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// truncate and drop
+	code, _ = do("DELETE", "/tables/people/rows", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("GET", "/tables/people/row?id=2", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("DELETE", "/tables/m", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do("DELETE", "/tables/m", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", "/tables/m/row?at=2024-05-02T00:00:00Z", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestHttpStatus(t *testing.T) {
+	tdef := &TableDef{Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "s"}, PKeys: 1}
+	for _, rec := range []*Record{
+		(&Record{}).AddStr("id", []byte("x")).AddStr("s", nil), // type
+		(&Record{}).AddStr("s", nil),                           // missing
+	} {
+		_, err := checkRecord(tdef, *rec, len(tdef.Cols))
+		assert.Equal(t, http.StatusBadRequest, httpStatus(err), err)
+	}
+	_, err := checkRecord(tdef, Record{}, 0)
+	assert.Equal(t, http.StatusBadRequest, httpStatus(err))
+	assert.Equal(t, http.StatusBadRequest, httpStatus(ErrTooManyErrors))
+	assert.Equal(t, http.StatusInternalServerError, httpStatus(errors.New("fsync: i/o error")))
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "server"
+	"slices"
+	"strings"
+	. "types"
+	. "utils"
+)
+
+// Online index creation.
+//
+// A new index is saved in the table definition in the building state.
+// From then on the writes maintain it like the other indexes, while an
+// IndexBuilder backfills the existing rows in batches, each batch is a
+// separate commit so that the writers can run in between. The backfill
+// is idempotent: a row gets the same index key whether it is written by
+// a writer or by the backfill. The index is marked as ready once the
+// whole table is scanned, and only then it is used by the queries.
+
+var ErrIndexExists = errors.New("index exists")
+
+// a background job outlived its table
+var ErrTableChanged = errors.New("the table was dropped or truncated")
+
+// the number of rows backfilled per commit
+const INDEX_BATCH_SIZE = 1000
+
+// the backfill of a building index
+type IndexBuilder struct {
+	db     *DB
+	tdef   *TableDef
+	prefix uint32 // identifies the index
+	next   []byte // the scan resumes from here
+	done   bool
+	err    error // the build failed
+}
+
+// add an index to a table that may hold rows, the returned builder
+// must be run to make the index ready. an interrupted build is resumed
+// by calling this again with the same columns.
+func (db *DB) IndexNew(table string, cols []string, unique bool) (*IndexBuilder, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	cols, err := checkIndexKeys(tdef, cols, unique)
+	if err != nil {
+		return nil, err
+	}
+	for i, index := range tdef.Indexes {
+		if !slices.Equal(index, cols) || isUnique(tdef, i) != unique {
+			continue
+		}
+		if !isBuilding(tdef, i) {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrIndexExists, table, strings.Join(cols, ", "))
+		}
+		return newIndexBuilder(db, tdef, tdef.IndexPrefixes[i]), nil
+	}
+	prefix, err := allocPrefixes(db, 1)
+	if err != nil {
+		return nil, err
+	}
+	// on a copy, the cached definition is replaced once saved.
+	// the optional flags are filled up to the new index.
+	def := *tdef
+	def.Unique, def.Building = slices.Clone(tdef.Unique), slices.Clone(tdef.Building)
+	for len(def.Unique) < len(def.Indexes) {
+		def.Unique = append(def.Unique, false)
+	}
+	for len(def.Building) < len(def.Indexes) {
+		def.Building = append(def.Building, false)
+	}
+	def.Indexes = append(slices.Clone(tdef.Indexes), cols)
+	def.IndexPrefixes = append(slices.Clone(tdef.IndexPrefixes), prefix)
+	def.Unique = append(def.Unique, unique)
+	def.Building = append(def.Building, true)
+	if err := tableDefSave(db, &def); err != nil {
+		return nil, err
+	}
+	db.tables[table] = &def
+	return newIndexBuilder(db, &def, prefix), nil
+}
+
+func newIndexBuilder(db *DB, tdef *TableDef, prefix uint32) *IndexBuilder {
+	return &IndexBuilder{db: db, tdef: tdef, prefix: prefix, next: encodeKey(nil, tdef.Prefix, nil)}
+}
+
+// the position of the index in the table definition
+func (b *IndexBuilder) index() int {
+	idx := slices.Index(b.tdef.IndexPrefixes, b.prefix)
+	Assert(idx >= 0)
+	return idx
+}
+
+// backfill up to n rows in one commit, returns true when the index is ready.
+// a duplicate in a unique index fails the build and removes the index.
+func (b *IndexBuilder) Step(n int) (bool, error) {
+	if b.done {
+		return b.err == nil, b.err
+	}
+	if b.tdef = currentTableDef(b.db, b.tdef.Name, b.prefix); b.tdef == nil {
+		b.done, b.err = true, ErrTableChanged
+		return false, b.err
+	}
+	db, tdef, idx := b.db, b.tdef, b.index()
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	sc := Scanner{tdef: tdef, index: -1, iter: db.kv.GetTree().Seek(b.next, CMP_GE)}
+	batch := &Batch{}
+	added := map[string]bool{} // the unique keys of this batch
+	count, more := 0, true
+	for ; count < n; sc.iter.Next() {
+		if !sc.iter.Valid() {
+			more = false
+			break
+		}
+		key, _ := sc.iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			more = false
+			break
+		}
+		rec := Record{}
+		sc.Deref(&rec)
+		ikey := encodeIndexKey(tdef, idx, rec.Vals)
+		var ival []byte
+		if isUnique(tdef, idx) {
+			ival = encodeValues(nil, rec.Vals[:tdef.PKeys])
+			old, ok := db.kv.Get(ikey)
+			if added[string(ikey)] || (ok && !bytes.Equal(old, ival)) {
+				b.err = &ConstraintError{Table: tdef.Name, Kind: "unique", Cols: tdef.Indexes[idx]}
+				return false, errors.Join(b.err, b.abort())
+			}
+			added[string(ikey)] = true
+		}
+		batch.Set(ikey, ival)
+		b.next = append(append([]byte{}, key...), 0) // the next possible key
+		count++
+	}
+	if _, err := db.kv.Commit(batch); err != nil {
+		return false, err
+	}
+	if more {
+		return false, nil
+	}
+	ready := *tdef
+	ready.Building = slices.Clone(tdef.Building)
+	ready.Building[idx] = false
+	if err := tableDefSave(db, &ready); err != nil {
+		return false, err
+	}
+	db.tables[tdef.Name], b.tdef = &ready, &ready
+	b.done = true
+	return true, nil
+}
+
+// backfill the whole table, n rows per commit
+func (b *IndexBuilder) Run(n int) error {
+	for {
+		done, err := b.Step(n)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// remove the building index and its entries
+func (b *IndexBuilder) abort() error {
+	tdef, idx := b.tdef, b.index()
+	def := *tdef
+	def.Indexes = slices.Delete(slices.Clone(tdef.Indexes), idx, idx+1)
+	def.IndexPrefixes = slices.Delete(slices.Clone(tdef.IndexPrefixes), idx, idx+1)
+	def.Unique = slices.Delete(slices.Clone(tdef.Unique), idx, idx+1)
+	def.Building = slices.Delete(slices.Clone(tdef.Building), idx, idx+1)
+	if err := tableDefSave(b.db, &def); err != nil {
+		return err
+	}
+	b.db.tables[tdef.Name], b.tdef = &def, &def
+	b.done = true
+	return dbDelPrefixes(b.db, []uint32{b.prefix})
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	. "server"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// count the B-tree keys with the prefix
+func countPrefix(db *DB, prefix uint32) int {
+	start := encodeKey(nil, prefix, nil)
+	n := 0
+	for iter := db.kv.GetTree().Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if !bytes.HasPrefix(key, start) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func TestIndex(t *testing.T) {
+	os.Remove("test_index.db")
+	defer os.Remove("test_index.db")
+	db := &DB{Path: "test_index.db"}
+	assert.NoError(t, db.Open())
+
+	tdef := &TableDef{
+		Name:    "people",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"id", "name", "age", "city"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}, {"city", "age"}},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	assert.Equal(t, [][]string{{"age", "id"}, {"city", "age", "id"}}, tdef.Indexes)
+	assert.Equal(t, []uint32{tdef.Prefix + 1, tdef.Prefix + 2}, tdef.IndexPrefixes)
+	// the next table gets the prefix after the indexes
+	other := &TableDef{Name: "other", Types: []uint32{TYPE_INT64}, Cols: []string{"k"}, PKeys: 1}
+	assert.NoError(t, db.TableNew(other))
+	assert.Equal(t, tdef.Prefix+3, other.Prefix)
+
+	bad := &TableDef{Name: "bad", Types: []uint32{TYPE_INT64}, Cols: []string{"k"}, PKeys: 1}
+	bad.Indexes = [][]string{{"nope"}}
+	assert.Error(t, db.TableNew(bad))
+	bad.Indexes = [][]string{{}}
+	assert.Error(t, db.TableNew(bad))
+
+	row := func(id int64, name string, age int64, city string) Record {
+		rec := Record{}
+		rec.AddInt64("id", id).AddStr("name", []byte(name)).AddInt64("age", age).AddStr("city", []byte(city))
+		return rec
+	}
+	for _, rec := range []Record{
+		row(1, "alice", 30, "paris"),
+		row(2, "bob", 25, "tokyo"),
+		row(3, "carol", 41, "paris"),
+		row(4, "dave", 30, "berlin"),
+	} {
+		_, err := db.Insert("people", rec)
+		assert.NoError(t, err)
+	}
+	scan := func(sc Scanner) []string {
+		assert.NoError(t, db.Scan("people", &sc))
+		names := []string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			sc.Deref(&rec)
+			assert.Equal(t, tdef.Cols, rec.Cols)
+			names = append(names, string(rec.Get("name").Str))
+		}
+		return names
+	}
+	age := func(v int64) Record { return *(&Record{}).AddInt64("age", v) }
+	city := func(v string) Record { return *(&Record{}).AddStr("city", []byte(v)) }
+
+	// the index prefix matches all the rows with the same age
+	assert.Equal(t, []string{"alice", "dave"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: age(30), Key2: age(30)}))
+	assert.Equal(t, []string{"alice", "dave", "carol"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LT, Key1: age(26), Key2: age(100)}))
+	assert.Equal(t, []string{"carol"}, scan(Scanner{Cmp1: CMP_GT, Cmp2: CMP_LE, Key1: age(30), Key2: age(100)}))
+	assert.Equal(t, []string{"dave", "alice", "bob"}, scan(Scanner{Cmp1: CMP_LE, Cmp2: CMP_GE, Key1: age(30), Key2: age(0)}))
+	assert.Equal(t, []string{"bob"}, scan(Scanner{Cmp1: CMP_LT, Cmp2: CMP_GT, Key1: age(30), Key2: age(0)}))
+	// a composite index, by the prefix or by all the columns
+	assert.Equal(t, []string{"alice", "carol"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: city("paris"), Key2: city("paris")}))
+	key1 := *(&Record{}).AddInt64("age", 35).AddStr("city", []byte("paris"))
+	key2 := *(&Record{}).AddStr("city", []byte("paris")).AddInt64("age", 50)
+	assert.Equal(t, []string{"carol"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key1, Key2: key2}))
+	// not an index
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddStr("name", nil), Key2: *(&Record{}).AddStr("name", nil)}
+	assert.Error(t, db.Scan("people", &sc))
+
+	// updates replace the stale index entries
+	_, err := db.Update("people", row(1, "alice", 31, "paris"))
+	assert.NoError(t, err)
+	_, err = db.Upsert("people", row(2, "bob", 25, "paris"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dave"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: age(30), Key2: age(30)}))
+	assert.Equal(t, []string{"bob", "alice", "carol"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: city("paris"), Key2: city("paris")}))
+	assert.Equal(t, 4, countPrefix(db, tdef.IndexPrefixes[0]))
+	assert.Equal(t, 4, countPrefix(db, tdef.IndexPrefixes[1]))
+	// a failed insert leaves the indexes alone
+	_, err = db.Insert("people", row(1, "dup", 99, "rome"))
+	assert.ErrorIs(t, err, ErrKeyExist)
+	assert.Equal(t, 4, countPrefix(db, tdef.IndexPrefixes[0]))
+
+	// deletes remove the index entries
+	deleted, err := db.Delete("people", *(&Record{}).AddInt64("id", 3))
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, 3, countPrefix(db, tdef.IndexPrefixes[0]))
+	assert.Equal(t, 3, countPrefix(db, tdef.IndexPrefixes[1]))
+
+	// the indexes survive a reopen
+	db.Close()
+	db = &DB{Path: "test_index.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, tdef.Indexes, db.GetTableDef("people").Indexes)
+	assert.Equal(t, []string{"bob", "alice"}, scan(Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: city("paris"), Key2: city("paris")}))
+}
+
+func TestUniqueIndex(t *testing.T) {
+	os.Remove("test_unique.db")
+	defer os.Remove("test_unique.db")
+	db := &DB{Path: "test_unique.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"id", "email", "team"},
+		PKeys:   1,
+		Indexes: [][]string{{"email"}, {"team"}},
+		Unique:  []bool{true},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	assert.Equal(t, [][]string{{"email"}, {"team", "id"}}, tdef.Indexes)
+
+	row := func(id int64, email string, team string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddStr("team", []byte(team))
+	}
+	_, err := db.Insert("users", row(1, "a@x", "red"))
+	assert.NoError(t, err)
+	_, err = db.Insert("users", row(2, "b@x", "red"))
+	assert.NoError(t, err)
+
+	// duplicates are rejected without touching the table
+	_, err = db.Insert("users", row(3, "a@x", "blue"))
+	var cerr *ConstraintError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, "unique", cerr.Kind)
+	assert.Equal(t, []string{"email"}, cerr.Cols)
+	ok, err := db.Get("users", (&Record{}).AddInt64("id", 3))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2, countPrefix(db, tdef.IndexPrefixes[1]))
+	_, err = db.Update("users", row(2, "a@x", "blue"))
+	assert.ErrorAs(t, err, &cerr)
+	rec := (&Record{}).AddInt64("id", 2)
+	_, err = db.Get("users", rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "red", string(rec.Get("team").Str))
+
+	// a row can keep its own value, or take a freed one
+	_, err = db.Update("users", row(1, "a@x", "blue"))
+	assert.NoError(t, err)
+	_, err = db.Update("users", row(1, "c@x", "blue"))
+	assert.NoError(t, err)
+	_, err = db.Insert("users", row(3, "a@x", "green"))
+	assert.NoError(t, err)
+	_, err = db.Delete("users", *(&Record{}).AddInt64("id", 3))
+	assert.NoError(t, err)
+	_, err = db.Insert("users", row(4, "a@x", "green"))
+	assert.NoError(t, err)
+
+	// lookup by the unique index
+	email := *(&Record{}).AddStr("email", []byte("a@x"))
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: email, Key2: email}
+	assert.NoError(t, db.Scan("users", &sc))
+	assert.True(t, sc.Valid())
+	sc.Deref(rec)
+	assert.Equal(t, int64(4), rec.Get("id").I64)
+	sc.Next()
+	assert.False(t, sc.Valid())
+}
+
+func TestIndexNew(t *testing.T) {
+	os.Remove("test_index_new.db")
+	defer os.Remove("test_index_new.db")
+	db := &DB{Path: "test_index_new.db"}
+	assert.NoError(t, db.Open())
+
+	tdef := &TableDef{
+		Name:  "t",
+		Types: []uint32{TYPE_INT64, TYPE_INT64},
+		Cols:  []string{"id", "v"},
+		PKeys: 1,
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	row := func(id int64, v int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddInt64("v", v)
+	}
+	for i := int64(0); i < 100; i++ {
+		_, err := db.Insert("t", row(i, i%10))
+		assert.NoError(t, err)
+	}
+	v := func(x int64) Record { return *(&Record{}).AddInt64("v", x) }
+	count := func(x int64) int {
+		sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: v(x), Key2: v(x)}
+		if err := db.Scan("t", &sc); err != nil {
+			return -1
+		}
+		n := 0
+		for ; sc.Valid(); sc.Next() {
+			n++
+		}
+		return n
+	}
+
+	old := db.GetTableDef("t")
+	b, err := db.IndexNew("t", []string{"v"}, false)
+	assert.NoError(t, err)
+	tdef = db.GetTableDef("t")
+	assert.Equal(t, []bool{true}, tdef.Building)
+	// the definition is replaced once saved, not changed in place
+	assert.Empty(t, old.Indexes)
+	// not used by queries while building
+	assert.Equal(t, -1, count(3))
+	done, err := b.Step(30)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	// the writes in the middle of the backfill
+	_, err = db.Update("t", row(5, 3)) // backfilled
+	assert.NoError(t, err)
+	_, err = db.Update("t", row(90, 3)) // not yet
+	assert.NoError(t, err)
+	_, err = db.Delete("t", *(&Record{}).AddInt64("id", 93)) // not yet
+	assert.NoError(t, err)
+	_, err = db.Insert("t", row(200, 3)) // after the cursor
+	assert.NoError(t, err)
+	_, err = db.Insert("t", row(-1, 3)) // before the cursor
+	assert.NoError(t, err)
+	assert.NoError(t, b.Run(30))
+	tdef = db.GetTableDef("t")
+	assert.Equal(t, []bool{false}, tdef.Building)
+	assert.Equal(t, 13, count(3))
+	assert.Equal(t, 9, count(5))
+	assert.Equal(t, 9, count(0))
+	assert.Equal(t, 101, countPrefix(db, tdef.IndexPrefixes[0]))
+
+	_, err = db.IndexNew("t", []string{"v"}, false)
+	assert.ErrorIs(t, err, ErrIndexExists)
+
+	// a unique index fails on duplicates and is removed
+	b, err = db.IndexNew("t", []string{"v"}, true)
+	assert.NoError(t, err)
+	prefix := db.GetTableDef("t").IndexPrefixes[1]
+	var cerr *ConstraintError
+	assert.ErrorAs(t, b.Run(30), &cerr)
+	assert.Equal(t, 1, len(db.GetTableDef("t").Indexes))
+	assert.Equal(t, 0, countPrefix(db, prefix))
+	b, err = db.IndexNew("t", []string{"id", "v"}, true)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Run(7))
+
+	// an interrupted build is resumed after a reopen
+	b, err = db.IndexNew("t", []string{"id", "v"}, false)
+	assert.NoError(t, err)
+	_, err = b.Step(10)
+	assert.NoError(t, err)
+	db.Close()
+	db = &DB{Path: "test_index_new.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	tdef = db.GetTableDef("t")
+	assert.Equal(t, []bool{false, false, true}, tdef.Building)
+	b, err = db.IndexNew("t", []string{"id", "v"}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Run(1000))
+	tdef = db.GetTableDef("t")
+	assert.Equal(t, []bool{false, false, false}, tdef.Building)
+	assert.Equal(t, 101, countPrefix(db, tdef.IndexPrefixes[2]))
+	_, err = db.ExecSQL("create unique index on t (v)")
+	assert.Error(t, err)
+	_, err = db.ExecSQL("create index on t (v, id)")
+	assert.ErrorIs(t, err, ErrIndexExists)
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	. "types"
+)
+
+// Joins.
+//
+// An inner join scans the left table and finds the matching rows of the
+// right table for each left row. The right rows are found by point lookups
+// when the join columns are the primary key, or by seeking the primary key
+// or a secondary index that starts with the join columns. Otherwise the
+// right table is scanned once into a hash table of the join values. NULL
+// matches nothing.
+
+const (
+	JOIN_HASH   = 1 // a hash table of the right rows
+	JOIN_LOOKUP = 2 // point lookups by the primary key
+	JOIN_INDEX  = 3 // seeks on a key prefix or a secondary index
+)
+
+// an inner join of 2 tables on equal columns
+type JoinQuery struct {
+	Left      string   // the outer table
+	Right     string   // the inner table
+	LeftCols  []string // the join columns
+	RightCols []string // pairwise equal to LeftCols
+	// the qualifiers of the output columns, the table names by default
+	LeftAs  string
+	RightAs string
+	Filter  func(rec *Record) bool // optional, on the joined rows
+}
+
+// how to find the rows of the inner table by the join columns,
+// which are distinct, see Join
+func joinMethod(tdef *TableDef, cols []string) int {
+	switch {
+	case len(cols) == tdef.PKeys && isPKeyPrefix(tdef, cols):
+		return JOIN_LOOKUP
+	case isPKeyPrefix(tdef, cols) || findIndex(tdef, cols) >= 0:
+		return JOIN_INDEX
+	}
+	return JOIN_HASH
+}
+
+// the join values of a row, false if any is NULL
+func joinValues(rec *Record, cols []string) ([]Value, bool) {
+	vals := make([]Value, len(cols))
+	for i, col := range cols {
+		vals[i] = *rec.Get(col)
+		if vals[i].Type == TYPE_NULL {
+			return nil, false
+		}
+	}
+	return vals, true
+}
+
+// join 2 tables, each output row has the columns of the left row then
+// the right row, named as `table.column`. the rows come in the order of
+// the left table.
+func (db *DB) Join(q *JoinQuery) ([]Record, error) {
+	left, right := getTableDef(db, q.Left), getTableDef(db, q.Right)
+	switch {
+	case left == nil:
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, q.Left)
+	case right == nil:
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, q.Right)
+	case len(q.LeftCols) == 0 || len(q.LeftCols) != len(q.RightCols):
+		return nil, errors.New("bad join columns")
+	}
+	for i := range q.LeftCols {
+		switch {
+		case slices.Contains(q.LeftCols[:i], q.LeftCols[i]):
+			return nil, fmt.Errorf("repeated join column: %s", q.LeftCols[i])
+		case slices.Contains(q.RightCols[:i], q.RightCols[i]):
+			return nil, fmt.Errorf("repeated join column: %s", q.RightCols[i])
+		}
+	}
+	for i := range q.LeftCols {
+		li, ri := colIndex(left, q.LeftCols[i]), colIndex(right, q.RightCols[i])
+		switch {
+		case li < 0:
+			return nil, fmt.Errorf("unknown column: %s", q.LeftCols[i])
+		case ri < 0:
+			return nil, fmt.Errorf("unknown column: %s", q.RightCols[i])
+		case left.Types[li] != right.Types[ri]:
+			return nil, fmt.Errorf("mismatched types: %s and %s", q.LeftCols[i], q.RightCols[i])
+		}
+	}
+	lname, rname := q.LeftAs, q.RightAs
+	if lname == "" {
+		lname = q.Left
+	}
+	if rname == "" {
+		rname = q.Right
+	}
+	if lname == rname {
+		return nil, fmt.Errorf("ambiguous table name: %s", lname)
+	}
+
+	out := []Record{}
+	emit := func(l *Record, r *Record) {
+		rec := Record{}
+		for i, col := range l.Cols {
+			rec.Cols = append(rec.Cols, lname+"."+col)
+			rec.Vals = append(rec.Vals, l.Vals[i])
+		}
+		for i, col := range r.Cols {
+			rec.Cols = append(rec.Cols, rname+"."+col)
+			rec.Vals = append(rec.Vals, r.Vals[i])
+		}
+		if q.Filter == nil || q.Filter(&rec) {
+			out = append(out, rec)
+		}
+	}
+
+	var err error
+	switch joinMethod(right, q.RightCols) {
+	case JOIN_HASH:
+		rows := map[string][]Record{}
+		dbScanAll(db, right, func(rec *Record) bool {
+			if vals, ok := joinValues(rec, q.RightCols); ok {
+				key := string(encodeValues(nil, vals))
+				rows[key] = append(rows[key], *rec)
+			}
+			return true
+		})
+		dbScanAll(db, left, func(rec *Record) bool {
+			if vals, ok := joinValues(rec, q.LeftCols); ok {
+				matched := rows[string(encodeValues(nil, vals))]
+				for i := range matched {
+					emit(rec, &matched[i])
+				}
+			}
+			return true
+		})
+	case JOIN_LOOKUP:
+		dbScanAll(db, left, func(rec *Record) bool {
+			vals, ok := joinValues(rec, q.LeftCols)
+			if !ok {
+				return true
+			}
+			// the key in the primary key order
+			key := Record{}
+			for _, col := range right.Cols[:right.PKeys] {
+				key.Cols = append(key.Cols, col)
+				key.Vals = append(key.Vals, vals[slices.Index(q.RightCols, col)])
+			}
+			var found bool
+			if found, err = dbGet(db, right, &key); found {
+				emit(rec, &key)
+			}
+			return err == nil
+		})
+	case JOIN_INDEX:
+		dbScanAll(db, left, func(rec *Record) bool {
+			vals, ok := joinValues(rec, q.LeftCols)
+			if !ok {
+				return true
+			}
+			key := Record{Cols: q.RightCols, Vals: vals}
+			sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+			if err = dbScan(db, right, &sc); err != nil {
+				return false
+			}
+			for ; sc.Valid(); sc.Next() {
+				r := Record{}
+				sc.Deref(&r)
+				emit(rec, &r)
+			}
+			return true
+		})
+	}
+	return out, err
+}
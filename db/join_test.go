@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoin(t *testing.T) {
+	os.Remove("test_join.db")
+	defer os.Remove("test_join.db")
+	db := &DB{Path: "test_join.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) {
+		_, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+	}
+	exec("create table users (id int64, name bytes, city bytes null, primary key (id))")
+	exec("create table orders (oid int64, uid int64 null, item bytes, primary key (oid), index (uid))")
+	exec("create table cities (name bytes, country bytes, primary key (name))")
+	exec("insert into users values (1, 'alice', 'paris'), (2, 'bob', null), (3, 'carol', 'rome'), (4, 'dave', 'oslo')")
+	exec("insert into orders values (10, 1, 'pen'), (11, 3, 'ink'), (12, 1, 'cap'), (13, null, 'box'), (14, 9, 'cup')")
+	exec("insert into cities values ('paris', 'fr'), ('rome', 'it'), ('nice', 'fr')")
+
+	pairs := func(q *JoinQuery, a string, b string) [][2]string {
+		out, err := db.Join(q)
+		assert.NoError(t, err)
+		res := [][2]string{}
+		for _, rec := range out {
+			res = append(res, [2]string{FormatValue(rec.Get(a)), FormatValue(rec.Get(b))})
+		}
+		return res
+	}
+
+	// the right primary key
+	q := &JoinQuery{Left: "orders", Right: "users", LeftCols: []string{"uid"}, RightCols: []string{"id"}}
+	assert.Equal(t, JOIN_LOOKUP, joinMethod(db.GetTableDef("users"), q.RightCols))
+	assert.Equal(t, [][2]string{{"10", "alice"}, {"11", "carol"}, {"12", "alice"}}, pairs(q, "orders.oid", "users.name"))
+	out, err := db.Join(q)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"orders.oid", "orders.uid", "orders.item", "users.id", "users.name", "users.city",
+	}, out[0].Cols)
+
+	// a secondary index of the right table
+	q = &JoinQuery{Left: "users", Right: "orders", LeftCols: []string{"id"}, RightCols: []string{"uid"}}
+	assert.Equal(t, JOIN_INDEX, joinMethod(db.GetTableDef("orders"), q.RightCols))
+	assert.Equal(t, [][2]string{{"alice", "pen"}, {"alice", "cap"}, {"carol", "ink"}}, pairs(q, "users.name", "orders.item"))
+
+	// no index, a NULL matches nothing
+	q = &JoinQuery{Left: "cities", Right: "users", LeftCols: []string{"name"}, RightCols: []string{"city"}}
+	assert.Equal(t, JOIN_HASH, joinMethod(db.GetTableDef("users"), q.RightCols))
+	assert.Equal(t, [][2]string{{"fr", "alice"}, {"it", "carol"}}, pairs(q, "cities.country", "users.name"))
+
+	// a filter and aliases, a self join
+	q = &JoinQuery{
+		Left: "users", Right: "users", LeftAs: "a", RightAs: "b",
+		LeftCols: []string{"city"}, RightCols: []string{"city"},
+		Filter: func(rec *Record) bool { return rec.Get("a.id").I64 < rec.Get("b.id").I64 },
+	}
+	assert.Equal(t, [][2]string{}, pairs(q, "a.name", "b.name"))
+	exec("insert into users values (5, 'eve', 'paris')")
+	assert.Equal(t, [][2]string{{"alice", "eve"}}, pairs(q, "a.name", "b.name"))
+
+	// a prefix of the right primary key
+	exec("create table items (oid int64, line int64, qty int64, primary key (oid, line))")
+	exec("insert into items values (10, 1, 5), (10, 2, 6), (11, 1, 7), (15, 1, 8)")
+	q = &JoinQuery{Left: "orders", Right: "items", LeftCols: []string{"oid"}, RightCols: []string{"oid"}}
+	assert.Equal(t, JOIN_INDEX, joinMethod(db.GetTableDef("items"), q.RightCols))
+	assert.Equal(t, [][2]string{{"pen", "5"}, {"pen", "6"}, {"ink", "7"}}, pairs(q, "orders.item", "items.qty"))
+
+	for _, bad := range []*JoinQuery{
+		{Left: "users", Right: "users", LeftCols: []string{"id"}, RightCols: []string{"id"}},
+		{Left: "users", Right: "orders", LeftCols: []string{"name"}, RightCols: []string{"uid"}},
+		{Left: "users", Right: "orders", LeftCols: []string{"id"}, RightCols: []string{"nope"}},
+		{Left: "users", Right: "orders", LeftCols: []string{"id"}},
+		{Left: "orders", Right: "items", LeftCols: []string{"oid", "uid"}, RightCols: []string{"oid", "oid"}},
+		{Left: "orders", Right: "items", LeftCols: []string{"oid", "oid"}, RightCols: []string{"oid", "line"}},
+	} {
+		_, err := db.Join(bad)
+		assert.Error(t, err)
+	}
+	_, err = db.Join(&JoinQuery{Left: "users", Right: "nope", LeftCols: []string{"id"}, RightCols: []string{"id"}})
+	assert.True(t, errors.Is(err, ErrTableNotFound))
+}
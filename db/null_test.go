@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNull(t *testing.T) {
+	os.Remove("test_null.db")
+	defer os.Remove("test_null.db")
+	db := &DB{Path: "test_null.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	// the primary key is never nullable
+	bad := &TableDef{
+		Name: "bad", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"k", "v"},
+		PKeys: 1, Nullable: []bool{true, false},
+	}
+	assert.Error(t, db.TableNew(bad))
+
+	tdef := &TableDef{
+		Name:     "people",
+		Types:    []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:     []string{"id", "name", "age", "email"},
+		PKeys:    1,
+		Nullable: []bool{false, false, true, true},
+		Indexes:  [][]string{{"age"}, {"email"}},
+		Unique:   []bool{false, true},
+	}
+	assert.NoError(t, db.TableNew(tdef))
+
+	// NULL is distinct from the empty string and zero
+	rows := []*Record{
+		(&Record{}).AddInt64("id", 1).AddStr("name", []byte("alice")).AddInt64("age", 30).AddStr("email", []byte("a@x")),
+		(&Record{}).AddInt64("id", 2).AddStr("name", []byte("bob")).AddNull("age").AddStr("email", []byte("")),
+		(&Record{}).AddInt64("id", 3).AddStr("name", []byte("carol")).AddInt64("age", 0), // missing email
+		(&Record{}).AddInt64("id", 4).AddStr("name", []byte("dave")).AddNull("age").AddNull("email"),
+	}
+	for _, rec := range rows {
+		_, err := db.Insert("people", *rec)
+		assert.NoError(t, err)
+	}
+	get := func(id int64) *Record {
+		rec := (&Record{}).AddInt64("id", id)
+		ok, err := db.Get("people", rec)
+		assert.True(t, ok && err == nil)
+		return rec
+	}
+	assert.Equal(t, uint32(TYPE_NULL), get(2).Get("age").Type)
+	assert.Equal(t, uint32(TYPE_BYTES), get(2).Get("email").Type)
+	assert.Empty(t, get(2).Get("email").Str)
+	assert.Equal(t, Value{Type: TYPE_INT64, I64: 0}, *get(3).Get("age"))
+	assert.Equal(t, uint32(TYPE_NULL), get(3).Get("email").Type)
+	assert.Equal(t, "NULL", FormatValue(get(4).Get("email")))
+
+	// NULL in a NOT NULL column
+	rec := (&Record{}).AddInt64("id", 5).AddNull("name").AddInt64("age", 1).AddNull("email")
+	_, err := db.Insert("people", *rec)
+	cerr := &ConstraintError{}
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, "not null", cerr.Kind)
+
+	// a unique index allows many NULLs but not duplicate values
+	rec = (&Record{}).AddInt64("id", 5).AddStr("name", []byte("eve")).AddNull("age").AddNull("email")
+	_, err = db.Insert("people", *rec)
+	assert.NoError(t, err)
+	rec = (&Record{}).AddInt64("id", 6).AddStr("name", []byte("frank")).AddNull("age").AddStr("email", []byte(""))
+	_, err = db.Insert("people", *rec)
+	assert.True(t, errors.As(err, &cerr))
+
+	// NULLs sort first in an index
+	scan := func(key1 Record, cmp1 int, key2 Record, cmp2 int) []int64 {
+		sc := Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: key1, Key2: key2}
+		assert.NoError(t, db.Scan("people", &sc))
+		ids := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Record{}
+			sc.Deref(&rec)
+			ids = append(ids, rec.Get("id").I64)
+		}
+		return ids
+	}
+	null := *(&Record{}).AddNull("age")
+	max := *(&Record{}).AddInt64("age", 100)
+	assert.Equal(t, []int64{2, 4, 5, 3, 1}, scan(null, CMP_GE, max, CMP_LE))
+	assert.Equal(t, []int64{3, 1}, scan(null, CMP_GT, max, CMP_LE))
+	assert.Equal(t, []int64{2, 4, 5}, scan(null, CMP_GE, null, CMP_LE))
+	// the NULLs of a unique index
+	assert.Equal(t, []int64{3, 4, 5}, scan(*(&Record{}).AddNull("email"), CMP_GE, *(&Record{}).AddNull("email"), CMP_LE))
+
+	// updates move the index entries
+	rec = (&Record{}).AddInt64("id", 4).AddStr("name", []byte("dave")).AddInt64("age", 50).AddStr("email", []byte("d@x"))
+	_, err = db.Update("people", *rec)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 5}, scan(null, CMP_GE, null, CMP_LE))
+	_, err = db.Delete("people", *(&Record{}).AddInt64("id", 5))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, countPrefix(db, tdef.IndexPrefixes[0]))
+	assert.Equal(t, 4, countPrefix(db, tdef.IndexPrefixes[1]))
+}
+
+func TestNullSQL(t *testing.T) {
+	os.Remove("test_null_ql.db")
+	defer os.Remove("test_null_ql.db")
+	db := &DB{Path: "test_null_ql.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) QLResult {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res
+	}
+	exec("create table t (id int64, a int64 null, b bytes not null, c float64 NULL)")
+	tdef := db.GetTableDef("t")
+	assert.Equal(t, []bool{false, true, false, true}, tdef.Nullable)
+	_, err := db.ExecSQL("create table bad (id int64 null)")
+	assert.Error(t, err)
+
+	exec("insert into t values (1, 10, 'x', 1.5), (2, null, 'y', null)")
+	exec("insert into t (id, b) values (3, 'z')")
+	_, err = db.ExecSQL("insert into t values (4, 1, null, 1)")
+	assert.Error(t, err)
+
+	ids := func(sql string) []int64 {
+		out := []int64{}
+		for _, rec := range exec(sql).Records {
+			out = append(out, rec.Get("id").I64)
+		}
+		return out
+	}
+	assert.Equal(t, []int64{2, 3}, ids("select id from t where a is null"))
+	assert.Equal(t, []int64{1}, ids("select id from t where a is not null"))
+	// comparisons with NULL are unknown, and unknown is not true
+	assert.Equal(t, []int64{1}, ids("select id from t where a > 0"))
+	assert.Equal(t, []int64{}, ids("select id from t where not (a > 0)"))
+	assert.Equal(t, []int64{}, ids("select id from t where a = null"))
+	assert.Equal(t, []int64{1, 2, 3}, ids("select id from t where a > 0 or b > 'x'"))
+	assert.Equal(t, []int64{}, ids("select id from t where a > 0 and b > 'x'"))
+
+	res := exec("select a + 1 as a1 from t where id = 2")
+	assert.Equal(t, uint32(TYPE_NULL), res.Records[0].Get("a1").Type)
+	exec("update t set a = null, c = 2 where id = 1")
+	assert.Equal(t, []int64{1, 2, 3}, ids("select id from t where a is null"))
+	res = exec("select c from t where id = 1")
+	assert.Equal(t, 2.0, res.Records[0].Get("c").F64)
+}
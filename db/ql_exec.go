@@ -0,0 +1,836 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+	. "types"
+)
+
+// the result of a SQL statement
+type QLResult struct {
+	Records []Record // rows of SELECT
+	Updated int      // rows affected by INSERT, UPDATE, DELETE
+	LastID  int64    // the last AUTO_INCREMENT key of INSERT
+}
+
+// parse and execute a SQL statement
+func (db *DB) ExecSQL(input string) (QLResult, error) {
+	stmt, err := ParseSQL(input)
+	if err != nil {
+		return QLResult{}, err
+	}
+	switch stmt := stmt.(type) {
+	case *QLCreateTable:
+		return QLResult{}, db.TableNew(&stmt.Def)
+	case *QLDropTable:
+		return QLResult{}, db.DropTable(stmt.Table)
+	case *QLTruncate:
+		return QLResult{}, db.TruncateTable(stmt.Table)
+	case *QLAlterTable:
+		return QLResult{}, qlAlterTable(db, stmt)
+	case *QLCreateIndex:
+		builder, err := db.IndexNew(stmt.Table, stmt.Cols, stmt.Unique)
+		if err != nil {
+			return QLResult{}, err
+		}
+		return QLResult{}, builder.Run(INDEX_BATCH_SIZE)
+	case *QLInsert:
+		n, id, err := qlInsert(db, stmt)
+		return QLResult{Updated: n, LastID: id}, err
+	case *QLSelect:
+		recs, err := qlSelect(db, stmt)
+		return QLResult{Records: recs}, err
+	case *QLUpdate:
+		n, err := qlUpdate(db, stmt)
+		return QLResult{Updated: n}, err
+	case *QLDelete:
+		n, err := qlDelete(db, stmt)
+		return QLResult{Updated: n}, err
+	case *QLAnalyze:
+		_, err := db.Analyze(stmt.Table)
+		return QLResult{}, err
+	case *QLExplain:
+		recs, err := qlExplain(db, stmt.Scan)
+		return QLResult{Records: recs}, err
+	}
+	panic("unreachable")
+}
+
+func qlBool(b bool) Value {
+	return Value{Type: TYPE_BOOL, I64: boolToInt64(b)}
+}
+
+// the truth of a condition, integers are true if not zero, NULL is false
+func qlTruth(val *Value) (bool, error) {
+	switch val.Type {
+	case TYPE_BOOL, TYPE_INT64:
+		return val.I64 != 0, nil
+	case TYPE_NULL:
+		return false, nil
+	}
+	return false, errors.New("expect a boolean")
+}
+
+// the implicit conversions
+func qlConvert(val Value, typ uint32) (Value, error) {
+	switch {
+	case val.Type == typ || val.Type == TYPE_NULL:
+		return val, nil
+	case val.Type == TYPE_INT64 && typ == TYPE_FLOAT64:
+		return Value{Type: typ, F64: float64(val.I64)}, nil
+	case (val.Type == TYPE_INT64 || val.Type == TYPE_FLOAT64) && typ == TYPE_DECIMAL:
+		return ParseValue(typ, FormatValue(&val))
+	case val.Type == TYPE_BYTES && (typ == TYPE_TIMESTAMP || typ == TYPE_DECIMAL):
+		return ParseValue(typ, string(val.Str))
+	}
+	return Value{}, fmt.Errorf("cannot convert %s to %s", TypeName(val.Type), TypeName(typ))
+}
+
+// convert one side of a binary op to the type of the other
+func qlUnify(a *Value, b *Value) error {
+	if conv, err := qlConvert(*a, b.Type); err == nil {
+		*a = conv
+		return nil
+	}
+	conv, err := qlConvert(*b, a.Type)
+	if err != nil {
+		return fmt.Errorf("mismatched types: %s and %s", TypeName(a.Type), TypeName(b.Type))
+	}
+	*b = conv
+	return nil
+}
+
+// compare 2 values of the same type
+func qlCompare(a *Value, b *Value) (int, error) {
+	if a.Type != b.Type {
+		return 0, errors.New("comparison of different types")
+	}
+	switch a.Type {
+	case TYPE_INT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_DECIMAL:
+		switch {
+		case a.I64 < b.I64:
+			return -1, nil
+		case a.I64 > b.I64:
+			return +1, nil
+		}
+		return 0, nil
+	case TYPE_FLOAT64:
+		switch {
+		case a.F64 < b.F64:
+			return -1, nil
+		case a.F64 > b.F64:
+			return +1, nil
+		}
+		return 0, nil
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str), nil
+	}
+	return 0, errors.New("bad value type")
+}
+
+// evaluate an expression on a row, rec is nil for constant expressions.
+func qlEval(rec *Record, node *QLNode) (Value, error) {
+	switch node.Type {
+	case QL_I64, QL_F64, QL_STR, QL_BOOL, QL_NULL:
+		return node.Value, nil
+	case QL_SYM:
+		if rec != nil {
+			if val := rec.Get(string(node.Str)); val.Type != TYPE_ERROR {
+				return *val, nil
+			}
+		}
+		return Value{}, fmt.Errorf("unknown column: %s", node.Str)
+	case QL_AGG:
+		// the result of the group, see qlSelectAgg
+		if rec != nil {
+			if val := rec.Get(qlAggCol(node.I64)); val.Type != TYPE_ERROR {
+				return *val, nil
+			}
+		}
+		return Value{}, errors.New("aggregates are only allowed in the output of SELECT")
+	case QL_NOT, QL_NEG, QL_IS_NULL:
+		kid, err := qlEval(rec, &node.Kids[0])
+		if err != nil {
+			return kid, err
+		}
+		if node.Type == QL_IS_NULL {
+			return qlBool(kid.Type == TYPE_NULL), nil
+		}
+		if kid.Type == TYPE_NULL {
+			return kid, nil
+		}
+		if node.Type == QL_NOT {
+			b, err := qlTruth(&kid)
+			return qlBool(!b), err
+		}
+		switch kid.Type {
+		case TYPE_INT64, TYPE_DECIMAL:
+			kid.I64 = -kid.I64
+		case TYPE_FLOAT64:
+			kid.F64 = -kid.F64
+		default:
+			return Value{}, errors.New("expect a number")
+		}
+		return kid, nil
+	case QL_IN:
+		return qlIn(rec, node)
+	case QL_FUNC:
+		return qlFunc(rec, node)
+	}
+	// binary ops
+	left, err := qlEval(rec, &node.Kids[0])
+	if err != nil {
+		return left, err
+	}
+	right, err := qlEval(rec, &node.Kids[1])
+	if err != nil {
+		return right, err
+	}
+	switch node.Type {
+	case QL_AND, QL_OR:
+		return qlLogic(node.Type, left, right)
+	}
+	if left.Type == TYPE_NULL || right.Type == TYPE_NULL {
+		return Value{Type: TYPE_NULL}, nil // unknown
+	}
+	if node.Type == QL_LIKE {
+		if left.Type != TYPE_BYTES || right.Type != TYPE_BYTES {
+			return Value{}, errors.New("LIKE expects strings")
+		}
+		return qlBool(qlLike(left.Str, right.Str)), nil
+	}
+	if err := qlUnify(&left, &right); err != nil {
+		return Value{}, err
+	}
+	switch node.Type {
+	case QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE, QL_CMP_EQ, QL_CMP_NE:
+		r, err := qlCompare(&left, &right)
+		if err != nil {
+			return Value{}, err
+		}
+		switch node.Type {
+		case QL_CMP_GE:
+			return qlBool(r >= 0), nil
+		case QL_CMP_GT:
+			return qlBool(r > 0), nil
+		case QL_CMP_LT:
+			return qlBool(r < 0), nil
+		case QL_CMP_LE:
+			return qlBool(r <= 0), nil
+		case QL_CMP_EQ:
+			return qlBool(r == 0), nil
+		default:
+			return qlBool(r != 0), nil
+		}
+	}
+	return qlArith(node.Type, left, right)
+}
+
+// a IN (b, c, ...), NULL if not found and the list has a NULL
+func qlIn(rec *Record, node *QLNode) (Value, error) {
+	left, err := qlEval(rec, &node.Kids[0])
+	if err != nil || left.Type == TYPE_NULL {
+		return left, err
+	}
+	null := false
+	for i := 1; i < len(node.Kids); i++ {
+		right, err := qlEval(rec, &node.Kids[i])
+		if err != nil {
+			return Value{}, err
+		}
+		if right.Type == TYPE_NULL {
+			null = true
+			continue
+		}
+		a := left
+		if err := qlUnify(&a, &right); err != nil {
+			return Value{}, err
+		}
+		r, err := qlCompare(&a, &right)
+		if err != nil {
+			return Value{}, err
+		}
+		if r == 0 {
+			return qlBool(true), nil
+		}
+	}
+	if null {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	return qlBool(false), nil
+}
+
+// match a LIKE pattern, % is any string and _ is any byte
+func qlLike(str []byte, pat []byte) bool {
+	si, pi := 0, 0
+	star, mark := -1, 0 // the last %, and where it starts to match
+	for si < len(str) {
+		switch {
+		case pi < len(pat) && pat[pi] == '%':
+			star, mark = pi, si
+			pi++
+		case pi < len(pat) && (pat[pi] == '_' || pat[pi] == str[si]):
+			si++
+			pi++
+		case star >= 0:
+			// let the last % match one more byte
+			mark++
+			si, pi = mark, star+1
+		default:
+			return false
+		}
+	}
+	for pi < len(pat) && pat[pi] == '%' {
+		pi++
+	}
+	return pi == len(pat)
+}
+
+// AND, OR with NULL as unknown: FALSE AND NULL is FALSE,
+// TRUE OR NULL is TRUE, and NULL otherwise.
+func qlLogic(op uint32, left Value, right Value) (Value, error) {
+	a, err := qlTruth(&left)
+	if err != nil {
+		return Value{}, err
+	}
+	b, err := qlTruth(&right)
+	if err != nil {
+		return Value{}, err
+	}
+	if op == QL_AND {
+		if (left.Type != TYPE_NULL && !a) || (right.Type != TYPE_NULL && !b) {
+			return qlBool(false), nil
+		}
+	} else if a || b {
+		return qlBool(true), nil
+	}
+	if left.Type == TYPE_NULL || right.Type == TYPE_NULL {
+		return Value{Type: TYPE_NULL}, nil
+	}
+	return qlBool(op == QL_AND), nil
+}
+
+// arithmetic on 2 values of the same type
+func qlArith(op uint32, left Value, right Value) (Value, error) {
+	switch left.Type {
+	case TYPE_INT64:
+		a, b := left.I64, right.I64
+		switch op {
+		case QL_ADD:
+			return Value{Type: TYPE_INT64, I64: a + b}, nil
+		case QL_SUB:
+			return Value{Type: TYPE_INT64, I64: a - b}, nil
+		case QL_MUL:
+			return Value{Type: TYPE_INT64, I64: a * b}, nil
+		case QL_DIV, QL_MOD:
+			if b == 0 {
+				return Value{}, errors.New("division by zero")
+			}
+			if op == QL_DIV {
+				return Value{Type: TYPE_INT64, I64: a / b}, nil
+			}
+			return Value{Type: TYPE_INT64, I64: a % b}, nil
+		}
+	case TYPE_FLOAT64:
+		a, b := left.F64, right.F64
+		switch op {
+		case QL_ADD:
+			return Value{Type: TYPE_FLOAT64, F64: a + b}, nil
+		case QL_SUB:
+			return Value{Type: TYPE_FLOAT64, F64: a - b}, nil
+		case QL_MUL:
+			return Value{Type: TYPE_FLOAT64, F64: a * b}, nil
+		case QL_DIV:
+			return Value{Type: TYPE_FLOAT64, F64: a / b}, nil
+		case QL_MOD:
+			return Value{Type: TYPE_FLOAT64, F64: math.Mod(a, b)}, nil
+		}
+	case TYPE_DECIMAL:
+		switch op {
+		case QL_ADD:
+			return Value{Type: TYPE_DECIMAL, I64: left.I64 + right.I64}, nil
+		case QL_SUB:
+			return Value{Type: TYPE_DECIMAL, I64: left.I64 - right.I64}, nil
+		}
+		return Value{}, errors.New("decimals only support + and -")
+	}
+	if op < QL_ADD || op > QL_MOD {
+		return Value{}, fmt.Errorf("bad expression type: %d", op)
+	}
+	return Value{}, fmt.Errorf("expect numbers, got %s", TypeName(left.Type))
+}
+
+// collect the column names of an expression
+func qlColumns(node *QLNode, out []string) []string {
+	if node.Type == QL_SYM && !slices.Contains(out, string(node.Str)) {
+		out = append(out, string(node.Str))
+	}
+	for i := range node.Kids {
+		out = qlColumns(&node.Kids[i], out)
+	}
+	return out
+}
+
+// does the row pass the WHERE clause?
+func qlFilter(rec *Record, filter *QLNode) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	val, err := qlEval(rec, filter)
+	if err != nil {
+		return false, err
+	}
+	return qlTruth(&val)
+}
+
+// the conditions on a key column
+type qlKeyCond struct {
+	eq       *Value
+	lo, hi   *Value
+	cmp1     int // CMP_GE or CMP_GT for lo
+	cmp2     int // CMP_LE or CMP_LT for hi
+	hasRange bool
+}
+
+// split a condition by AND
+func qlConjuncts(node *QLNode, out []*QLNode) []*QLNode {
+	if node.Type == QL_AND {
+		out = qlConjuncts(&node.Kids[0], out)
+		return qlConjuncts(&node.Kids[1], out)
+	}
+	return append(out, node)
+}
+
+// collect `col op const` conditions on the key columns from the filter.
+func qlKeyConds(tdef *TableDef, cols []string, filter *QLNode) []qlKeyCond {
+	conds := make([]qlKeyCond, len(cols))
+	if filter == nil {
+		return conds
+	}
+	flip := map[uint32]uint32{
+		QL_CMP_GE: QL_CMP_LE, QL_CMP_GT: QL_CMP_LT, QL_CMP_LT: QL_CMP_GT,
+		QL_CMP_LE: QL_CMP_GE, QL_CMP_EQ: QL_CMP_EQ,
+	}
+	for _, node := range qlConjuncts(filter, nil) {
+		op, ok := flip[node.Type]
+		if !ok {
+			continue
+		}
+		sym, val := &node.Kids[0], &node.Kids[1]
+		if sym.Type != QL_SYM {
+			sym, val = val, sym
+			op = flip[op]
+		} else {
+			op = node.Type
+		}
+		if sym.Type != QL_SYM || len(val.Kids) > 0 || val.Type == QL_SYM {
+			continue // not a constant
+		}
+		for i, col := range cols {
+			if col != string(sym.Str) {
+				continue
+			}
+			v, err := qlConvert(val.Value, tdef.Types[colIndex(tdef, col)])
+			if err != nil || v.Type == TYPE_NULL {
+				continue // never true
+			}
+			c := &conds[i]
+			switch op {
+			case QL_CMP_EQ:
+				c.eq = &v
+			case QL_CMP_GE, QL_CMP_GT:
+				c.lo, c.cmp1 = &v, map[uint32]int{QL_CMP_GE: CMP_GE, QL_CMP_GT: CMP_GT}[op]
+			case QL_CMP_LE, QL_CMP_LT:
+				c.hi, c.cmp2 = &v, map[uint32]int{QL_CMP_LE: CMP_LE, QL_CMP_LT: CMP_LT}[op]
+			}
+		}
+	}
+	return conds
+}
+
+// iterate over the rows matching the WHERE clause.
+// the access path is picked by qlPlanScan, the whole filter is then
+// applied to each row.
+func qlScan(db *DB, scan *QLScan, fn func(rec *Record) error) error {
+	tdef := getTableDef(db, scan.Table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, scan.Table)
+	}
+	return qlScanPlan(db, tdef, qlPlanScan(db, tdef, scan.Filter), scan.Filter, fn)
+}
+
+// iterate over the rows of a chosen plan
+func qlScanPlan(db *DB, tdef *TableDef, plan *qlPlan, filter *QLNode, fn func(rec *Record) error) error {
+	if plan.access == PLAN_LOOKUP {
+		rec := plan.key1
+		ok, err := dbGet(db, tdef, &rec)
+		if err != nil || !ok {
+			return err
+		}
+		if ok, err = qlFilter(&rec, filter); err != nil || !ok {
+			return err
+		}
+		return fn(&rec)
+	}
+	sc, err := qlPlanScanner(db, tdef, plan, filter)
+	if err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// the range of the plan on the index of the plan, as EXPLAIN shows it
+func qlPlanScanner(db *DB, tdef *TableDef, plan *qlPlan, filter *QLNode) (*Scanner, error) {
+	sc := &Scanner{Cmp1: plan.cmp1, Cmp2: plan.cmp2, Key1: plan.key1, Key2: plan.key2, Filter: filter}
+	if err := dbScanIndex(db, tdef, sc, plan.index); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func qlAlterTable(db *DB, stmt *QLAlterTable) error {
+	switch stmt.Op {
+	case QL_ALTER_ADD:
+		col := &stmt.Column
+		return db.AddColumn(stmt.Table, col.Name, col.Type, col.Nullable, col.Default)
+	case QL_ALTER_DROP:
+		return db.DropColumn(stmt.Table, stmt.Name)
+	default:
+		return db.RenameColumn(stmt.Table, stmt.Name, stmt.NewName)
+	}
+}
+
+// stops a scan at the LIMIT
+var errQLLimit = errors.New("limit reached")
+
+// the hidden column of an ORDER BY value in the sorted rows
+func qlOrderCol(i int) string {
+	return fmt.Sprintf("#order%d", i)
+}
+
+func qlSelect(db *DB, stmt *QLSelect) ([]Record, error) {
+	tdef := getTableDef(db, stmt.Table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, stmt.Table)
+	}
+	out := []Record{}
+	if stmt.Limit == 0 {
+		return out, nil
+	}
+	var sorter *Sorter
+	if len(stmt.OrderBy) > 0 {
+		sorter = &Sorter{Offset: int(stmt.Offset), Limit: int(max(stmt.Limit, 0))}
+		for i, order := range stmt.OrderBy {
+			sorter.Keys = append(sorter.Keys, SortKey{Col: qlOrderCol(i), Desc: order.Desc})
+		}
+		defer sorter.Close()
+	}
+	// take an output row, ctx is the row it is computed from
+	skip := stmt.Offset
+	emit := func(row Record, ctx *Record) error {
+		if sorter != nil {
+			// ORDER BY sees the output names, then the columns
+			both := Record{
+				Cols: append(slices.Clone(row.Cols), ctx.Cols...),
+				Vals: append(slices.Clone(row.Vals), ctx.Vals...),
+			}
+			for i := range stmt.OrderBy {
+				val, err := qlEval(&both, &stmt.OrderBy[i].Expr)
+				if err != nil {
+					return err
+				}
+				row.Cols = append(row.Cols, qlOrderCol(i))
+				row.Vals = append(row.Vals, val)
+			}
+			return sorter.Add(row)
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		out = append(out, row)
+		if stmt.Limit > 0 && int64(len(out)) >= stmt.Limit {
+			return errQLLimit
+		}
+		return nil
+	}
+
+	var err error
+	hasAgg := func(order QLOrder) bool { return qlHasAgg(order.Expr) }
+	if len(stmt.GroupBy) > 0 || slices.ContainsFunc(stmt.Output, qlHasAgg) ||
+		slices.ContainsFunc(stmt.OrderBy, hasAgg) {
+		err = qlSelectAgg(db, tdef, stmt, emit)
+	} else {
+		err = qlScan(db, &stmt.QLScan, func(rec *Record) error {
+			row := Record{}
+			for i := range stmt.Output {
+				if stmt.Output[i].Type == QL_STAR {
+					row.Cols = append(row.Cols, rec.Cols...)
+					row.Vals = append(row.Vals, rec.Vals...)
+					continue
+				}
+				val, err := qlEval(rec, &stmt.Output[i])
+				if err != nil {
+					return err
+				}
+				row.Cols = append(row.Cols, stmt.Names[i])
+				row.Vals = append(row.Vals, val)
+			}
+			return emit(row, rec)
+		})
+	}
+	if err == errQLLimit {
+		err = nil
+	}
+	if err == nil && sorter != nil {
+		err = sorter.Sort(func(rec *Record) bool {
+			n := len(rec.Cols) - len(stmt.OrderBy)
+			out = append(out, Record{Cols: rec.Cols[:n], Vals: rec.Vals[:n]})
+			return true
+		})
+	}
+	return out, err
+}
+
+func qlHasAgg(node QLNode) bool {
+	return node.Type == QL_AGG || slices.ContainsFunc(node.Kids, qlHasAgg)
+}
+func qlHasFunc(node QLNode) bool {
+	return node.Type == QL_FUNC || slices.ContainsFunc(node.Kids, qlHasFunc)
+}
+
+// the scalar functions, nextval() is handled by evalDefault
+func qlFunc(rec *Record, node *QLNode) (Value, error) {
+	switch string(node.Str) {
+	case "now":
+		return Value{Type: TYPE_TIMESTAMP, I64: time.Now().UnixMicro()}, nil
+	case "length":
+		arg, err := qlEval(rec, &node.Kids[0])
+		switch {
+		case err != nil || arg.Type == TYPE_NULL:
+			return arg, err
+		case arg.Type != TYPE_BYTES:
+			return Value{}, errors.New("length() expects bytes")
+		}
+		return Value{Type: TYPE_INT64, I64: int64(len(arg.Str))}, nil
+	}
+	return Value{}, fmt.Errorf("%s() is only allowed as a column default", node.Str)
+}
+
+// the column of an aggregate result in the group record
+func qlAggCol(i int64) string {
+	return fmt.Sprintf("#%d", i)
+}
+
+// number the aggregates of an output expression. the columns outside
+// the aggregates must be grouping columns.
+func qlCollectAggs(node *QLNode, groupBy []string, out []*QLNode) ([]*QLNode, error) {
+	switch node.Type {
+	case QL_STAR:
+		return nil, errors.New("cannot select * with aggregates")
+	case QL_SYM:
+		if !slices.Contains(groupBy, string(node.Str)) {
+			return nil, fmt.Errorf("column not in GROUP BY: %s", node.Str)
+		}
+	case QL_AGG:
+		if qlHasAgg(node.Kids[0]) {
+			return nil, errors.New("nested aggregates")
+		}
+		node.I64 = int64(len(out))
+		return append(out, node), nil
+	}
+	var err error
+	for i := range node.Kids {
+		if out, err = qlCollectAggs(&node.Kids[i], groupBy, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// SELECT with aggregates, one row per group. the rows of a primary key
+// plan come in the key order, so grouping by a key prefix is streamed.
+func qlSelectAgg(db *DB, tdef *TableDef, stmt *QLSelect, emit func(row Record, ctx *Record) error) error {
+	for _, col := range stmt.GroupBy {
+		if colIndex(tdef, col) < 0 {
+			return fmt.Errorf("unknown column: %s", col)
+		}
+	}
+	aggs := []*QLNode{}
+	for i := range stmt.Output {
+		var err error
+		if aggs, err = qlCollectAggs(&stmt.Output[i], stmt.GroupBy, aggs); err != nil {
+			return err
+		}
+	}
+	// ORDER BY may also use the output names
+	names := append(slices.Clone(stmt.GroupBy), stmt.Names...)
+	for i := range stmt.OrderBy {
+		var err error
+		if aggs, err = qlCollectAggs(&stmt.OrderBy[i].Expr, names, aggs); err != nil {
+			return err
+		}
+	}
+	funcs := make([]int, len(aggs))
+	for i, node := range aggs {
+		funcs[i] = aggNames[string(node.Str)]
+	}
+	plan := qlPlanScan(db, tdef, stmt.Filter)
+	agg := newAggregator(funcs, len(stmt.GroupBy), plan.index < 0 && isPKeyPrefix(tdef, stmt.GroupBy))
+	agg.emit = func(group []Value, results []Value) error {
+		rec := Record{Cols: slices.Clone(stmt.GroupBy), Vals: group}
+		for i, val := range results {
+			rec.Cols = append(rec.Cols, qlAggCol(int64(i)))
+			rec.Vals = append(rec.Vals, val)
+		}
+		row := Record{}
+		for i := range stmt.Output {
+			val, err := qlEval(&rec, &stmt.Output[i])
+			if err != nil {
+				return err
+			}
+			row.Cols = append(row.Cols, stmt.Names[i])
+			row.Vals = append(row.Vals, val)
+		}
+		return emit(row, &rec)
+	}
+	err := qlScanPlan(db, tdef, plan, stmt.Filter, func(rec *Record) error {
+		vals := make([]Value, len(stmt.GroupBy))
+		for i, col := range stmt.GroupBy {
+			vals[i] = *rec.Get(col)
+		}
+		inputs := make([]Value, len(aggs))
+		for i, node := range aggs {
+			if node.Kids[0].Type == QL_STAR {
+				inputs[i] = Value{Type: TYPE_INT64} // counts the row
+				continue
+			}
+			val, err := qlEval(rec, &node.Kids[0])
+			if err != nil {
+				return err
+			}
+			inputs[i] = val
+		}
+		return agg.add(vals, inputs)
+	})
+	if err == nil {
+		err = agg.finish()
+	}
+	return err
+}
+
+// returns the number of rows and the last AUTO_INCREMENT key
+func qlInsert(db *DB, stmt *QLInsert) (int, int64, error) {
+	tdef := getTableDef(db, stmt.Table)
+	if tdef == nil {
+		return 0, 0, fmt.Errorf("%w: %s", ErrTableNotFound, stmt.Table)
+	}
+	names := stmt.Names
+	if len(names) == 0 {
+		names = tdef.Cols
+	}
+	count, last := 0, int64(0)
+	for _, row := range stmt.Values {
+		if len(row) != len(names) {
+			return count, last, errors.New("the number of values does not match the columns")
+		}
+		rec := Record{}
+		for i := range row {
+			val, err := qlEval(nil, &row[i])
+			if idx := colIndex(tdef, names[i]); err == nil && idx >= 0 {
+				val, err = qlConvert(val, tdef.Types[idx])
+			}
+			if err != nil {
+				return count, last, err
+			}
+			rec.Cols = append(rec.Cols, names[i])
+			rec.Vals = append(rec.Vals, val)
+		}
+		id, err := autoIncrement(db, tdef, &rec)
+		if err == nil {
+			_, err = dbUpdate(db, tdef, rec, MODE_INSERT_ONLY)
+		}
+		if err != nil {
+			return count, last, err
+		}
+		count, last = count+1, id
+	}
+	return count, last, nil
+}
+
+func qlUpdate(db *DB, stmt *QLUpdate) (int, error) {
+	tdef := getTableDef(db, stmt.Table)
+	if tdef == nil {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotFound, stmt.Table)
+	}
+	for _, name := range stmt.Names {
+		switch idx := colIndex(tdef, name); {
+		case idx < 0:
+			return 0, fmt.Errorf("unknown column: %s", name)
+		case idx < tdef.PKeys:
+			return 0, fmt.Errorf("cannot update the primary key: %s", name)
+		}
+	}
+	// compute the new rows first, the tree is not modified while scanning.
+	rows := []Record{}
+	err := qlScan(db, &stmt.QLScan, func(rec *Record) error {
+		vals := make([]Value, len(stmt.Values))
+		for i := range stmt.Values {
+			val, err := qlEval(rec, &stmt.Values[i])
+			if idx := colIndex(tdef, stmt.Names[i]); err == nil && idx >= 0 {
+				val, err = qlConvert(val, tdef.Types[idx])
+			}
+			if err != nil {
+				return err
+			}
+			vals[i] = val
+		}
+		for i, name := range stmt.Names {
+			*rec.Get(name) = vals[i]
+		}
+		rows = append(rows, *rec)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range rows {
+		if _, err := dbUpdate(db, tdef, rows[i], MODE_UPDATE_ONLY); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+func qlDelete(db *DB, stmt *QLDelete) (int, error) {
+	tdef := getTableDef(db, stmt.Table)
+	if tdef == nil {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotFound, stmt.Table)
+	}
+	keys := []Record{}
+	err := qlScan(db, &stmt.QLScan, func(rec *Record) error {
+		key := Record{Cols: rec.Cols[:tdef.PKeys], Vals: rec.Vals[:tdef.PKeys]}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range keys {
+		if _, err := dbDelete(db, tdef, keys[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,1188 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The SQL syntax:
+//
+//	CREATE TABLE t (a int64, b bytes [NULL] [DEFAULT 'x'], ..., PRIMARY KEY (a, ...), [UNIQUE] INDEX (b, ...))
+//	CREATE TABLE t (id int64 AUTO_INCREMENT, ...)
+//	CREATE TABLE t (..., FOREIGN KEY (a, ...) REFERENCES p [ON DELETE RESTRICT|CASCADE|SET NULL])
+//	CREATE TABLE t (a int64 [DEFAULT expr] [CHECK (cond)], ..., CHECK (cond))
+//	CREATE [UNIQUE] INDEX ON t (b, ...)
+//	DROP TABLE t
+//	TRUNCATE [TABLE] t
+//	ALTER TABLE t ADD [COLUMN] c int64 [NULL] [DEFAULT 0]
+//	ALTER TABLE t DROP [COLUMN] c
+//	ALTER TABLE t RENAME [COLUMN] c TO d
+//	INSERT INTO t [(a, b, ...)] VALUES (1, 'x', ...), ...
+//	SELECT expr [AS name], ... FROM t [WHERE cond] [GROUP BY a, ...]
+//	       [ORDER BY expr [ASC|DESC], ...] [LIMIT n [OFFSET m]]
+//	UPDATE t SET a = expr, ... [WHERE cond]
+//	DELETE FROM t [WHERE cond]
+//	ANALYZE [TABLE] t
+//	EXPLAIN SELECT ... | UPDATE ... | DELETE ...
+//
+// Expressions have int64, float64, string, TRUE/FALSE and NULL literals,
+// column names, the arithmetic operators + - * / %, the comparisons
+// = != <> < <= > >=, IS [NOT] NULL, [NOT] IN (list), [NOT] LIKE 'pattern'
+// where % matches any string and _ any character, and AND, OR, NOT. Comparisons and
+// logical operators yield booleans. Strings are converted to timestamps
+// and decimals, and integers to floats and decimals, where the other side
+// expects them.
+//
+// The functions are length(bytes), now(), and nextval('sequence') which is
+// only allowed as a column default. A column default is a constant, or an
+// expression computed for each new row. A CHECK condition must not be
+// false for any row.
+//
+// The aggregate functions COUNT(*), COUNT(expr), SUM, MIN, MAX and AVG
+// are only allowed in the output of SELECT. With aggregates or GROUP BY,
+// one row is output per group, and the columns outside the aggregates
+// must be grouping columns. ORDER BY may use the output names as well as
+// the columns.
+//
+// Columns are NOT NULL unless declared NULL. NULL is unknown: arithmetic
+// and comparisons with NULL yield NULL, and a NULL condition is false.
+
+// syntax tree node
+type QLNode struct {
+	Value // Type, I64, Str; the column name for QL_SYM
+	Kids  []QLNode
+}
+
+const (
+	QL_UNINIT = 0
+	// scalar
+	QL_STR  = TYPE_BYTES
+	QL_I64  = TYPE_INT64
+	QL_F64  = TYPE_FLOAT64
+	QL_BOOL = TYPE_BOOL
+	QL_NULL = TYPE_NULL
+	// binary ops
+	QL_CMP_GE = 10 // >=
+	QL_CMP_GT = 11 // >
+	QL_CMP_LT = 12 // <
+	QL_CMP_LE = 13 // <=
+	QL_CMP_EQ = 14 // =
+	QL_CMP_NE = 15 // !=
+	QL_LIKE   = 16 // LIKE, Kids[1] is the pattern
+	QL_IN     = 17 // IN, Kids[1:] is the list
+	QL_ADD    = 20
+	QL_SUB    = 21
+	QL_MUL    = 22
+	QL_DIV    = 23
+	QL_MOD    = 24
+	QL_AND    = 30
+	QL_OR     = 31
+	// unary ops
+	QL_NOT     = 50
+	QL_NEG     = 51
+	QL_IS_NULL = 52
+	// others
+	QL_SYM  = 100 // column
+	QL_STAR = 101 // select *
+	QL_AGG  = 102 // aggregate function, Str is the name, Kids[0] is the argument
+	QL_FUNC = 103 // scalar function, Str is the name, Kids are the arguments
+)
+
+// common structure for statements: `FROM table WHERE cond`
+type QLScan struct {
+	Table  string
+	Filter *QLNode // nil for all rows
+}
+
+// stmt: select
+type QLSelect struct {
+	QLScan
+	Names   []string // expr AS name
+	Output  []QLNode
+	GroupBy []string
+	OrderBy []QLOrder
+	Limit   int64 // -1 for no limit
+	Offset  int64
+}
+
+// ORDER BY expr [DESC]
+type QLOrder struct {
+	Expr QLNode
+	Desc bool
+}
+
+// stmt: update
+type QLUpdate struct {
+	QLScan
+	Names  []string
+	Values []QLNode
+}
+
+// stmt: insert
+type QLInsert struct {
+	Table  string
+	Names  []string // empty for all columns
+	Values [][]QLNode
+}
+
+// stmt: delete
+type QLDelete struct {
+	QLScan
+}
+
+// stmt: create table
+type QLCreateTable struct {
+	Def TableDef
+}
+
+// a column of CREATE TABLE and ALTER TABLE ADD
+type QLColumn struct {
+	Name     string
+	Type     uint32
+	Nullable bool
+	PKey     bool
+	Default  Value  // TYPE_ERROR for none
+	DefExpr  string // a default computed for each row, such as now()
+	Checks   []string
+	AutoInc  bool // the primary key is assigned from a sequence
+}
+
+// stmt: alter table
+type QLAlterTable struct {
+	Table   string
+	Op      int      // QL_ALTER_*
+	Column  QLColumn // the added column
+	Name    string   // the dropped or renamed column
+	NewName string
+}
+
+const (
+	QL_ALTER_ADD = iota + 1
+	QL_ALTER_DROP
+	QL_ALTER_RENAME
+)
+
+// stmt: drop table
+type QLDropTable struct {
+	Table string
+}
+
+// stmt: truncate table
+type QLTruncate struct {
+	Table string
+}
+
+// stmt: analyze, gather the statistics
+type QLAnalyze struct {
+	Table string
+}
+
+// stmt: explain, the access path of a SELECT, UPDATE or DELETE
+type QLExplain struct {
+	Scan *QLScan
+}
+
+// stmt: create index
+type QLCreateIndex struct {
+	Table  string
+	Cols   []string
+	Unique bool
+}
+
+const (
+	TOK_EOF = iota
+	TOK_NAME
+	TOK_I64
+	TOK_F64
+	TOK_STR
+	TOK_SYM // punctuation and operators
+)
+
+type qlToken struct {
+	kind int
+	text string
+	i64  int64
+	f64  float64
+}
+
+type Parser struct {
+	tokens []qlToken
+	pos    int
+}
+
+func qlTokenize(input string) ([]qlToken, error) {
+	tokens := []qlToken{}
+	for i := 0; i < len(input); {
+		ch := input[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '_' || isLetter(ch):
+			j := i
+			for j < len(input) && (input[j] == '_' || isLetter(input[j]) || isDigit(input[j])) {
+				j++
+			}
+			tokens = append(tokens, qlToken{kind: TOK_NAME, text: input[i:j]})
+			i = j
+		case isDigit(ch):
+			j := i
+			for j < len(input) && isDigit(input[j]) {
+				j++
+			}
+			// a fraction or an exponent makes a float
+			isFloat := false
+			if j+1 < len(input) && input[j] == '.' && isDigit(input[j+1]) {
+				for j++; j < len(input) && isDigit(input[j]); j++ {
+				}
+				isFloat = true
+			}
+			if j < len(input) && (input[j] == 'e' || input[j] == 'E') {
+				k := j + 1
+				if k < len(input) && (input[k] == '+' || input[k] == '-') {
+					k++
+				}
+				if k < len(input) && isDigit(input[k]) {
+					for j = k; j < len(input) && isDigit(input[j]); j++ {
+					}
+					isFloat = true
+				}
+			}
+			if isFloat {
+				f64, err := strconv.ParseFloat(input[i:j], 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad number: %s", input[i:j])
+				}
+				tokens = append(tokens, qlToken{kind: TOK_F64, text: input[i:j], f64: f64})
+				i = j
+				continue
+			}
+			i64, err := strconv.ParseInt(input[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad integer: %s", input[i:j])
+			}
+			tokens = append(tokens, qlToken{kind: TOK_I64, text: input[i:j], i64: i64})
+			i = j
+		case ch == '\'':
+			// 'it''s' is the string it's
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(input) {
+					return nil, errors.New("unterminated string")
+				}
+				if input[j] == '\'' {
+					if j+1 < len(input) && input[j+1] == '\'' {
+						sb.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(input[j])
+				j++
+			}
+			tokens = append(tokens, qlToken{kind: TOK_STR, text: sb.String()})
+			i = j + 1
+		default:
+			sym := ""
+			for _, op := range []string{">=", "<=", "!=", "<>", "(", ")", ",", ";", "*", "=", "<", ">", "+", "-", "/", "%"} {
+				if strings.HasPrefix(input[i:], op) {
+					sym = op
+					break
+				}
+			}
+			if sym == "" {
+				return nil, fmt.Errorf("unexpected character: %q", ch)
+			}
+			tokens = append(tokens, qlToken{kind: TOK_SYM, text: sym})
+			i += len(sym)
+		}
+	}
+	return append(tokens, qlToken{kind: TOK_EOF}), nil
+}
+func isLetter(ch byte) bool {
+	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+// parse a single statement, the trailing semicolon is optional.
+func ParseSQL(input string) (any, error) {
+	tokens, err := qlTokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	stmt, err := p.parseStmt()
+	if err != nil {
+		return nil, err
+	}
+	p.trySym(";")
+	if p.peek().kind != TOK_EOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return stmt, nil
+}
+
+// parse an expression, such as a condition for Scanner.Filter
+func ParseExpr(input string) (*QLNode, error) {
+	tokens, err := qlTokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != TOK_EOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return &expr, nil
+}
+
+func (p *Parser) peek() qlToken {
+	return p.tokens[p.pos]
+}
+func (p *Parser) next() qlToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != TOK_EOF {
+		p.pos++
+	}
+	return tok
+}
+func (p *Parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("syntax error: "+format, args...)
+}
+
+// match a keyword, case insensitive
+func (p *Parser) tryKeyword(kws ...string) bool {
+	save := p.pos
+	for _, kw := range kws {
+		tok := p.peek()
+		if tok.kind != TOK_NAME || !strings.EqualFold(tok.text, kw) {
+			p.pos = save
+			return false
+		}
+		p.next()
+	}
+	return true
+}
+func (p *Parser) expectKeyword(kws ...string) error {
+	if !p.tryKeyword(kws...) {
+		return p.errorf("expect %s", strings.Join(kws, " "))
+	}
+	return nil
+}
+func (p *Parser) trySym(sym string) bool {
+	if tok := p.peek(); tok.kind == TOK_SYM && tok.text == sym {
+		p.next()
+		return true
+	}
+	return false
+}
+func (p *Parser) expectSym(sym string) error {
+	if !p.trySym(sym) {
+		return p.errorf("expect %q", sym)
+	}
+	return nil
+}
+
+var qlKeywords = map[string]bool{
+	"create": true, "table": true, "insert": true, "into": true, "values": true,
+	"select": true, "from": true, "where": true, "update": true, "set": true,
+	"delete": true, "and": true, "or": true, "not": true, "as": true,
+	"primary": true, "key": true, "index": true, "unique": true, "on": true,
+	"true": true, "false": true, "null": true, "is": true,
+	"alter": true, "default": true, "drop": true, "truncate": true,
+	"group": true, "by": true, "order": true, "limit": true, "offset": true,
+	"in": true, "like": true,
+}
+
+func (p *Parser) parseName() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_NAME || qlKeywords[strings.ToLower(tok.text)] {
+		return "", p.errorf("expect a name, got %q", tok.text)
+	}
+	p.next()
+	return tok.text, nil
+}
+
+func (p *Parser) parseStmt() (any, error) {
+	switch {
+	case p.tryKeyword("CREATE", "TABLE"):
+		return p.parseCreateTable()
+	case p.tryKeyword("ALTER", "TABLE"):
+		return p.parseAlterTable()
+	case p.tryKeyword("DROP", "TABLE"):
+		name, err := p.parseName()
+		return &QLDropTable{Table: name}, err
+	case p.tryKeyword("TRUNCATE"):
+		p.tryKeyword("TABLE")
+		name, err := p.parseName()
+		return &QLTruncate{Table: name}, err
+	case p.tryKeyword("CREATE", "INDEX"):
+		return p.parseCreateIndex(false)
+	case p.tryKeyword("CREATE", "UNIQUE", "INDEX"):
+		return p.parseCreateIndex(true)
+	case p.tryKeyword("INSERT", "INTO"):
+		return p.parseInsert()
+	case p.tryKeyword("SELECT"):
+		return p.parseSelect()
+	case p.tryKeyword("UPDATE"):
+		return p.parseUpdate()
+	case p.tryKeyword("DELETE", "FROM"):
+		return p.parseDelete()
+	case p.tryKeyword("ANALYZE"):
+		p.tryKeyword("TABLE")
+		name, err := p.parseName()
+		return &QLAnalyze{Table: name}, err
+	case p.tryKeyword("EXPLAIN"):
+		return p.parseExplain()
+	}
+	return nil, p.errorf("unknown statement")
+}
+
+// EXPLAIN SELECT ..., the statement is not executed
+func (p *Parser) parseExplain() (*QLExplain, error) {
+	stmt, err := p.parseStmt()
+	if err != nil {
+		return nil, err
+	}
+	switch stmt := stmt.(type) {
+	case *QLSelect:
+		return &QLExplain{Scan: &stmt.QLScan}, nil
+	case *QLUpdate:
+		return &QLExplain{Scan: &stmt.QLScan}, nil
+	case *QLDelete:
+		return &QLExplain{Scan: &stmt.QLScan}, nil
+	}
+	return nil, p.errorf("only SELECT, UPDATE and DELETE can be explained")
+}
+
+// CREATE TABLE t (a int64, b bytes NULL, PRIMARY KEY (a), UNIQUE INDEX (b))
+// the primary key columns are moved to the front of the table.
+func (p *Parser) parseCreateTable() (*QLCreateTable, error) {
+	stmt := &QLCreateTable{}
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Def.Name = name
+	if err := p.expectSym("("); err != nil {
+		return nil, err
+	}
+	cols, pkeys := []QLColumn{}, []string{}
+	for {
+		if p.tryKeyword("PRIMARY", "KEY") {
+			if pkeys, err = p.parseParenNames(); err != nil {
+				return nil, err
+			}
+		} else if unique := p.tryKeyword("UNIQUE"); unique || p.tryKeyword("INDEX") {
+			if unique {
+				p.tryKeyword("INDEX")
+			}
+			index, err := p.parseParenNames()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Def.Indexes = append(stmt.Def.Indexes, index)
+			stmt.Def.Unique = append(stmt.Def.Unique, unique)
+		} else if p.tryKeyword("CHECK") {
+			cond, err := p.parseCheck()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Def.Checks = append(stmt.Def.Checks, cond)
+		} else if p.tryKeyword("FOREIGN", "KEY") {
+			fk, err := p.parseForeignKey()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Def.ForeignKeys = append(stmt.Def.ForeignKeys, fk)
+		} else {
+			col, err := p.parseColumn()
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, col)
+			stmt.Def.Checks = append(stmt.Def.Checks, col.Checks...)
+			if col.AutoInc {
+				stmt.Def.AutoIncrement = true
+			}
+			if col.PKey {
+				pkeys = append(pkeys, col.Name)
+			}
+		}
+		if !p.trySym(",") {
+			break
+		}
+	}
+	if err := p.expectSym(")"); err != nil {
+		return nil, err
+	}
+	if len(pkeys) == 0 && len(cols) > 0 {
+		pkeys = []string{cols[0].Name} // default to the first column
+	}
+	// reorder the columns: primary key first
+	def := &stmt.Def
+	add := func(col QLColumn) {
+		def.Cols = append(def.Cols, col.Name)
+		def.Types = append(def.Types, col.Type)
+		def.Nullable = append(def.Nullable, col.Nullable)
+		def.Defaults = append(def.Defaults, col.Default)
+		def.DefaultExprs = append(def.DefaultExprs, col.DefExpr)
+	}
+	used := make([]bool, len(cols))
+	for _, pk := range pkeys {
+		idx := slices.IndexFunc(cols, func(col QLColumn) bool { return col.Name == pk })
+		if idx < 0 || used[idx] {
+			return nil, fmt.Errorf("bad primary key column: %s", pk)
+		}
+		used[idx] = true
+		add(cols[idx])
+	}
+	for i := range cols {
+		if cols[i].AutoInc && !used[i] {
+			return nil, fmt.Errorf("AUTO_INCREMENT is not the primary key: %s", cols[i].Name)
+		}
+	}
+	for i := range cols {
+		if !used[i] {
+			add(cols[i])
+		}
+	}
+	// the optional fields are omitted when unused
+	if !slices.Contains(def.Nullable, true) {
+		def.Nullable = nil
+	}
+	if !slices.ContainsFunc(def.Defaults, func(v Value) bool { return v.Type != TYPE_ERROR }) {
+		def.Defaults = nil
+	}
+	if !slices.ContainsFunc(def.DefaultExprs, func(s string) bool { return s != "" }) {
+		def.DefaultExprs = nil
+	}
+	def.PKeys = len(pkeys)
+	return stmt, nil
+}
+
+// (a, ...) REFERENCES p [ON DELETE RESTRICT|CASCADE|SET NULL]
+func (p *Parser) parseForeignKey() (ForeignKey, error) {
+	fk := ForeignKey{}
+	var err error
+	if fk.Cols, err = p.parseParenNames(); err != nil {
+		return fk, err
+	}
+	if err := p.expectKeyword("REFERENCES"); err != nil {
+		return fk, err
+	}
+	if fk.Table, err = p.parseName(); err != nil {
+		return fk, err
+	}
+	if p.tryKeyword("ON", "DELETE") {
+		switch {
+		case p.tryKeyword("RESTRICT"):
+			fk.OnDelete = FK_RESTRICT
+		case p.tryKeyword("CASCADE"):
+			fk.OnDelete = FK_CASCADE
+		case p.tryKeyword("SET", "NULL"):
+			fk.OnDelete = FK_SET_NULL
+		default:
+			return fk, p.errorf("expect RESTRICT, CASCADE or SET NULL")
+		}
+	}
+	return fk, nil
+}
+
+// (cond), the source text of the condition
+func (p *Parser) parseCheck() (string, error) {
+	if err := p.expectSym("("); err != nil {
+		return "", err
+	}
+	start := p.pos
+	if _, err := p.parseExpr(); err != nil {
+		return "", err
+	}
+	cond := p.text(start, p.pos)
+	return cond, p.expectSym(")")
+}
+
+// a int64 [PRIMARY KEY] [AUTO_INCREMENT] [NULL | NOT NULL] [DEFAULT value] [CHECK (cond)]
+func (p *Parser) parseColumn() (QLColumn, error) {
+	col := QLColumn{}
+	var err error
+	if col.Name, err = p.parseName(); err != nil {
+		return col, err
+	}
+	typ := p.next()
+	if col.Type = TypeByName(typ.text); typ.kind != TOK_NAME || col.Type == TYPE_ERROR {
+		return col, p.errorf("unknown type %q", typ.text)
+	}
+	for {
+		if p.tryKeyword("PRIMARY", "KEY") {
+			col.PKey = true
+		} else if p.tryKeyword("AUTO_INCREMENT") {
+			col.AutoInc = true
+		} else if p.tryKeyword("NOT", "NULL") {
+			col.Nullable = false
+		} else if p.tryKeyword("NULL") {
+			col.Nullable = true
+		} else if p.tryKeyword("CHECK") {
+			cond, err := p.parseCheck()
+			if err != nil {
+				return col, err
+			}
+			col.Checks = append(col.Checks, cond)
+		} else if p.tryKeyword("DEFAULT") {
+			start := p.pos
+			node, err := p.parseUnary()
+			if err != nil {
+				return col, err
+			}
+			if qlHasFunc(node) {
+				// computed for each row
+				col.DefExpr = p.text(start, p.pos)
+				continue
+			}
+			// a constant
+			val, err := qlEval(nil, &node)
+			if err == nil {
+				val, err = qlConvert(val, col.Type)
+			}
+			if err != nil {
+				return col, fmt.Errorf("bad default: %s: %w", col.Name, err)
+			}
+			if val.Type != TYPE_NULL {
+				col.Default = val
+			}
+		} else {
+			return col, nil
+		}
+	}
+}
+
+// ALTER TABLE t ADD [COLUMN] c int64 [NULL] [DEFAULT 0]
+// ALTER TABLE t DROP [COLUMN] c
+// ALTER TABLE t RENAME [COLUMN] c TO d
+func (p *Parser) parseAlterTable() (*QLAlterTable, error) {
+	stmt := &QLAlterTable{}
+	var err error
+	if stmt.Table, err = p.parseName(); err != nil {
+		return nil, err
+	}
+	switch {
+	case p.tryKeyword("ADD"):
+		p.tryKeyword("COLUMN")
+		stmt.Op = QL_ALTER_ADD
+		stmt.Column, err = p.parseColumn()
+		if err == nil && (stmt.Column.PKey || stmt.Column.AutoInc) {
+			err = p.errorf("cannot add a primary key column")
+		}
+		if err == nil && (stmt.Column.DefExpr != "" || len(stmt.Column.Checks) > 0) {
+			err = p.errorf("an added column has a constant default and no checks")
+		}
+	case p.tryKeyword("DROP"):
+		p.tryKeyword("COLUMN")
+		stmt.Op = QL_ALTER_DROP
+		stmt.Name, err = p.parseName()
+	case p.tryKeyword("RENAME"):
+		p.tryKeyword("COLUMN")
+		stmt.Op = QL_ALTER_RENAME
+		if stmt.Name, err = p.parseName(); err == nil {
+			if err = p.expectKeyword("TO"); err == nil {
+				stmt.NewName, err = p.parseName()
+			}
+		}
+	default:
+		err = p.errorf("expect ADD, DROP or RENAME")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// CREATE INDEX ON t (a, b)
+func (p *Parser) parseCreateIndex(unique bool) (*QLCreateIndex, error) {
+	stmt := &QLCreateIndex{Unique: unique}
+	var err error
+	if err = p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.parseName(); err != nil {
+		return nil, err
+	}
+	if stmt.Cols, err = p.parseParenNames(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')
+func (p *Parser) parseInsert() (*QLInsert, error) {
+	stmt := &QLInsert{}
+	var err error
+	if stmt.Table, err = p.parseName(); err != nil {
+		return nil, err
+	}
+	if p.trySym("(") {
+		if stmt.Names, err = p.parseNameList(); err != nil {
+			return nil, err
+		}
+		if err := p.expectSym(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSym("("); err != nil {
+			return nil, err
+		}
+		row := []QLNode{}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, expr)
+			if !p.trySym(",") {
+				break
+			}
+		}
+		if err := p.expectSym(")"); err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, row)
+		if !p.trySym(",") {
+			break
+		}
+	}
+	return stmt, nil
+}
+
+// (a, b, ...)
+func (p *Parser) parseParenNames() ([]string, error) {
+	if err := p.expectSym("("); err != nil {
+		return nil, err
+	}
+	names, err := p.parseNameList()
+	if err != nil {
+		return nil, err
+	}
+	return names, p.expectSym(")")
+}
+
+func (p *Parser) parseNameList() ([]string, error) {
+	names := []string{}
+	for {
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.trySym(",") {
+			return names, nil
+		}
+	}
+}
+
+// SELECT a, b + 1 AS c FROM t WHERE cond GROUP BY a ORDER BY c LIMIT 10
+func (p *Parser) parseSelect() (*QLSelect, error) {
+	stmt := &QLSelect{}
+	for {
+		if p.trySym("*") {
+			stmt.Output = append(stmt.Output, QLNode{Value: Value{Type: QL_STAR}})
+			stmt.Names = append(stmt.Names, "*")
+		} else {
+			start := p.pos
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			name := p.text(start, p.pos)
+			if p.tryKeyword("AS") {
+				if name, err = p.parseName(); err != nil {
+					return nil, err
+				}
+			}
+			stmt.Output = append(stmt.Output, expr)
+			stmt.Names = append(stmt.Names, name)
+		}
+		if !p.trySym(",") {
+			break
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.parseScan(&stmt.QLScan); err != nil {
+		return nil, err
+	}
+	if p.tryKeyword("GROUP", "BY") {
+		var err error
+		if stmt.GroupBy, err = p.parseNameList(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tryKeyword("ORDER", "BY") {
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			desc := p.tryKeyword("DESC")
+			if !desc {
+				p.tryKeyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, QLOrder{Expr: expr, Desc: desc})
+			if !p.trySym(",") {
+				break
+			}
+		}
+	}
+	stmt.Limit = -1
+	if p.tryKeyword("LIMIT") {
+		var err error
+		if stmt.Limit, err = p.parseCount(); err != nil {
+			return nil, err
+		}
+		if p.tryKeyword("OFFSET") {
+			if stmt.Offset, err = p.parseCount(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// a non-negative integer
+func (p *Parser) parseCount() (int64, error) {
+	tok := p.peek()
+	if tok.kind != TOK_I64 || tok.i64 < 0 {
+		return 0, p.errorf("expect a count, got %q", tok.text)
+	}
+	p.next()
+	return tok.i64, nil
+}
+
+// the source text of the tokens [start, end), for naming the output
+func (p *Parser) text(start int, end int) string {
+	parts := []string{}
+	for _, tok := range p.tokens[start:end] {
+		if tok.kind == TOK_STR {
+			parts = append(parts, "'"+strings.ReplaceAll(tok.text, "'", "''")+"'")
+		} else {
+			parts = append(parts, tok.text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// table [WHERE cond]
+func (p *Parser) parseScan(scan *QLScan) error {
+	var err error
+	if scan.Table, err = p.parseName(); err != nil {
+		return err
+	}
+	if p.tryKeyword("WHERE") {
+		cond, err := p.parseExpr()
+		if err != nil {
+			return err
+		}
+		scan.Filter = &cond
+	}
+	return nil
+}
+
+// UPDATE t SET a = expr, b = expr WHERE cond
+func (p *Parser) parseUpdate() (*QLUpdate, error) {
+	stmt := &QLUpdate{}
+	var err error
+	if stmt.Table, err = p.parseName(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSym("="); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Names = append(stmt.Names, name)
+		stmt.Values = append(stmt.Values, expr)
+		if !p.trySym(",") {
+			break
+		}
+	}
+	if p.tryKeyword("WHERE") {
+		cond, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Filter = &cond
+	}
+	return stmt, nil
+}
+
+// DELETE FROM t WHERE cond
+func (p *Parser) parseDelete() (*QLDelete, error) {
+	stmt := &QLDelete{}
+	return stmt, p.parseScan(&stmt.QLScan)
+}
+
+// expressions, from the lowest precedence
+func (p *Parser) parseExpr() (QLNode, error) {
+	return p.parseOr()
+}
+
+func qlBinary(op uint32, left QLNode, right QLNode) QLNode {
+	return QLNode{Value: Value{Type: op}, Kids: []QLNode{left, right}}
+}
+
+func qlNot(not bool, node QLNode) QLNode {
+	if not {
+		return QLNode{Value: Value{Type: QL_NOT}, Kids: []QLNode{node}}
+	}
+	return node
+}
+
+// a OR b
+func (p *Parser) parseOr() (QLNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.tryKeyword("OR") {
+		var right QLNode
+		if right, err = p.parseAnd(); err == nil {
+			left = qlBinary(QL_OR, left, right)
+		}
+	}
+	return left, err
+}
+
+// a AND b
+func (p *Parser) parseAnd() (QLNode, error) {
+	left, err := p.parseNot()
+	for err == nil && p.tryKeyword("AND") {
+		var right QLNode
+		if right, err = p.parseNot(); err == nil {
+			left = qlBinary(QL_AND, left, right)
+		}
+	}
+	return left, err
+}
+
+// NOT a
+func (p *Parser) parseNot() (QLNode, error) {
+	if p.tryKeyword("NOT") {
+		kid, err := p.parseNot()
+		return QLNode{Value: Value{Type: QL_NOT}, Kids: []QLNode{kid}}, err
+	}
+	return p.parseCmp()
+}
+
+// a < b, a IS [NOT] NULL, a [NOT] IN (b, c), a [NOT] LIKE b
+func (p *Parser) parseCmp() (QLNode, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return left, err
+	}
+	not := p.tryKeyword("NOT")
+	switch {
+	case p.tryKeyword("IN"):
+		node := QLNode{Value: Value{Type: QL_IN}, Kids: []QLNode{left}}
+		if err := p.expectSym("("); err != nil {
+			return node, err
+		}
+		for {
+			kid, err := p.parseAdd()
+			if err != nil {
+				return node, err
+			}
+			node.Kids = append(node.Kids, kid)
+			if !p.trySym(",") {
+				break
+			}
+		}
+		return qlNot(not, node), p.expectSym(")")
+	case p.tryKeyword("LIKE"):
+		right, err := p.parseAdd()
+		return qlNot(not, qlBinary(QL_LIKE, left, right)), err
+	case not:
+		return left, p.errorf("expect IN or LIKE")
+	}
+	if p.tryKeyword("IS") {
+		not := p.tryKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return left, err
+		}
+		node := QLNode{Value: Value{Type: QL_IS_NULL}, Kids: []QLNode{left}}
+		return qlNot(not, node), nil
+	}
+	ops := map[string]uint32{
+		">=": QL_CMP_GE, ">": QL_CMP_GT, "<": QL_CMP_LT, "<=": QL_CMP_LE,
+		"=": QL_CMP_EQ, "!=": QL_CMP_NE, "<>": QL_CMP_NE,
+	}
+	if tok := p.peek(); tok.kind == TOK_SYM && ops[tok.text] != 0 {
+		p.next()
+		right, err := p.parseAdd()
+		return qlBinary(ops[tok.text], left, right), err
+	}
+	return left, nil
+}
+
+// a + b, a - b
+func (p *Parser) parseAdd() (QLNode, error) {
+	left, err := p.parseMul()
+	for err == nil {
+		op := uint32(0)
+		if p.trySym("+") {
+			op = QL_ADD
+		} else if p.trySym("-") {
+			op = QL_SUB
+		} else {
+			break
+		}
+		var right QLNode
+		if right, err = p.parseMul(); err == nil {
+			left = qlBinary(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// a * b, a / b, a % b
+func (p *Parser) parseMul() (QLNode, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		op := uint32(0)
+		if p.trySym("*") {
+			op = QL_MUL
+		} else if p.trySym("/") {
+			op = QL_DIV
+		} else if p.trySym("%") {
+			op = QL_MOD
+		} else {
+			break
+		}
+		var right QLNode
+		if right, err = p.parseUnary(); err == nil {
+			left = qlBinary(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// -a
+func (p *Parser) parseUnary() (QLNode, error) {
+	if p.trySym("-") {
+		kid, err := p.parseUnary()
+		if err == nil && kid.Type == QL_I64 {
+			kid.I64 = -kid.I64 // fold the constant
+			return kid, nil
+		}
+		if err == nil && kid.Type == QL_F64 {
+			kid.F64 = -kid.F64
+			return kid, nil
+		}
+		return QLNode{Value: Value{Type: QL_NEG}, Kids: []QLNode{kid}}, err
+	}
+	return p.parseAtom()
+}
+
+// literals, column names, aggregates, and (expr)
+func (p *Parser) parseAtom() (QLNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case TOK_I64:
+		p.next()
+		return QLNode{Value: Value{Type: QL_I64, I64: tok.i64}}, nil
+	case TOK_STR:
+		p.next()
+		return QLNode{Value: Value{Type: QL_STR, Str: []byte(tok.text)}}, nil
+	case TOK_F64:
+		p.next()
+		return QLNode{Value: Value{Type: QL_F64, F64: tok.f64}}, nil
+	case TOK_NAME:
+		if p.tryKeyword("TRUE") {
+			return QLNode{Value: Value{Type: QL_BOOL, I64: 1}}, nil
+		}
+		if p.tryKeyword("FALSE") {
+			return QLNode{Value: Value{Type: QL_BOOL, I64: 0}}, nil
+		}
+		if p.tryKeyword("NULL") {
+			return QLNode{Value: Value{Type: QL_NULL}}, nil
+		}
+		if p.tokens[p.pos+1].text == "(" && aggNames[strings.ToLower(tok.text)] != 0 {
+			return p.parseAgg()
+		}
+		if _, ok := qlFuncs[strings.ToLower(tok.text)]; ok && p.tokens[p.pos+1].text == "(" {
+			return p.parseFunc()
+		}
+		name, err := p.parseName()
+		return QLNode{Value: Value{Type: QL_SYM, Str: []byte(name)}}, err
+	}
+	if p.trySym("(") {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return expr, err
+		}
+		return expr, p.expectSym(")")
+	}
+	return QLNode{}, p.errorf("unexpected %q", tok.text)
+}
+
+// the scalar functions and their number of arguments
+var qlFuncs = map[string]int{"length": 1, "now": 0, "nextval": 1}
+
+// length(expr), now(), ...
+func (p *Parser) parseFunc() (QLNode, error) {
+	name := strings.ToLower(p.next().text)
+	node := QLNode{Value: Value{Type: QL_FUNC, Str: []byte(name)}}
+	p.next() // (
+	for !p.trySym(")") {
+		if len(node.Kids) > 0 {
+			if err := p.expectSym(","); err != nil {
+				return node, err
+			}
+		}
+		kid, err := p.parseExpr()
+		if err != nil {
+			return node, err
+		}
+		node.Kids = append(node.Kids, kid)
+	}
+	if len(node.Kids) != qlFuncs[name] {
+		return node, p.errorf("%s() takes %d arguments", name, qlFuncs[name])
+	}
+	return node, nil
+}
+
+// COUNT(*), SUM(expr), ...
+func (p *Parser) parseAgg() (QLNode, error) {
+	name := strings.ToLower(p.next().text)
+	node := QLNode{Value: Value{Type: QL_AGG, Str: []byte(name)}}
+	p.next() // (
+	if name == "count" && p.trySym("*") {
+		node.Kids = []QLNode{{Value: Value{Type: QL_STAR}}}
+		return node, p.expectSym(")")
+	}
+	kid, err := p.parseExpr()
+	if err != nil {
+		return node, err
+	}
+	node.Kids = []QLNode{kid}
+	return node, p.expectSym(")")
+}
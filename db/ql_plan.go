@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	. "types"
+)
+
+// Access paths.
+//
+// A scan with a WHERE clause reads the whole table, a range of the primary
+// key, or a range of a secondary index with a lookup of each row. The
+// `col op constant` conditions on the columns of a key give an equal
+// prefix and a range on the next column, and the statistics estimate the
+// rows within. The cheapest path wins: a row read in key order costs 1, a
+// row found by an index costs PLAN_FETCH_COST more, and a seek costs
+// PLAN_SEEK_COST. Without statistics, a table is assumed to have
+// PLAN_DEFAULT_ROWS rows, and the conditions fixed selectivities.
+
+const (
+	PLAN_FULL_SCAN   = "full scan"
+	PLAN_LOOKUP      = "primary key lookup"
+	PLAN_PKEY_RANGE  = "primary key range"
+	PLAN_INDEX_RANGE = "index range"
+)
+
+const (
+	PLAN_SEEK_COST    = 4.0
+	PLAN_FETCH_COST   = 3.0
+	PLAN_DEFAULT_ROWS = 1000
+	PLAN_EQ_SEL       = 0.1 // col = constant
+	PLAN_RANGE_SEL    = 0.3 // col < constant, etc.
+)
+
+// the chosen access path of a scan
+type qlPlan struct {
+	access     string // PLAN_*
+	index      int    // the secondary index, -1 for the primary key
+	key1, key2 Record // the range for the Scanner
+	cmp1, cmp2 int
+	nEq        int     // the key columns of the equal prefix
+	rows       float64 // estimated
+	cost       float64
+}
+
+// pick the cheapest access path for the filter
+func qlPlanScan(db *DB, tdef *TableDef, filter *QLNode) *qlPlan {
+	stats := getTableStats(db, tdef)
+	total := float64(PLAN_DEFAULT_ROWS)
+	if stats != nil {
+		total = float64(stats.Rows)
+	}
+	best := &qlPlan{access: PLAN_FULL_SCAN, index: -1, cmp1: CMP_GE, cmp2: CMP_LE, rows: total, cost: total}
+	consider := func(plan *qlPlan) {
+		if plan != nil && plan.cost < best.cost {
+			best = plan
+		}
+	}
+	consider(qlKeyPlan(tdef, stats, total, -1, filter))
+	for i := range tdef.Indexes {
+		if !isBuilding(tdef, i) {
+			consider(qlKeyPlan(tdef, stats, total, i, filter))
+		}
+	}
+	return best
+}
+
+// the range of the primary key or an index from the conditions on its
+// columns, nil if there are none
+func qlKeyPlan(tdef *TableDef, stats *TableStats, total float64, index int, filter *QLNode) *qlPlan {
+	cols := tdef.Cols[:tdef.PKeys]
+	if index >= 0 {
+		cols = tdef.Indexes[index]
+	}
+	conds := qlKeyConds(tdef, cols, filter)
+	plan := &qlPlan{index: index, cmp1: CMP_GE, cmp2: CMP_LE}
+	sel := 1.0
+	nEq := 0
+	for nEq < len(cols) && conds[nEq].eq != nil {
+		plan.key1.Cols = append(plan.key1.Cols, cols[nEq])
+		plan.key1.Vals = append(plan.key1.Vals, *conds[nEq].eq)
+		sel *= stats.eqSel(cols[nEq])
+		nEq++
+	}
+	plan.nEq = nEq
+	if index < 0 && nEq == tdef.PKeys {
+		plan.access, plan.rows, plan.cost = PLAN_LOOKUP, min(total, 1), PLAN_SEEK_COST
+		plan.key2 = plan.key1
+		return plan
+	}
+	plan.key2.Cols = append(plan.key2.Cols, plan.key1.Cols...)
+	plan.key2.Vals = append(plan.key2.Vals, plan.key1.Vals...)
+	if nEq < len(cols) {
+		// a range on the next column
+		c := &conds[nEq]
+		if c.lo != nil {
+			plan.key1.Cols = append(plan.key1.Cols, cols[nEq])
+			plan.key1.Vals = append(plan.key1.Vals, *c.lo)
+			plan.cmp1 = c.cmp1
+		}
+		if c.hi != nil {
+			plan.key2.Cols = append(plan.key2.Cols, cols[nEq])
+			plan.key2.Vals = append(plan.key2.Vals, *c.hi)
+			plan.cmp2 = c.cmp2
+		}
+		if c.lo != nil || c.hi != nil {
+			sel *= stats.rangeSel(cols[nEq], c.lo, c.cmp1, c.hi, c.cmp2)
+		}
+	}
+	if len(plan.key1.Cols) == 0 && len(plan.key2.Cols) == 0 {
+		return nil // the full scan
+	}
+	plan.rows = total * sel
+	if index >= 0 && isUnique(tdef, index) && nEq == len(cols) {
+		plan.rows = min(plan.rows, 1)
+	}
+	plan.access, plan.cost = PLAN_PKEY_RANGE, PLAN_SEEK_COST+plan.rows
+	if index >= 0 {
+		plan.access, plan.cost = PLAN_INDEX_RANGE, PLAN_SEEK_COST+plan.rows*(1+PLAN_FETCH_COST)
+	}
+	return plan
+}
+
+// describe the plan of a scan, one row per table
+func qlExplain(db *DB, scan *QLScan) ([]Record, error) {
+	tdef := getTableDef(db, scan.Table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, scan.Table)
+	}
+	plan := qlPlanScan(db, tdef, scan.Filter)
+	index := ""
+	if plan.index >= 0 {
+		index = "(" + strings.Join(tdef.Indexes[plan.index], ", ") + ")"
+	}
+	// the key conditions
+	conds := []string{}
+	ops := map[int]string{CMP_GE: ">=", CMP_GT: ">", CMP_LT: "<", CMP_LE: "<="}
+	nEq := plan.nEq
+	for i := 0; i < nEq; i++ {
+		conds = append(conds, plan.key1.Cols[i]+" = "+FormatValue(&plan.key1.Vals[i]))
+	}
+	if nEq < len(plan.key1.Cols) {
+		conds = append(conds, plan.key1.Cols[nEq]+" "+ops[plan.cmp1]+" "+FormatValue(&plan.key1.Vals[nEq]))
+	}
+	if nEq < len(plan.key2.Cols) {
+		conds = append(conds, plan.key2.Cols[nEq]+" "+ops[plan.cmp2]+" "+FormatValue(&plan.key2.Vals[nEq]))
+	}
+	rec := (&Record{}).AddStr("table", []byte(tdef.Name)).AddStr("access", []byte(plan.access))
+	rec.AddStr("index", []byte(index)).AddStr("key", []byte(strings.Join(conds, " AND ")))
+	rec.AddInt64("rows", int64(math.Round(plan.rows))).AddFloat64("cost", plan.cost)
+	return []Record{*rec}, nil
+}
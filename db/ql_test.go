@@ -0,0 +1,126 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSQL(t *testing.T) {
+	stmt, err := ParseSQL("select a, b + 1 as c from t where a >= 3 and not b = 'x'")
+	assert.NoError(t, err)
+	sel := stmt.(*QLSelect)
+	assert.Equal(t, "t", sel.Table)
+	assert.Equal(t, []string{"a", "c"}, sel.Names)
+	assert.Equal(t, uint32(QL_AND), sel.Filter.Type)
+	assert.Equal(t, uint32(QL_NOT), sel.Filter.Kids[1].Type)
+
+	stmt, err = ParseSQL("create table t (id int64, name bytes, primary key (name, id));")
+	assert.NoError(t, err)
+	def := stmt.(*QLCreateTable).Def
+	assert.Equal(t, []string{"name", "id"}, def.Cols)
+	assert.Equal(t, []uint32{TYPE_BYTES, TYPE_INT64}, def.Types)
+	assert.Equal(t, 2, def.PKeys)
+
+	stmt, err = ParseSQL("create table t (id int64, a bytes, b int64, index (a), unique index (b, a), unique (b))")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a"}, {"b", "a"}, {"b"}}, stmt.(*QLCreateTable).Def.Indexes)
+	assert.Equal(t, []bool{false, true, true}, stmt.(*QLCreateTable).Def.Unique)
+
+	stmt, err = ParseSQL("insert into t (a, b) values (1, 'it''s'), (-2, '')")
+	assert.NoError(t, err)
+	ins := stmt.(*QLInsert)
+	assert.Equal(t, 2, len(ins.Values))
+	assert.Equal(t, "it's", string(ins.Values[0][1].Str))
+	assert.Equal(t, int64(-2), ins.Values[1][0].I64)
+
+	for _, bad := range []string{
+		"select from t",
+		"select a from",
+		"select a from t where",
+		"insert into t values (1",
+		"update t set a = 1 where",
+		"delete t",
+		"select a from t extra",
+		"select 'abc from t",
+		"select a from t where a in ()",
+		"select a from t where a not b",
+	} {
+		_, err := ParseSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestExecSQL(t *testing.T) {
+	os.Remove("test_ql.db")
+	defer os.Remove("test_ql.db")
+	db := &DB{Path: "test_ql.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) QLResult {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res
+	}
+	exec("create table people (id int64, name bytes, age int64, primary key (id))")
+	res := exec("insert into people values (1, 'alice', 30), (2, 'bob', 25), (3, 'carol', 41)")
+	assert.Equal(t, 3, res.Updated)
+	res = exec("insert into people (id, name, age) values (4, 'dave', 19)")
+	assert.Equal(t, 1, res.Updated)
+	_, err := db.ExecSQL("insert into people values (1, 'dup', 0)")
+	assert.Error(t, err)
+
+	names := func(recs []Record) []string {
+		out := []string{}
+		for _, rec := range recs {
+			out = append(out, string(rec.Get("name").Str))
+		}
+		return out
+	}
+	// point lookup
+	res = exec("select name, age * 2 as double from people where id = 2")
+	assert.Equal(t, []string{"bob"}, names(res.Records))
+	assert.Equal(t, int64(50), res.Records[0].Get("double").I64)
+	// key range
+	res = exec("select * from people where 2 <= id and id < 4")
+	assert.Equal(t, []string{"bob", "carol"}, names(res.Records))
+	assert.Equal(t, []string{"id", "name", "age"}, res.Records[0].Cols)
+	// full scan with a filter
+	res = exec("select name from people where age >= 25 or name = 'dave'")
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave"}, names(res.Records))
+	res = exec("select name from people where age > 100")
+	assert.Equal(t, 0, len(res.Records))
+	// IN and LIKE
+	res = exec("select name from people where age in (19, 41) or name like '_o%'")
+	assert.Equal(t, []string{"bob", "carol", "dave"}, names(res.Records))
+	res = exec("select name from people where id >= 1 and id <= 3 and name not like '%a%'")
+	assert.Equal(t, []string{"bob"}, names(res.Records))
+	res = exec("select name from people where id not in (1, 2, 3)")
+	assert.Equal(t, []string{"dave"}, names(res.Records))
+
+	res = exec("update people set age = age + 1 where age < 30")
+	assert.Equal(t, 2, res.Updated)
+	res = exec("select name from people where age = 26 or age = 20")
+	assert.Equal(t, []string{"bob", "dave"}, names(res.Records))
+	_, err = db.ExecSQL("update people set id = 5 where id = 1")
+	assert.Error(t, err)
+
+	res = exec("delete from people where id > 2 and id <= 100")
+	assert.Equal(t, 2, res.Updated)
+	res = exec("select name from people")
+	assert.Equal(t, []string{"alice", "bob"}, names(res.Records))
+
+	for _, bad := range []string{
+		"select x from people",
+		"select name from people where name > 1",
+		"select name from nope",
+		"select 1 / 0 from people",
+		"select name from people where age like 'x'",
+		"select name from people where name in ('a', 1)",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -1,36 +1,67 @@
 package db
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"slices"
 	. "types"
 	. "utils"
 )
 
-// the iterator for range queries
+var ErrBadScan = errors.New("bad scan") // the range or the columns of a Scanner
+
+// the iterator for range queries.
+// the keys are either the primary key or a prefix of a secondary index,
+// rows found by an index are fetched by the primary key.
+//
+// the optional filter skips the rows not matching it, and the optional
+// projection returns only some columns. when an index has all the needed
+// columns, the rows are not fetched.
 type Scanner struct {
 	// the range, from Key1 to Key2
 	Cmp1 int // CMP_?
 	Cmp2 int
 	Key1 Record
 	Key2 Record
+	// optional
+	Filter *QLNode  // the condition on the rows, see ParseExpr
+	Cols   []string // the returned columns, all if empty
 	// internal
-	tdef   *TableDef
-	iter   *BIter // the underlying B-tree iterator
-	keyEnd []byte // the encoded Key2
+	db      *DB
+	tdef    *TableDef
+	index   int    // -1: the primary key, >= 0: the secondary index
+	iter    *BIter // the underlying B-tree iterator
+	keyEnd  []byte // the encoded Key2
+	cmpEnd  int    // Cmp2 for keyEnd
+	covered bool   // the index has the needed columns
+	rec     Record // the current row when filtered
+	err     error  // from the filter
 }
 
 // within the range or not?
 func (sc *Scanner) Valid() bool {
-	if !sc.iter.Valid() {
+	if sc.err != nil || !sc.iter.Valid() {
 		return false
 	}
 	key, _ := sc.iter.Deref()
-	return CmpOK(key, sc.Cmp2, sc.keyEnd)
+	return CmpOK(key, sc.cmpEnd, sc.keyEnd)
 }
 
-// move the underlying B-tree iterator
+// the error of the filter that stopped the scan
+func (sc *Scanner) Err() error {
+	return sc.err
+}
+
+// move to the next row matching the filter
 func (sc *Scanner) Next() {
 	Assert(sc.Valid())
+	sc.move()
+	sc.skip()
+}
+
+// move the underlying B-tree iterator
+func (sc *Scanner) move() {
 	if sc.Cmp1 > 0 {
 		sc.iter.Next()
 	} else {
@@ -38,51 +69,278 @@ func (sc *Scanner) Next() {
 	}
 }
 
+// skip the rows not matching the filter, the current row is kept
+func (sc *Scanner) skip() {
+	for sc.Filter != nil && sc.Valid() {
+		sc.deref(&sc.rec)
+		ok, err := qlFilter(&sc.rec, sc.Filter)
+		if err != nil || ok {
+			sc.err = err
+			return
+		}
+		sc.move()
+	}
+}
+
 // fetch the current row
 func (sc *Scanner) Deref(rec *Record) {
-	values, err := checkRecord(sc.tdef, *rec, sc.tdef.PKeys)
-	if err != nil {
+	row := &sc.rec
+	if sc.Filter == nil {
+		sc.deref(rec)
+		row = rec
+	}
+	if len(sc.Cols) == 0 {
+		rec.Cols = append(rec.Cols[:0], row.Cols...)
+		rec.Vals = append(rec.Vals[:0], row.Vals...)
 		return
 	}
-	// key := encodeKey(nil, sc.tdef.Prefix, values[:sc.tdef.PKeys])
-	// fmt.Println("prefix", sc.tdef.Prefix, "values:", values[:sc.tdef.PKeys], "record", rec)
-	// fmt.Printf("serach for key: %s\n", key)
-	_, val := sc.iter.Deref()
+	vals := make([]Value, len(sc.Cols))
+	for i, col := range sc.Cols {
+		vals[i] = *row.Get(col)
+	}
+	rec.Cols = append(rec.Cols[:0], sc.Cols...)
+	rec.Vals = append(rec.Vals[:0], vals...)
+}
 
-	for i := sc.tdef.PKeys; i < len(sc.tdef.Cols); i++ {
-		values[i].Type = sc.tdef.Types[i]
+// decode the current row, only the index columns if covered
+func (sc *Scanner) deref(rec *Record) {
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	if sc.index >= 0 {
+		// decode the primary key from the index entry, then fetch the row
+		pk := Record{Cols: tdef.Cols[:tdef.PKeys:tdef.PKeys], Vals: make([]Value, tdef.PKeys)}
+		cols := tdef.Indexes[sc.index]
+		ivals := make([]Value, len(cols))
+		for i, col := range cols {
+			ivals[i].Type = tdef.Types[colIndex(tdef, col)]
+		}
+		decodeCols(key[4:], ivals, nullableCols(tdef, cols))
+		if isUnique(tdef, sc.index) {
+			for i := range pk.Vals {
+				pk.Vals[i].Type = tdef.Types[i]
+			}
+			decodeValues(val, pk.Vals)
+		} else {
+			for i, col := range cols {
+				if idx := colIndex(tdef, col); idx < tdef.PKeys {
+					pk.Vals[idx] = ivals[i]
+				}
+			}
+		}
+		if sc.covered {
+			rec.Cols = append(rec.Cols[:0], pk.Cols...)
+			rec.Vals = append(rec.Vals[:0], pk.Vals...)
+			for i, col := range cols {
+				if colIndex(tdef, col) >= tdef.PKeys {
+					rec.Cols = append(rec.Cols, col)
+					rec.Vals = append(rec.Vals, ivals[i])
+				}
+			}
+			return
+		}
+		ok, err := dbGet(sc.db, tdef, &pk)
+		Assert(ok && err == nil) // the index is consistent with the table
+		rec.Cols = append(rec.Cols[:0], pk.Cols...)
+		rec.Vals = append(rec.Vals[:0], pk.Vals...)
+		return
 	}
-	decodeValues(val, values[sc.tdef.PKeys:])
-	rec.Cols = append(rec.Cols, sc.tdef.Cols[sc.tdef.PKeys:]...)
-	rec.Vals = append(rec.Vals, values[sc.tdef.PKeys:]...)
+	values := make([]Value, len(tdef.Cols))
+	for i := range values {
+		values[i].Type = tdef.Types[i]
+	}
+	decodeValues(key[4:], values[:tdef.PKeys]) // skip the prefix
+	decodeRow(tdef, val, values)
+	rec.Cols = append(rec.Cols[:0], tdef.Cols...)
+	rec.Vals = append(rec.Vals[:0], values...)
 }
 func (db *DB) Scan(table string, req *Scanner) error {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return fmt.Errorf("table not found: %s", table)
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return dbScan(db, tdef, req)
 }
 func dbScan(db *DB, tdef *TableDef, req *Scanner) error {
+	// the index is picked by the columns of the longer key,
+	// the other key has a prefix of them.
+	keys := req.Key1.Cols
+	if len(req.Key2.Cols) > len(keys) {
+		keys = req.Key2.Cols
+	}
+	return dbScanIndex(db, tdef, req, findIndex(tdef, keys))
+}
+
+// scan with the given index, -1 for the primary key
+func dbScanIndex(db *DB, tdef *TableDef, req *Scanner, index int) error {
 	// sanity checks
 	switch {
 	case req.Cmp1 > 0 && req.Cmp2 < 0:
 	case req.Cmp2 > 0 && req.Cmp1 < 0:
 	default:
-		return fmt.Errorf("bad range")
+		return fmt.Errorf("%w: bad range", ErrBadScan)
+	}
+	req.db, req.tdef = db, tdef
+	req.rec, req.err = Record{}, nil
+	req.index = index
+	if err := scanCheckCols(tdef, req); err != nil {
+		return err
+	}
+	cols := tdef.Cols[:tdef.PKeys]
+	if req.index >= 0 {
+		cols = tdef.Indexes[req.index]
 	}
-	values1, err := checkRecord(tdef, req.Key1, tdef.PKeys)
+	values1, err := checkIndexRecord(tdef, cols, req.Key1)
 	if err != nil {
 		return err
 	}
-	values2, err := checkRecord(tdef, req.Key2, tdef.PKeys)
+	values2, err := checkIndexRecord(tdef, cols, req.Key2)
 	if err != nil {
 		return err
 	}
-	req.tdef = tdef
 	// seek to the start key
-	keyStart := encodeKey(nil, tdef.Prefix, values1[:tdef.PKeys])
-	req.keyEnd = encodeKey(nil, tdef.Prefix, values2[:tdef.PKeys])
-	req.iter = db.kv.GetTree().Seek(keyStart, req.Cmp1)
+	keyStart, cmpStart := scanBound(tdef, req.index, values1, req.Cmp1)
+	req.keyEnd, req.cmpEnd = scanBound(tdef, req.index, values2, req.Cmp2)
+	req.iter = db.kv.GetTree().Seek(keyStart, cmpStart)
+	req.skip()
+	return nil
+}
+
+// encode a bound of the range from a key prefix, the missing columns match
+// any value. a missing bound is the start or the end of the table or index.
+func scanBound(tdef *TableDef, index int, values []Value, cmp int) ([]byte, int) {
+	prefix, cols, ncols := tdef.Prefix, tdef.Cols[:tdef.PKeys], tdef.PKeys
+	if index >= 0 {
+		prefix, cols, ncols = tdef.IndexPrefixes[index], tdef.Indexes[index], indexKeyCols(tdef, index, values)
+	}
+	if len(values) == 0 {
+		// inclusive, so that the bound covers every key of the prefix
+		cmp = map[int]int{CMP_GT: CMP_GE, CMP_GE: CMP_GE, CMP_LT: CMP_LE, CMP_LE: CMP_LE}[cmp]
+	}
+	return encodeKeyPartial(nil, prefix, values, nullableCols(tdef, cols[:len(values)]), ncols, cmp)
+}
+
+// check the columns of the filter and the projection, and see if
+// the index covers them.
+func scanCheckCols(tdef *TableDef, req *Scanner) error {
+	needed := slices.Clone(req.Cols)
+	if req.Filter != nil {
+		needed = qlColumns(req.Filter, needed)
+	}
+	req.covered = req.index >= 0 && len(req.Cols) > 0
+	for _, col := range needed {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return fmt.Errorf("%w: unknown column: %s", ErrBadScan, col)
+		}
+		if req.covered && idx >= tdef.PKeys && !slices.Contains(tdef.Indexes[req.index], col) {
+			req.covered = false
+		}
+	}
+	return nil
+}
+
+// the number of columns in the keys of an index, a unique key with
+// a NULL has the primary key appended, see encodeIndexKey.
+func indexKeyCols(tdef *TableDef, idx int, values []Value) int {
+	n := len(tdef.Indexes[idx])
+	if !isUnique(tdef, idx) {
+		return n
+	}
+	for _, val := range values {
+		if val.Type == TYPE_NULL {
+			return n + tdef.PKeys
+		}
+	}
+	return n
+}
+
+// pick the index for the key columns, -1 for the primary key.
+// the columns must be a prefix of the primary key or the index, in any order.
+func findIndex(tdef *TableDef, keys []string) int {
+	isPrefix := func(index []string) bool {
+		if len(keys) > len(index) {
+			return false
+		}
+		for _, col := range keys {
+			found := false
+			for _, name := range index[:len(keys)] {
+				found = found || name == col
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	if isPrefix(tdef.Cols[:tdef.PKeys]) {
+		return -1
+	}
+	for i, index := range tdef.Indexes {
+		if !isBuilding(tdef, i) && isPrefix(index) {
+			return i
+		}
+	}
+	return -1 // the primary key check will report the error
+}
+
+// the values of a prefix of the key or index columns, in that order
+func checkIndexRecord(tdef *TableDef, cols []string, rec Record) ([]Value, error) {
+	if len(rec.Cols) > len(cols) {
+		return nil, fmt.Errorf("%w length", ErrInvalidRecord)
+	}
+	values := make([]Value, len(rec.Cols))
+	for i := range values {
+		values[i] = *rec.Get(cols[i])
+		idx := colIndex(tdef, cols[i])
+		if values[i].Type == TYPE_NULL && isNullable(tdef, idx) {
+			continue
+		}
+		if values[i].Type != tdef.Types[idx] {
+			return nil, fmt.Errorf("%w: invalid key column: %s", ErrInvalidRecord, cols[i])
+		}
+	}
+	return values, nil
+}
+
+// encode a key prefix for range comparisons, the missing columns match
+// any value. a range that covers all the keys with the prefix uses the
+// prefix successor instead, the comparison is adjusted accordingly.
+func encodeKeyPartial(out []byte, prefix uint32, values []Value, nullable []bool, ncols int, cmp int) ([]byte, int) {
+	out = encodeCols(encodeKey(out, prefix, nil), values, nullable)
+	if len(values) == ncols || (cmp != CMP_GT && cmp != CMP_LE) {
+		return out, cmp
+	}
+	for out[len(out)-1] == 0xff {
+		out = out[:len(out)-1]
+	}
+	out[len(out)-1]++
+	if cmp == CMP_GT {
+		return out, CMP_GE
+	}
+	return out, CMP_LT
+}
+
+// iterate over every row of a table in primary key order
+func dbScanAll(db *DB, tdef *TableDef, fn func(rec *Record) bool) {
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	sc := Scanner{tdef: tdef, index: -1, iter: db.kv.GetTree().Seek(prefix, CMP_GE)}
+	for ; sc.iter.Valid(); sc.iter.Next() {
+		key, _ := sc.iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break // the next table
+		}
+		rec := Record{}
+		sc.Deref(&rec)
+		if !fn(&rec) {
+			break
+		}
+	}
+}
+func (db *DB) ScanAll(table string, fn func(rec *Record) bool) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	dbScanAll(db, tdef, fn)
 	return nil
 }
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Sequences.
+//
+// A sequence is a counter in @meta under "seq:" + name, like next_prefix.
+// To avoid a commit per value, SEQ_BATCH values are reserved at a time:
+// @meta stores the end of the reserved range, and the values are handed
+// out from memory. The unused values are given back on Close; a crash
+// leaves a gap, but a value is never handed out twice.
+//
+// A table with an AUTO_INCREMENT primary key uses the sequence named "@"
+// and the table name, which starts from 1. An inserted row without the
+// key gets the next value, and an explicit key moves the sequence past it.
+
+const SEQ_BATCH = 64 // the values reserved per commit
+
+var (
+	ErrSequenceNotFound = errors.New("sequence not found")
+	ErrSequenceExists   = errors.New("sequence exists")
+)
+
+// the values reserved in memory, from next to end (exclusive)
+type sequence struct {
+	next int64
+	end  int64
+}
+
+func seqKey(name string) *Record {
+	return (&Record{}).AddStr("key", []byte("seq:"+name))
+}
+
+// the stored value, the end of the reserved range
+func seqLoad(db *DB, name string) (int64, bool, error) {
+	rec := seqKey(name)
+	ok, err := dbGet(db, TDEF_META, rec)
+	if !ok || err != nil {
+		return 0, false, err
+	}
+	return int64(binary.BigEndian.Uint64(rec.Get("val").Str)), true, nil
+}
+func seqStore(db *DB, name string, val int64) error {
+	rec := seqKey(name).AddStr("val", binary.BigEndian.AppendUint64(nil, uint64(val)))
+	_, err := dbUpdate(db, TDEF_META, *rec, 0)
+	return err
+}
+
+// the cached sequence, the missing one starts from 1 if create
+func seqGet(db *DB, name string, create bool) (*sequence, error) {
+	if seq := db.seqs[name]; seq != nil {
+		return seq, nil
+	}
+	val, ok, err := seqLoad(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && !create {
+		return nil, fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	if !ok {
+		val = 1
+	}
+	seq := &sequence{next: val, end: val}
+	if db.seqs == nil {
+		db.seqs = map[string]*sequence{}
+	}
+	db.seqs[name] = seq
+	return seq, nil
+}
+
+// hand out the next value, reserving a new batch if needed
+func seqNext(db *DB, name string, create bool) (int64, error) {
+	seq, err := seqGet(db, name, create)
+	if err != nil {
+		return 0, err
+	}
+	if seq.next == math.MaxInt64 {
+		return 0, fmt.Errorf("sequence exhausted: %s", name)
+	}
+	if seq.next == seq.end {
+		end := seq.end + min(SEQ_BATCH, math.MaxInt64-seq.end)
+		if err := seqStore(db, name, end); err != nil {
+			return 0, err
+		}
+		seq.end = end
+	}
+	seq.next++
+	return seq.next - 1, nil
+}
+
+// hand out only the values greater than val from now on
+func seqAdvance(db *DB, name string, val int64) error {
+	seq, err := seqGet(db, name, true)
+	if err != nil || val < seq.next {
+		return err
+	}
+	if val == math.MaxInt64 {
+		seq.next = val
+	} else {
+		seq.next = val + 1
+	}
+	if seq.next > seq.end {
+		end := seq.next + min(SEQ_BATCH, math.MaxInt64-seq.next)
+		if err := seqStore(db, name, end); err != nil {
+			return err
+		}
+		seq.end = end
+	}
+	return nil
+}
+
+// remove a sequence, the cached one included
+func seqDrop(db *DB, name string) (bool, error) {
+	delete(db.seqs, name)
+	return dbDelete(db, TDEF_META, *seqKey(name))
+}
+
+// give back the unused reserved values
+func seqFlush(db *DB) error {
+	for name, seq := range db.seqs {
+		if seq.next < seq.end {
+			if err := seqStore(db, name, seq.next); err != nil {
+				return err
+			}
+		}
+	}
+	db.seqs = nil
+	return nil
+}
+
+// the names starting with @ are reserved for the tables
+func checkSeqName(name string) error {
+	if name == "" || name[0] == '@' {
+		return fmt.Errorf("bad sequence name: %q", name)
+	}
+	return nil
+}
+
+// create a sequence whose first value is start
+func (db *DB) CreateSequence(name string, start int64) error {
+	if err := checkSeqName(name); err != nil {
+		return err
+	}
+	_, ok, err := seqLoad(db, name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("%w: %s", ErrSequenceExists, name)
+	}
+	return seqStore(db, name, start)
+}
+
+// the next value of a sequence
+func (db *DB) NextVal(name string) (int64, error) {
+	if err := checkSeqName(name); err != nil {
+		return 0, err
+	}
+	return seqNext(db, name, false)
+}
+
+func (db *DB) DropSequence(name string) error {
+	if err := checkSeqName(name); err != nil {
+		return err
+	}
+	ok, err := seqDrop(db, name)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	return err
+}
+
+// the sequence of an AUTO_INCREMENT table
+func tableSeq(tdef *TableDef) string {
+	return "@" + tdef.Name
+}
+
+// assign the AUTO_INCREMENT key of a new row if it is missing, or move the
+// sequence past the given key. returns the key, 0 if the table has none.
+func autoIncrement(db *DB, tdef *TableDef, rec *Record) (int64, error) {
+	if !tdef.AutoIncrement {
+		return 0, nil
+	}
+	col := tdef.Cols[0]
+	if val := rec.Get(col); val.Type != TYPE_ERROR && val.Type != TYPE_NULL {
+		if val.Type != TYPE_INT64 {
+			return 0, fmt.Errorf("bad key column: %s", col)
+		}
+		return val.I64, seqAdvance(db, tableSeq(tdef), val.I64)
+	}
+	id, err := seqNext(db, tableSeq(tdef), true)
+	if err != nil {
+		return 0, err
+	}
+	// the caller's record is not modified
+	out := Record{}
+	for i := range rec.Cols {
+		if rec.Cols[i] != col {
+			out.Cols = append(out.Cols, rec.Cols[i])
+			out.Vals = append(out.Vals, rec.Vals[i])
+		}
+	}
+	*rec = *out.AddInt64(col, id)
+	return id, nil
+}
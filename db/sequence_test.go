@@ -0,0 +1,141 @@
+package db
+
+import (
+	"os"
+	. "server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequence(t *testing.T) {
+	os.Remove("test_seq.db")
+	defer os.Remove("test_seq.db")
+	db := &DB{Path: "test_seq.db"}
+	assert.NoError(t, db.Open())
+
+	assert.NoError(t, db.CreateSequence("s", 10))
+	assert.ErrorIs(t, db.CreateSequence("s", 1), ErrSequenceExists)
+	assert.Error(t, db.CreateSequence("@s", 1))
+	_, err := db.NextVal("nope")
+	assert.ErrorIs(t, err, ErrSequenceNotFound)
+	for i := 0; i < 100; i++ {
+		id, err := db.NextVal("s")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10+i), id)
+	}
+	// a batch is reserved per commit
+	end, _, _ := seqLoad(db, "s")
+	assert.Equal(t, int64(10+2*SEQ_BATCH), end)
+
+	// the unused values are given back on close
+	db.Close()
+	assert.NoError(t, db.Open())
+	id, err := db.NextVal("s")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), id)
+
+	// a crash skips the reserved values, but never reuses them
+	db.kv.Close()
+	db = &DB{Path: "test_seq.db"}
+	assert.NoError(t, db.Open())
+	id, err = db.NextVal("s")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(111+SEQ_BATCH-1), id)
+
+	assert.NoError(t, db.DropSequence("s"))
+	assert.ErrorIs(t, db.DropSequence("s"), ErrSequenceNotFound)
+	_, err = db.NextVal("s")
+	assert.ErrorIs(t, err, ErrSequenceNotFound)
+	db.Close()
+}
+
+func TestAutoIncrement(t *testing.T) {
+	os.Remove("test_auto.db")
+	defer os.Remove("test_auto.db")
+	db := &DB{Path: "test_auto.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	bad := &TableDef{
+		Name: "bad", Cols: []string{"id", "k"}, Types: []uint32{TYPE_BYTES, TYPE_INT64},
+		PKeys: 1, AutoIncrement: true,
+	}
+	assert.Error(t, db.TableNew(bad))
+	bad.Types, bad.PKeys = []uint32{TYPE_INT64, TYPE_INT64}, 2
+	assert.Error(t, db.TableNew(bad))
+
+	tdef := &TableDef{
+		Name: "t", Cols: []string{"id", "name"}, Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		PKeys: 1, AutoIncrement: true,
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	rec := (&Record{}).AddStr("name", []byte("a"))
+	id, err := db.Insert("t", *rec)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), id)
+	assert.Equal(t, []string{"name"}, rec.Cols)
+	id, _ = db.Insert("t", *(&Record{}).AddStr("name", []byte("b")))
+	assert.Equal(t, int64(2), id)
+
+	// an explicit key moves the sequence past it
+	id, err = db.Insert("t", *(&Record{}).AddInt64("id", 10).AddStr("name", []byte("c")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), id)
+	_, err = db.Upsert("t", *(&Record{}).AddStr("name", []byte("d")))
+	assert.NoError(t, err)
+	got := (&Record{}).AddInt64("id", 11)
+	ok, _ := db.Get("t", got)
+	assert.True(t, ok)
+	assert.Equal(t, "d", string(got.Get("name").Str))
+	_, err = db.Insert("t", *(&Record{}).AddInt64("id", 1).AddStr("name", []byte("e")))
+	assert.ErrorIs(t, err, ErrKeyExist)
+	// a batch is reserved past an explicit key, each store moves the end
+	stores := 0
+	end, _, _ := seqLoad(db, tableSeq(tdef))
+	for i := int64(100); i < 100+2*SEQ_BATCH; i++ {
+		_, err = db.Insert("t", *(&Record{}).AddInt64("id", i).AddStr("name", []byte("f")))
+		assert.NoError(t, err)
+		if now, _, _ := seqLoad(db, tableSeq(tdef)); now != end {
+			stores, end = stores+1, now
+		}
+	}
+	assert.Equal(t, 2, stores)
+	id, _ = db.Insert("t", *(&Record{}).AddStr("name", []byte("g")))
+	assert.Equal(t, int64(100+2*SEQ_BATCH), id)
+	// not for the updates
+	_, err = db.Update("t", *(&Record{}).AddStr("name", []byte("x")))
+	assert.Error(t, err)
+
+	// truncate starts over, drop removes the sequence
+	assert.NoError(t, db.TruncateTable("t"))
+	id, _ = db.Insert("t", *(&Record{}).AddStr("name", []byte("a")))
+	assert.Equal(t, int64(1), id)
+	assert.NoError(t, db.DropTable("t"))
+	_, ok, _ = seqLoad(db, tableSeq(tdef))
+	assert.False(t, ok)
+
+	// SQL
+	exec := func(sql string) QLResult {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res
+	}
+	exec("create table u (name bytes, id int64 auto_increment primary key)")
+	assert.Equal(t, []string{"id", "name"}, getTableDef(db, "u").Cols)
+	res := exec("insert into u (name) values ('a'), ('b')")
+	assert.Equal(t, 2, res.Updated)
+	assert.Equal(t, int64(2), res.LastID)
+	res = exec("insert into u values (7, 'c')")
+	assert.Equal(t, int64(7), res.LastID)
+	res = exec("insert into u (name) values ('d')")
+	assert.Equal(t, int64(8), res.LastID)
+	for _, bad := range []string{
+		"create table v (id int64 primary key, n int64 auto_increment)",
+		"create table v (id bytes auto_increment)",
+		"alter table u add n int64 auto_increment",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
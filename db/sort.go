@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// Sorting.
+//
+// The records are sorted by a key encoded like an index key, so that the
+// byte order is the sort order; a descending column has its bytes
+// inverted. NULLs come first, or last when descending. The records are
+// buffered in memory up to a budget, then sorted and spilled to a
+// temporary file as a run. The runs are merged at the end. Equal keys keep
+// the order they are added in.
+//
+// With a LIMIT, only the first OFFSET+LIMIT records of the buffer and of
+// each run are ever needed, so the buffer is cut down to that whenever it
+// doubles, and nothing is spilled if that many records fit in memory.
+
+const SORT_MEMORY = 16 << 20 // the default memory budget in bytes
+
+// a column of the sort order
+type SortKey struct {
+	Col  string
+	Desc bool
+}
+
+// sort records with the same columns, spilling to disk if needed.
+// a Sorter is used once: Add the records, then Sort.
+type Sorter struct {
+	Keys   []SortKey
+	Offset int    // skip the first rows
+	Limit  int    // 0 for no limit
+	Memory int    // the memory budget, SORT_MEMORY by default
+	Dir    string // for the temporary files, os.TempDir() by default
+	// internal
+	cols []string
+	buf  []sortRow
+	size int        // the estimated memory of buf
+	runs []*os.File // the sorted runs on disk
+}
+
+// a record with its sort key, only the values are kept
+type sortRow struct {
+	Key  []byte
+	Vals []Value
+}
+
+func (row *sortRow) size() int {
+	n := len(row.Key) + 64
+	for _, val := range row.Vals {
+		n += 40 + len(val.Str)
+	}
+	return n
+}
+
+func sortKey(keys []SortKey, rec *Record) ([]byte, error) {
+	var out []byte
+	for _, k := range keys {
+		val := rec.Get(k.Col)
+		if val.Type == TYPE_ERROR {
+			return nil, fmt.Errorf("unknown column: %s", k.Col)
+		}
+		start := len(out)
+		out = encodeCols(out, []Value{*val}, []bool{true})
+		if k.Desc {
+			for i := start; i < len(out); i++ {
+				out[i] = ^out[i]
+			}
+		}
+	}
+	return out, nil
+}
+
+// the number of records needed for the output, 0 for all
+func (s *Sorter) keep() int {
+	if s.Limit <= 0 {
+		return 0
+	}
+	return s.Offset + s.Limit
+}
+
+func (s *Sorter) Add(rec Record) error {
+	if s.cols == nil {
+		s.cols = slices.Clone(rec.Cols)
+	} else if !slices.Equal(s.cols, rec.Cols) {
+		return errors.New("the sorted records have different columns")
+	}
+	key, err := sortKey(s.Keys, &rec)
+	if err != nil {
+		return err
+	}
+	row := sortRow{Key: key, Vals: rec.Vals}
+	s.buf = append(s.buf, row)
+	s.size += row.size()
+	// top-N: keep the first N rows
+	if n := s.keep(); n > 0 && len(s.buf) >= 2*n {
+		s.sortBuf()
+		s.buf = s.buf[:n]
+		s.size = 0
+		for i := range s.buf {
+			s.size += s.buf[i].size()
+		}
+	}
+	memory := s.Memory
+	if memory <= 0 {
+		memory = SORT_MEMORY
+	}
+	if s.size > memory {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *Sorter) sortBuf() {
+	slices.SortStableFunc(s.buf, func(a, b sortRow) int {
+		return bytes.Compare(a.Key, b.Key)
+	})
+}
+
+// write the buffer as a sorted run
+func (s *Sorter) spill() error {
+	s.sortBuf()
+	if n := s.keep(); n > 0 && len(s.buf) > n {
+		s.buf = s.buf[:n]
+	}
+	fp, err := os.CreateTemp(s.Dir, "sort-*")
+	if err != nil {
+		return err
+	}
+	os.Remove(fp.Name()) // the space is freed on close
+	s.runs = append(s.runs, fp)
+	w := bufio.NewWriter(fp)
+	enc := gob.NewEncoder(w)
+	for i := range s.buf {
+		if err := enc.Encode(&s.buf[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.buf, s.size = nil, 0
+	_, err = fp.Seek(0, io.SeekStart)
+	return err
+}
+
+// a source of sorted rows for the merge
+type sortRun struct {
+	row  sortRow
+	idx  int // the order of the runs, for equal keys
+	next func() (sortRow, bool, error)
+}
+
+type sortHeap []*sortRun
+
+func (h sortHeap) Len() int { return len(h) }
+func (h sortHeap) Less(i, j int) bool {
+	if r := bytes.Compare(h[i].row.Key, h[j].row.Key); r != 0 {
+		return r < 0
+	}
+	return h[i].idx < h[j].idx
+}
+func (h sortHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *sortHeap) Push(x any)   { *h = append(*h, x.(*sortRun)) }
+func (h *sortHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// iterate over the sorted records after the offset and up to the limit.
+// the temporary files are removed.
+func (s *Sorter) Sort(fn func(rec *Record) bool) error {
+	defer s.Close()
+	s.sortBuf()
+	sources := []func() (sortRow, bool, error){}
+	for _, fp := range s.runs {
+		dec := gob.NewDecoder(bufio.NewReader(fp))
+		sources = append(sources, func() (sortRow, bool, error) {
+			row := sortRow{}
+			err := dec.Decode(&row)
+			if err == io.EOF {
+				return row, false, nil
+			}
+			return row, err == nil, err
+		})
+	}
+	buf := s.buf
+	sources = append(sources, func() (sortRow, bool, error) {
+		if len(buf) == 0 {
+			return sortRow{}, false, nil
+		}
+		row := buf[0]
+		buf = buf[1:]
+		return row, true, nil
+	})
+	// k-way merge
+	h := sortHeap{}
+	for i, next := range sources {
+		row, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, &sortRun{row: row, idx: i, next: next})
+		}
+	}
+	heap.Init(&h)
+	skip, count := s.Offset, 0
+	for h.Len() > 0 && (s.Limit <= 0 || count < s.Limit) {
+		run := h[0]
+		if skip > 0 {
+			skip--
+		} else {
+			count++
+			rec := Record{Cols: slices.Clone(s.cols), Vals: run.row.Vals}
+			if !fn(&rec) {
+				return nil
+			}
+		}
+		row, ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			run.row = row
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// remove the temporary files
+func (s *Sorter) Close() {
+	for _, fp := range s.runs {
+		fp.Close()
+	}
+	s.runs, s.buf, s.size = nil, nil, 0
+}
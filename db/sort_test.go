@@ -0,0 +1,138 @@
+package db
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSorter(t *testing.T) {
+	n := 5000
+	recs := []Record{}
+	for i := 0; i < n; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddInt64("k", int64(rand.Intn(100)))
+		if i%10 == 0 {
+			rec.AddNull("s")
+		} else {
+			rec.AddStr("s", []byte{byte(rand.Intn(26)) + 'a'})
+		}
+		recs = append(recs, *rec)
+	}
+	// by s descending, then k, then the insertion order
+	less := func(a, b *Record) int {
+		sa, sb := a.Get("s"), b.Get("s")
+		switch {
+		case sa.Type == TYPE_NULL && sb.Type != TYPE_NULL:
+			return +1
+		case sa.Type != TYPE_NULL && sb.Type == TYPE_NULL:
+			return -1
+		case string(sa.Str) != string(sb.Str):
+			return -bytes.Compare(sa.Str, sb.Str)
+		}
+		return int(a.Get("k").I64 - b.Get("k").I64)
+	}
+	expected := slices.Clone(recs)
+	slices.SortStableFunc(expected, func(a, b Record) int { return less(&a, &b) })
+	keys := []SortKey{{Col: "s", Desc: true}, {Col: "k"}}
+
+	sorted := func(s *Sorter) ([]Record, int) {
+		for _, rec := range recs {
+			assert.NoError(t, s.Add(rec))
+		}
+		runs := len(s.runs)
+		out := []Record{}
+		assert.NoError(t, s.Sort(func(rec *Record) bool {
+			out = append(out, *rec)
+			return true
+		}))
+		return out, runs
+	}
+	ids := func(recs []Record) []int64 {
+		out := []int64{}
+		for _, rec := range recs {
+			out = append(out, rec.Get("id").I64)
+		}
+		return out
+	}
+
+	// in memory
+	out, runs := sorted(&Sorter{Keys: keys})
+	assert.Equal(t, 0, runs)
+	assert.Equal(t, ids(expected), ids(out))
+	assert.Equal(t, []string{"id", "k", "s"}, out[0].Cols)
+
+	// spilled to disk
+	dir := t.TempDir()
+	out, runs = sorted(&Sorter{Keys: keys, Memory: 32 << 10, Dir: dir})
+	assert.Greater(t, runs, 4)
+	assert.Equal(t, ids(expected), ids(out))
+	assert.Equal(t, expected[n-1], out[n-1])
+	files, _ := os.ReadDir(dir)
+	assert.Empty(t, files)
+
+	// top-N
+	out, runs = sorted(&Sorter{Keys: keys, Offset: 10, Limit: 20, Memory: 32 << 10})
+	assert.Equal(t, 0, runs)
+	assert.Equal(t, ids(expected[10:30]), ids(out))
+	out, runs = sorted(&Sorter{Keys: keys, Offset: 100, Limit: 1000, Memory: 32 << 10, Dir: dir})
+	assert.Greater(t, runs, 0)
+	assert.Equal(t, ids(expected[100:1100]), ids(out))
+
+	s := &Sorter{Keys: []SortKey{{Col: "nope"}}}
+	assert.Error(t, s.Add(recs[0]))
+}
+
+func TestOrderBySQL(t *testing.T) {
+	os.Remove("test_order.db")
+	defer os.Remove("test_order.db")
+	db := &DB{Path: "test_order.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	exec("create table t (id int64, name bytes, score int64 null, primary key (id))")
+	exec("insert into t values (1, 'a', 30), (2, 'b', 10), (3, 'c', null), (4, 'd', 20), (5, 'e', 10)")
+	ids := func(sql string) []int64 {
+		out := []int64{}
+		for _, rec := range exec(sql) {
+			out = append(out, rec.Get("id").I64)
+		}
+		return out
+	}
+	assert.Equal(t, []int64{3, 2, 5, 4, 1}, ids("select id from t order by score"))
+	assert.Equal(t, []int64{1, 4, 5, 2, 3}, ids("select id from t order by score desc, id desc"))
+	assert.Equal(t, []int64{5, 4}, ids("select id from t order by score asc limit 2 offset 2"))
+	assert.Equal(t, []int64{2, 3}, ids("select id from t limit 2 offset 1"))
+	assert.Equal(t, []int64{}, ids("select id from t order by id limit 0"))
+	assert.Equal(t, []int64{5, 4}, ids("select id from t where id > 3 order by 0 - id"))
+	// by an output name, the hidden sort columns are dropped
+	res := exec("select id, score * 2 as s from t where score is not null order by s desc limit 1")
+	assert.Equal(t, []string{"id", "s"}, res[0].Cols)
+	assert.Equal(t, int64(60), res[0].Get("s").I64)
+	// with aggregates
+	res = exec("select score, count(*) as n from t group by score order by n desc, score limit 2")
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, int64(10), res[0].Get("score").I64)
+	assert.Equal(t, int64(2), res[0].Get("n").I64)
+	assert.Equal(t, "NULL", FormatValue(res[1].Get("score")))
+	res = exec("select score from t group by score order by count(*), score desc")
+	assert.Equal(t, int64(30), res[0].Get("score").I64)
+
+	for _, bad := range []string{
+		"select id from t order by nope",
+		"select id from t limit -1",
+		"select id from t limit 'x'",
+		"select score from t group by score order by id",
+	} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	. "types"
+	. "utils"
+)
+
+// Table statistics.
+//
+// ANALYZE walks the key range of a table to count the rows, and keeps a
+// uniform sample of STATS_SAMPLE rows by reservoir sampling; only the
+// sampled rows are decoded. For each column, the sample gives the fraction
+// of NULLs, an estimate of the distinct values, and an equi-depth
+// histogram: the values at every 1/STATS_BUCKETS of the sorted sample.
+//
+// The statistics are stored in @meta under "stats:" + table. They are not
+// maintained by the writes, so they get stale until the next ANALYZE.
+
+const (
+	STATS_SAMPLE  = 1000 // the sampled rows
+	STATS_BUCKETS = 32   // the buckets of a histogram
+)
+
+type TableStats struct {
+	Rows int64 // the number of rows when analyzed
+	Cols []ColumnStats
+}
+
+type ColumnStats struct {
+	Name     string
+	Nulls    float64 // the fraction of NULLs
+	Distinct int64   // the estimated number of values other than NULL
+	// the histogram: the upper bounds of the buckets, in order,
+	// encoded with encodeValues. each bucket has the same number of rows.
+	Bounds [][]byte
+}
+
+func statsKey(table string) *Record {
+	return (&Record{}).AddStr("key", []byte("stats:"+table))
+}
+
+// the stored statistics, nil if the table was never analyzed
+func getTableStats(db *DB, tdef *TableDef) *TableStats {
+	if stats, ok := db.stats[tdef.Name]; ok {
+		return stats
+	}
+	var stats *TableStats
+	rec := statsKey(tdef.Name)
+	ok, err := dbGet(db, TDEF_META, rec)
+	Assert(err == nil)
+	if ok {
+		stats = &TableStats{}
+		Assert(json.Unmarshal(rec.Get("val").Str, stats) == nil)
+	}
+	if db.stats == nil {
+		db.stats = map[string]*TableStats{}
+	}
+	db.stats[tdef.Name] = stats
+	return stats
+}
+
+// gather and store the statistics of a table
+func (db *DB) Analyze(table string) (*TableStats, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	rng := rand.New(rand.NewSource(1)) // repeatable
+	sample := [][]Value{}
+	count := int64(0)
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	for iter := db.kv.GetTree().Seek(prefix, CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break // the next table
+		}
+		count++
+		slot := len(sample)
+		if slot >= STATS_SAMPLE {
+			if slot = int(rng.Int63n(count)); slot >= STATS_SAMPLE {
+				continue
+			}
+		}
+		values := make([]Value, len(tdef.Cols))
+		for i := range values {
+			values[i].Type = tdef.Types[i]
+		}
+		decodeValues(key[4:], values[:tdef.PKeys])
+		decodeRow(tdef, val, values)
+		if slot == len(sample) {
+			sample = append(sample, values)
+		} else {
+			sample[slot] = values
+		}
+	}
+
+	stats := &TableStats{Rows: count}
+	for i, col := range tdef.Cols {
+		stats.Cols = append(stats.Cols, columnStats(col, sample, i, count))
+	}
+	data, err := json.Marshal(stats)
+	Assert(err == nil)
+	rec := statsKey(table).AddStr("val", data)
+	if _, err := dbUpdate(db, TDEF_META, *rec, 0); err != nil {
+		return nil, err
+	}
+	if db.stats == nil {
+		db.stats = map[string]*TableStats{}
+	}
+	db.stats[table] = stats
+	return stats, nil
+}
+
+// the statistics of a column from the sample of the rows
+func columnStats(name string, sample [][]Value, col int, rows int64) ColumnStats {
+	out := ColumnStats{Name: name}
+	keys := [][]byte{}
+	for _, row := range sample {
+		if row[col].Type != TYPE_NULL {
+			keys = append(keys, encodeValues(nil, row[col:col+1]))
+		}
+	}
+	if len(sample) > 0 {
+		out.Nulls = 1 - float64(len(keys))/float64(len(sample))
+	}
+	if len(keys) == 0 {
+		return out
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	// the values by the number of occurrences
+	freq := map[int]int64{}
+	for i, j := 0, 0; i < len(keys); i = j {
+		for j = i; j < len(keys) && bytes.Equal(keys[i], keys[j]); j++ {
+		}
+		freq[j-i]++
+	}
+	out.Distinct = estimateDistinct(freq, len(keys), float64(rows)*(1-out.Nulls))
+	buckets := min(STATS_BUCKETS, len(keys))
+	for i := 0; i < buckets; i++ {
+		out.Bounds = append(out.Bounds, keys[(i+1)*len(keys)/buckets-1])
+	}
+	return out
+}
+
+// the GEE estimator of the distinct values of n rows from a sample of
+// size s: the values seen once are scaled by sqrt(n/s), the others are
+// counted once. freq[j] is the number of values seen j times.
+func estimateDistinct(freq map[int]int64, s int, n float64) int64 {
+	d := 0.0
+	for j, f := range freq {
+		if j == 1 {
+			d += math.Sqrt(max(n/float64(s), 1)) * float64(f)
+		} else {
+			d += float64(f)
+		}
+	}
+	return int64(math.Round(min(d, max(n, 1))))
+}
+
+// the statistics of a column, nil if unknown
+func (s *TableStats) column(col string) *ColumnStats {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Cols {
+		if s.Cols[i].Name == col {
+			return &s.Cols[i]
+		}
+	}
+	return nil
+}
+
+// the estimated fraction of the rows with col = val
+func (s *TableStats) eqSel(col string) float64 {
+	c := s.column(col)
+	if c == nil {
+		return PLAN_EQ_SEL
+	}
+	if c.Distinct == 0 {
+		return 0
+	}
+	return (1 - c.Nulls) / float64(c.Distinct)
+}
+
+// the estimated fraction of the rows with col within the bounds,
+// a nil bound is open
+func (s *TableStats) rangeSel(col string, lo *Value, cmp1 int, hi *Value, cmp2 int) float64 {
+	c := s.column(col)
+	if c == nil || len(c.Bounds) == 0 {
+		if c != nil {
+			return 0 // all NULL
+		}
+		return PLAN_RANGE_SEL
+	}
+	// the fraction of the buckets below a value, or up to it
+	below := func(val *Value, inclusive bool) float64 {
+		key := encodeValues(nil, []Value{*val})
+		n := 0
+		for _, bound := range c.Bounds {
+			if r := bytes.Compare(bound, key); r < 0 || (r == 0 && inclusive) {
+				n++
+			}
+		}
+		return float64(n) / float64(len(c.Bounds))
+	}
+	from, to := 0.0, 1.0
+	if lo != nil {
+		from = below(lo, cmp1 == CMP_GT)
+	}
+	if hi != nil {
+		to = below(hi, cmp2 == CMP_LE)
+	}
+	// at least half a bucket, the bounds are coarse
+	return (1 - c.Nulls) * max(to-from, 0.5/float64(len(c.Bounds)))
+}
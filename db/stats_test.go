@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyze(t *testing.T) {
+	os.Remove("test_stats.db")
+	defer os.Remove("test_stats.db")
+	db := &DB{Path: "test_stats.db"}
+	assert.NoError(t, db.Open())
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	exec("create table t (id int64, k int64, s bytes null, primary key (id), index (k))")
+	n := 5000
+	for i := 0; i < n; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddInt64("k", int64(i%50))
+		if i%5 == 0 {
+			rec.AddNull("s")
+		} else {
+			rec.AddStr("s", []byte{'a' + byte(i%3)})
+		}
+		_, err := db.Insert("t", *rec)
+		assert.NoError(t, err)
+	}
+	explain := func(sql string) (string, string, string) {
+		rows := exec("explain " + sql)
+		assert.Equal(t, 1, len(rows))
+		return string(rows[0].Get("access").Str), string(rows[0].Get("index").Str), string(rows[0].Get("key").Str)
+	}
+
+	// without statistics
+	access, index, key := explain("select * from t where id = 7")
+	assert.Equal(t, PLAN_LOOKUP, access)
+	assert.Equal(t, "id = 7", key)
+	access, index, _ = explain("select * from t where k = 3")
+	assert.Equal(t, PLAN_INDEX_RANGE, access)
+	assert.Equal(t, "(k, id)", index)
+	access, _, _ = explain("select * from t where s = 'a'")
+	assert.Equal(t, PLAN_FULL_SCAN, access)
+
+	exec("analyze t")
+	stats := getTableStats(db, getTableDef(db, "t"))
+	assert.Equal(t, int64(n), stats.Rows)
+	assert.Equal(t, int64(50), stats.column("k").Distinct)
+	assert.Equal(t, int64(3), stats.column("s").Distinct)
+	assert.InDelta(t, 0.2, stats.column("s").Nulls, 0.05)
+	assert.Greater(t, stats.column("id").Distinct, int64(1000))
+	assert.Equal(t, STATS_BUCKETS, len(stats.column("id").Bounds))
+	assert.InDelta(t, 0.02, stats.eqSel("k"), 0.001)
+	v := Value{Type: TYPE_INT64, I64: 1000}
+	assert.InDelta(t, 0.2, stats.rangeSel("id", nil, 0, &v, CMP_LT), 0.05)
+
+	// with statistics
+	access, _, key = explain("select * from t where k = 3")
+	assert.Equal(t, PLAN_INDEX_RANGE, access)
+	assert.Equal(t, "k = 3", key)
+	access, _, _ = explain("select * from t where k > 3")
+	assert.Equal(t, PLAN_FULL_SCAN, access)
+	access, _, key = explain("delete from t where id > 4990 and id <= 4995 and k > 3")
+	assert.Equal(t, PLAN_PKEY_RANGE, access)
+	assert.Equal(t, "id > 4990 AND id <= 4995", key)
+	access, _, key = explain("update t set s = 'x' where id >= 10 and k = 3")
+	assert.Equal(t, PLAN_INDEX_RANGE, access)
+	assert.Equal(t, "k = 3 AND id >= 10", key)
+	rows := exec("explain select * from t where id < 1000")
+	assert.InDelta(t, 1000, rows[0].Get("rows").I64, 250)
+
+	// the same rows by any path
+	assert.Equal(t, 99, len(exec("select id from t where id >= 10 and k = 3")))
+	assert.Equal(t, 5, len(exec("select id from t where id > 4990 and id <= 4995 and k > 3")))
+	assert.Equal(t, 4600, len(exec("select id from t where k > 3")))
+
+	// kept in @meta, gone with the table
+	db.Close()
+	db = &DB{Path: "test_stats.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, int64(n), getTableStats(db, getTableDef(db, "t")).Rows)
+	assert.NoError(t, db.TruncateTable("t"))
+	assert.Nil(t, getTableStats(db, getTableDef(db, "t")))
+	exec("analyze table t")
+	assert.Equal(t, int64(0), getTableStats(db, getTableDef(db, "t")).Rows)
+	assert.NoError(t, db.DropTable("t"))
+	ok, _ := dbGet(db, TDEF_META, statsKey("t"))
+	assert.False(t, ok)
+
+	for _, bad := range []string{"analyze nope", "explain select * from nope", "explain insert into t values (1)"} {
+		_, err := db.ExecSQL(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestExplainIndex(t *testing.T) {
+	os.Remove("test_explain.db")
+	defer os.Remove("test_explain.db")
+	db := &DB{Path: "test_explain.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	exec := func(sql string) []Record {
+		res, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+		return res.Records
+	}
+	exec("create table t (id int64, c int64, d int64, primary key (id), index (c, d), unique index (c))")
+	for i := 0; i < 10; i++ {
+		exec(fmt.Sprintf("insert into t values (%d, %d, %d)", i, i, i%3))
+	}
+
+	// the scan uses the index shown by EXPLAIN, not the first one
+	// with the key columns
+	rows := exec("explain select * from t where c = 4")
+	assert.Equal(t, PLAN_INDEX_RANGE, string(rows[0].Get("access").Str))
+	tdef := getTableDef(db, "t")
+	filter, err := ParseExpr("c = 4")
+	assert.NoError(t, err)
+	sc, err := qlPlanScanner(db, tdef, qlPlanScan(db, tdef, filter), filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sc.index)
+	assert.Equal(t, string(rows[0].Get("index").Str), "("+strings.Join(tdef.Indexes[sc.index], ", ")+")")
+	assert.Equal(t, 1, len(exec("select id from t where c = 4")))
+}
+
+func TestAnalyzeAlter(t *testing.T) {
+	os.Remove("test_stats_alter.db")
+	defer os.Remove("test_stats_alter.db")
+	db := &DB{Path: "test_stats_alter.db"}
+	assert.NoError(t, db.Open())
+
+	exec := func(sql string) {
+		_, err := db.ExecSQL(sql)
+		assert.NoError(t, err, sql)
+	}
+	exec("create table t (id int64, k int64, s bytes null, primary key (id))")
+	for i := 0; i < 100; i++ {
+		exec(fmt.Sprintf("insert into t values (%d, %d, null)", i, i%10))
+	}
+	exec("analyze t")
+
+	// the statistics follow the column, kept in the same commit
+	assert.NoError(t, db.RenameColumn("t", "k", "kk"))
+	assert.NoError(t, db.DropColumn("t", "s"))
+	assert.NoError(t, db.AddColumn("t", "s", TYPE_INT64, true, Value{}))
+	db.Close()
+	db = &DB{Path: "test_stats_alter.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	stats := getTableStats(db, getTableDef(db, "t"))
+	assert.Nil(t, stats.column("k"))
+	assert.Equal(t, int64(10), stats.column("kk").Distinct)
+	assert.Nil(t, stats.column("s"))
+	assert.Equal(t, int64(100), stats.Rows)
+}
@@ -0,0 +1,378 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Struct mapping.
+//
+// The exported fields of a struct map to the columns of a table. The tag
+// `db:"name,pk,auto"` gives the column name, the lowercased field name if
+// empty, and the options: pk for the primary key columns, in field order,
+// and auto for an AUTO_INCREMENT key. `db:"-"` skips a field.
+//
+// The field types are string and []byte for bytes, the signed and unsigned
+// integers for int64, float32 and float64, bool, and time.Time for
+// timestamps. A pointer to one of them is a nullable column, nil is NULL.
+//
+// An inserted struct whose AUTO_INCREMENT key is 0 gets the next value of
+// the sequence, which is stored back into the struct.
+
+var ErrNotStruct = errors.New("not a struct")
+
+// a mapped field of a struct
+type structField struct {
+	index    int    // of the field
+	col      string // the column name
+	typ      uint32 // TYPE_?
+	nullable bool   // a pointer
+	pk       bool
+	auto     bool
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// the column type of a field type, a pointer is nullable
+func structFieldType(t reflect.Type) (uint32, bool) {
+	nullable := t.Kind() == reflect.Pointer
+	if nullable {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return TYPE_TIMESTAMP, nullable
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return TYPE_BYTES, nullable
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return TYPE_BYTES, nullable
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return TYPE_INT64, nullable
+	case reflect.Float32, reflect.Float64:
+		return TYPE_FLOAT64, nullable
+	case reflect.Bool:
+		return TYPE_BOOL, nullable
+	}
+	return TYPE_ERROR, nullable
+}
+
+// the mapped fields of a struct type
+func structFields(t reflect.Type) ([]structField, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %s", ErrNotStruct, t)
+	}
+	fields := []structField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		sf := structField{index: i, col: name}
+		if sf.typ, sf.nullable = structFieldType(f.Type); sf.typ == TYPE_ERROR {
+			return nil, fmt.Errorf("bad field type: %s %s", f.Name, f.Type)
+		}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "":
+			case "pk":
+				sf.pk = true
+			case "auto":
+				sf.auto = true
+			default:
+				return nil, fmt.Errorf("bad tag option: %s %q", f.Name, opt)
+			}
+		}
+		if slices.ContainsFunc(fields, func(other structField) bool { return other.col == name }) {
+			return nil, fmt.Errorf("duplicate column: %s", name)
+		}
+		fields = append(fields, sf)
+	}
+	return fields, nil
+}
+
+// the struct value of v, a struct or a pointer to one
+func structValue(v any) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("%w: %T", ErrNotStruct, v)
+	}
+	return rv, nil
+}
+
+// derive a table definition from a struct, the primary key columns first
+func TableDefOf(name string, v any) (*TableDef, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := structFields(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	// the stable sort keeps the field order
+	slices.SortStableFunc(fields, func(a, b structField) int {
+		if a.pk == b.pk {
+			return 0
+		} else if a.pk {
+			return -1
+		}
+		return 1
+	})
+	tdef := &TableDef{Name: name}
+	for _, f := range fields {
+		if f.pk {
+			tdef.PKeys++
+		}
+		tdef.AutoIncrement = tdef.AutoIncrement || f.auto
+		tdef.Cols = append(tdef.Cols, f.col)
+		tdef.Types = append(tdef.Types, f.typ)
+		tdef.Nullable = append(tdef.Nullable, f.nullable)
+	}
+	if tdef.AutoIncrement && !(len(fields) > 0 && fields[0].auto && tdef.PKeys == 1) {
+		return nil, fmt.Errorf("auto needs a single primary key field: %s", name)
+	}
+	return tdef, tableDefCheck(tdef)
+}
+
+// the Value of a field
+func fieldValue(fv reflect.Value, typ uint32) (Value, error) {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			return Value{Type: TYPE_NULL}, nil
+		}
+		fv = fv.Elem()
+	}
+	val := Value{Type: typ}
+	switch {
+	case typ == TYPE_TIMESTAMP:
+		val.I64 = fv.Interface().(time.Time).UnixMicro()
+	case fv.Kind() == reflect.String:
+		val.Str = []byte(fv.String())
+	case fv.Kind() == reflect.Slice:
+		val.Str = fv.Bytes()
+	case fv.CanInt():
+		val.I64 = fv.Int()
+	case fv.CanUint():
+		if fv.Uint() > math.MaxInt64 {
+			return val, fmt.Errorf("%d overflows int64", fv.Uint())
+		}
+		val.I64 = int64(fv.Uint())
+	case fv.CanFloat():
+		val.F64 = fv.Float()
+	case fv.Kind() == reflect.Bool:
+		val.I64 = boolToInt64(fv.Bool())
+	}
+	return val, nil
+}
+
+// store a Value into a field, NULL is the zero value
+func setField(fv reflect.Value, val *Value) error {
+	if val.Type == TYPE_NULL {
+		fv.SetZero()
+		return nil
+	}
+	if fv.Kind() == reflect.Pointer {
+		fv.Set(reflect.New(fv.Type().Elem()))
+		fv = fv.Elem()
+	}
+	typ, _ := structFieldType(fv.Type())
+	if typ != val.Type {
+		return fmt.Errorf("cannot store %s in %s", TypeName(val.Type), fv.Type())
+	}
+	switch {
+	case typ == TYPE_TIMESTAMP:
+		fv.Set(reflect.ValueOf(time.UnixMicro(val.I64).UTC()))
+	case fv.Kind() == reflect.String:
+		fv.SetString(string(val.Str))
+	case fv.Kind() == reflect.Slice:
+		fv.SetBytes(slices.Clone(val.Str))
+	case fv.CanInt():
+		if fv.OverflowInt(val.I64) {
+			return fmt.Errorf("%d overflows %s", val.I64, fv.Type())
+		}
+		fv.SetInt(val.I64)
+	case fv.CanUint():
+		if val.I64 < 0 || fv.OverflowUint(uint64(val.I64)) {
+			return fmt.Errorf("%d overflows %s", val.I64, fv.Type())
+		}
+		fv.SetUint(uint64(val.I64))
+	case fv.CanFloat():
+		fv.SetFloat(val.F64)
+	case fv.Kind() == reflect.Bool:
+		fv.SetBool(val.I64 != 0)
+	}
+	return nil
+}
+
+// the record of the mapped fields, only the key columns if pkOnly
+func structRecord(tdef *TableDef, rv reflect.Value, pkOnly bool) (Record, []structField, error) {
+	fields, err := structFields(rv.Type())
+	if err != nil {
+		return Record{}, nil, err
+	}
+	rec := Record{}
+	for _, f := range fields {
+		if pkOnly && !slices.Contains(tdef.Cols[:tdef.PKeys], f.col) {
+			continue
+		}
+		val, err := fieldValue(rv.Field(f.index), f.typ)
+		if err != nil {
+			return Record{}, nil, fmt.Errorf("column %s: %w", f.col, err)
+		}
+		rec.Cols = append(rec.Cols, f.col)
+		rec.Vals = append(rec.Vals, val)
+	}
+	return rec, fields, nil
+}
+
+// store the columns of a record into the mapped fields, the others are kept
+func recordToStruct(rec *Record, rv reflect.Value, fields []structField) error {
+	for _, f := range fields {
+		val := rec.Get(f.col)
+		if val.Type == TYPE_ERROR {
+			continue
+		}
+		if err := setField(rv.Field(f.index), val); err != nil {
+			return fmt.Errorf("column %s: %w", f.col, err)
+		}
+	}
+	return nil
+}
+
+// the table, the struct value, and its record for a struct operation
+func structRow(db *DB, table string, v any, pkOnly bool) (*TableDef, reflect.Value, Record, []structField, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, reflect.Value{}, Record{}, nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, rv, Record{}, nil, err
+	}
+	rec, fields, err := structRecord(tdef, rv, pkOnly)
+	return tdef, rv, rec, fields, err
+}
+
+// insert a struct as a new row. v is a pointer to get the AUTO_INCREMENT key.
+func (db *DB) InsertStruct(table string, v any) error {
+	tdef, rv, rec, fields, err := structRow(db, table, v, false)
+	if err != nil {
+		return err
+	}
+	// a zero key is missing
+	auto := -1
+	if tdef.AutoIncrement {
+		auto = slices.IndexFunc(fields, func(f structField) bool { return f.col == tdef.Cols[0] })
+	}
+	if auto >= 0 && rv.Field(fields[auto].index).IsZero() {
+		if !rv.CanSet() {
+			return fmt.Errorf("need a pointer to set the key: %T", v)
+		}
+		idx := slices.Index(rec.Cols, tdef.Cols[0])
+		rec.Cols = slices.Delete(rec.Cols, idx, idx+1)
+		rec.Vals = slices.Delete(rec.Vals, idx, idx+1)
+	}
+	id, err := db.Insert(table, rec)
+	if err != nil || auto < 0 {
+		return err
+	}
+	return setField(rv.Field(fields[auto].index), &Value{Type: TYPE_INT64, I64: id})
+}
+
+// replace the row of a struct, which must exist
+func (db *DB) UpdateStruct(table string, v any) (bool, error) {
+	_, _, rec, _, err := structRow(db, table, v, false)
+	if err != nil {
+		return false, err
+	}
+	return db.Update(table, rec)
+}
+
+// insert or replace the row of a struct
+func (db *DB) UpsertStruct(table string, v any) (bool, error) {
+	_, _, rec, _, err := structRow(db, table, v, false)
+	if err != nil {
+		return false, err
+	}
+	return db.Upsert(table, rec)
+}
+
+// delete the row with the primary key of a struct
+func (db *DB) DeleteStruct(table string, v any) (bool, error) {
+	_, _, rec, _, err := structRow(db, table, v, true)
+	if err != nil {
+		return false, err
+	}
+	return db.Delete(table, rec)
+}
+
+// fetch the row with the primary key set in the struct pointed to by v
+func (db *DB) GetStruct(table string, v any) (bool, error) {
+	tdef, rv, rec, fields, err := structRow(db, table, v, true)
+	if err != nil {
+		return false, err
+	}
+	if !rv.CanSet() {
+		return false, fmt.Errorf("need a pointer: %T", v)
+	}
+	ok, err := dbGet(db, tdef, &rec)
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := recordToStruct(&rec, rv, fields); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// append the rows of a scan to the slice pointed to by out, whose
+// elements are structs or pointers to structs
+func (db *DB) ScanStructs(table string, sc *Scanner, out any) error {
+	slice := reflect.ValueOf(out)
+	if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("need a pointer to a slice: %T", out)
+	}
+	slice = slice.Elem()
+	elem := slice.Type().Elem()
+	ptr := elem.Kind() == reflect.Pointer
+	if ptr {
+		elem = elem.Elem()
+	}
+	fields, err := structFields(elem)
+	if err != nil {
+		return err
+	}
+	if err := db.Scan(table, sc); err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		item := reflect.New(elem)
+		if err := recordToStruct(&rec, item.Elem(), fields); err != nil {
+			return err
+		}
+		if !ptr {
+			item = item.Elem()
+		}
+		slice.Set(reflect.Append(slice, item))
+	}
+	return sc.Err()
+}
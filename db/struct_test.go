@@ -0,0 +1,178 @@
+package db
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testUser struct {
+	ID      int64     `db:"id,pk,auto"`
+	Name    string    `db:"name"`
+	Email   *string   `db:"email"`
+	Age     uint8     // the column "age"
+	Score   float32   `db:"score"`
+	Admin   bool      `db:"admin"`
+	Avatar  []byte    `db:"avatar"`
+	Joined  time.Time `db:"joined"`
+	Skipped string    `db:"-"`
+	private int
+}
+
+type testPet struct {
+	Name  string `db:"name,pk"`
+	Owner int64  `db:"owner,pk"`
+	Kind  string `db:"kind"`
+}
+
+func TestStructs(t *testing.T) {
+	os.Remove("test_struct.db")
+	defer os.Remove("test_struct.db")
+	db := &DB{Path: "test_struct.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	tdef, err := TableDefOf("users", testUser{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "name", "email", "age", "score", "admin", "avatar", "joined"}, tdef.Cols)
+	assert.Equal(t, []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_BYTES, TYPE_TIMESTAMP}, tdef.Types)
+	assert.Equal(t, 1, tdef.PKeys)
+	assert.True(t, tdef.AutoIncrement)
+	assert.Equal(t, []bool{false, false, true, false, false, false, false, false}, tdef.Nullable)
+	assert.NoError(t, db.TableNew(tdef))
+	// the key columns come first
+	pets, err := TableDefOf("pets", &testPet{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name", "owner", "kind"}, pets.Cols)
+	assert.Equal(t, 2, pets.PKeys)
+	assert.NoError(t, db.TableNew(pets))
+
+	// insert with the assigned keys
+	joined := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	email := "ann@x"
+	ann := testUser{Name: "ann", Email: &email, Age: 30, Score: 1.5, Admin: true, Avatar: []byte{0, 1}, Joined: joined, Skipped: "x"}
+	assert.NoError(t, db.InsertStruct("users", &ann))
+	assert.Equal(t, int64(1), ann.ID)
+	bob := testUser{Name: "bob", Age: 40, Joined: joined}
+	assert.NoError(t, db.InsertStruct("users", &bob))
+	assert.Equal(t, int64(2), bob.ID)
+	assert.Error(t, db.InsertStruct("users", testUser{Name: "cat"}))
+	assert.Error(t, db.InsertStruct("users", &bob))
+	assert.NoError(t, db.InsertStruct("pets", testPet{Name: "rex", Owner: 1, Kind: "dog"}))
+
+	// fetch by the primary key
+	got := testUser{ID: 1}
+	ok, err := db.GetStruct("users", &got)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	ann.Skipped = ""
+	assert.Equal(t, ann, got)
+	got = testUser{ID: 9}
+	ok, err = db.GetStruct("users", &got)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	_, err = db.GetStruct("users", testUser{ID: 1})
+	assert.Error(t, err)
+	pet := testPet{Name: "rex", Owner: 1}
+	ok, err = db.GetStruct("pets", &pet)
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, "dog", pet.Kind)
+
+	// update and delete
+	bob.Email, bob.Age = &email, 41
+	ok, err = db.UpdateStruct("users", bob)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	_, err = db.UpdateStruct("users", testUser{ID: 7, Name: "nobody"})
+	assert.Error(t, err)
+	ok, err = db.UpsertStruct("users", testUser{ID: 7, Name: "dan", Joined: joined})
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	ok, err = db.DeleteStruct("users", testUser{ID: 1})
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	ok, err = db.DeleteStruct("users", &testUser{ID: 1})
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	// scan into a slice
+	users := []testUser{}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	sc.Key1.AddInt64("id", 0)
+	sc.Key2.AddInt64("id", 100)
+	assert.NoError(t, db.ScanStructs("users", &sc, &users))
+	assert.Equal(t, 2, len(users))
+	assert.Equal(t, "bob", users[0].Name)
+	assert.Equal(t, uint8(41), users[0].Age)
+	assert.Equal(t, email, *users[0].Email)
+	assert.Nil(t, users[1].Email)
+	assert.Equal(t, int64(7), users[1].ID)
+	names := []*testUser{}
+	sc = Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Cols: []string{"id", "name"}, Filter: mustParseExpr(t, "age > 40")}
+	sc.Key1.AddInt64("id", 0)
+	sc.Key2.AddInt64("id", 100)
+	assert.NoError(t, db.ScanStructs("users", &sc, &names))
+	assert.Equal(t, 1, len(names))
+	assert.Equal(t, testUser{ID: 2, Name: "bob"}, *names[0])
+	assert.Error(t, db.ScanStructs("users", &sc, names))
+	assert.Error(t, db.ScanStructs("users", &sc, &[]int{}))
+
+	// a value that does not fit
+	_, err = db.UpsertStruct("users", struct {
+		ID     int64
+		Name   string
+		Age    int64
+		Score  float64
+		Admin  bool
+		Avatar []byte
+		Joined time.Time
+	}{ID: 8, Name: "big", Age: 300, Joined: joined})
+	assert.NoError(t, err)
+	ok, err = db.GetStruct("users", &testUser{ID: 8})
+	assert.False(t, ok)
+	assert.ErrorContains(t, err, "overflows uint8")
+	huge := struct {
+		ID     uint64
+		Name   string
+		Joined time.Time
+	}{ID: math.MaxUint64, Name: "huge", Joined: joined}
+	assert.ErrorContains(t, db.InsertStruct("users", &huge), "column id: 18446744073709551615 overflows int64")
+	_, err = db.UpdateStruct("users", &huge)
+	assert.ErrorContains(t, err, "overflows int64")
+	_, err = db.DeleteStruct("users", &huge)
+	assert.ErrorContains(t, err, "overflows int64")
+
+	for _, bad := range []any{
+		struct{ A int64 }{}, // no primary key
+		struct {
+			A map[string]int `db:"a,pk"`
+		}{}, // type
+		struct {
+			A int64 `db:"a,pk,key"`
+		}{}, // option
+		struct {
+			A, B int64 `db:"a,pk"`
+		}{}, // duplicate
+		struct {
+			A string `db:"a,pk,auto"`
+		}{}, // auto
+		struct {
+			A *int64 `db:"a,pk"`
+		}{}, // nullable key
+		42,
+	} {
+		_, err := TableDefOf("x", bad)
+		assert.Error(t, err, "%T", bad)
+	}
+	assert.ErrorIs(t, db.InsertStruct("nope", ann), ErrTableNotFound)
+}
+
+func mustParseExpr(t *testing.T, s string) *QLNode {
+	node, err := ParseExpr(s)
+	assert.NoError(t, err)
+	return node
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"testing"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropTable(t *testing.T) {
+	os.Remove("test_drop.db")
+	defer os.Remove("test_drop.db")
+	db := &DB{Path: "test_drop.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	newTable := func(name string) *TableDef {
+		tdef := &TableDef{
+			Name:    name,
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+			Cols:    []string{"id", "name", "age"},
+			PKeys:   1,
+			Indexes: [][]string{{"age"}, {"name"}},
+			Unique:  []bool{false, true},
+		}
+		assert.NoError(t, db.TableNew(tdef))
+		for i := int64(0); i < 300; i++ {
+			rec := (&Record{}).AddInt64("id", i).AddStr("name", []byte{byte(i >> 8), byte(i)}).AddInt64("age", i%50)
+			_, err := db.Insert(name, *rec)
+			assert.NoError(t, err)
+		}
+		return db.GetTableDef(name)
+	}
+	a, b := newTable("a"), newTable("b")
+	keys := db.kv.Stats().Keys
+
+	// truncate moves the table to new prefixes
+	old := tablePrefixes(a)
+	assert.NoError(t, db.TruncateTable("a"))
+	assert.Equal(t, keys-900, db.kv.Stats().Keys)
+	for _, prefix := range old {
+		assert.Equal(t, 0, countPrefix(db, prefix))
+	}
+	// the cached definition is replaced, the old one is left as it was
+	assert.Equal(t, old, tablePrefixes(a))
+	a = db.GetTableDef("a")
+	assert.NotEqual(t, old, tablePrefixes(a))
+	assert.Equal(t, tablePrefixes(a), tablePrefixes(getTableDefDB(db, "a")))
+	rec := (&Record{}).AddInt64("id", 1)
+	ok, err := db.Get("a", rec)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	// the table is usable after that
+	rec = (&Record{}).AddInt64("id", 1).AddStr("name", []byte("x")).AddInt64("age", 1)
+	_, err = db.Insert("a", *rec)
+	assert.NoError(t, err)
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddInt64("age", 0), Key2: *(&Record{}).AddInt64("age", 9)}
+	assert.NoError(t, db.Scan("a", &sc))
+	assert.True(t, sc.Valid())
+
+	// drop frees the pages and forgets the definition
+	free := db.kv.Stats().Free
+	assert.NoError(t, db.DropTable("b"))
+	assert.Nil(t, db.GetTableDef("b"))
+	assert.Equal(t, []string{"a"}, db.ListTables())
+	for _, prefix := range tablePrefixes(b) {
+		assert.Equal(t, 0, countPrefix(db, prefix))
+	}
+	assert.Greater(t, db.kv.Stats().Free, free)
+	assert.True(t, errors.Is(db.DropTable("b"), ErrTableNotFound))
+	assert.True(t, errors.Is(db.TruncateTable("b"), ErrTableNotFound))
+	// the name can be reused
+	b = newTable("b")
+	assert.Equal(t, 300, countPrefix(db, b.Prefix))
+
+	// a background job of a dropped table fails instead of resurrecting it
+	builder, err := db.IndexNew("b", []string{"name", "age"}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, db.DropTable("b"))
+	_, err = builder.Step(10)
+	assert.True(t, errors.Is(err, ErrTableChanged))
+	assert.Nil(t, db.GetTableDef("b"))
+
+	// SQL
+	_, err = db.ExecSQL("truncate a")
+	assert.NoError(t, err)
+	res, err := db.ExecSQL("select * from a")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res.Records))
+	_, err = db.ExecSQL("drop table a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, db.ListTables())
+}
+
+func TestAllocPrefixes(t *testing.T) {
+	os.Remove("test_prefix.db")
+	defer os.Remove("test_prefix.db")
+	db := &DB{Path: "test_prefix.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	// the first user prefix is above the internal tables
+	prefix, err := allocPrefixes(db, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(TABLE_PREFIX_MIN), prefix)
+	prefix, err = allocPrefixes(db, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(TABLE_PREFIX_MIN+2), prefix)
+
+	// an older file with a lower counter moves up
+	meta := (&Record{}).AddStr("key", []byte("next_prefix")).AddStr("val", []byte{0, 0, 0, 3})
+	_, err = dbUpdate(db, TDEF_META, *meta, 0)
+	assert.NoError(t, err)
+	prefix, err = allocPrefixes(db, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(TABLE_PREFIX_MIN), prefix)
+}
@@ -1,33 +1,142 @@
 package db
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	. "server"
+	"slices"
 	. "types"
 	. "utils"
 )
 
-// add a row to the table
+// add a row to the table, the indexes are updated in the same commit.
 func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
+	rec, err := fillDefaults(db, tdef, rec)
+	if err != nil {
+		return false, err
+	}
 	values, err := checkRecord(tdef, rec, len(tdef.Cols))
 	if err != nil {
 		return false, err
 	}
+	if err := checkRow(tdef, values); err != nil {
+		return false, err
+	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	val := encodeValues(nil, values[tdef.PKeys:])
-	return db.kv.Update(key, val, mode)
+	val := encodeRow(tdef, values)
+	// the old row is needed for the mode and the stale index entries
+	old, exists := dbGetValues(db, tdef, key, values)
+	if exists && mode == MODE_INSERT_ONLY {
+		return false, ErrKeyExist
+	} else if !exists && mode == MODE_UPDATE_ONLY {
+		return false, ErrKeyNotExist
+	}
+	if err := fkCheckParents(db, tdef, values, old); err != nil {
+		return false, err
+	}
+	b := &Batch{}
+	b.Set(key, val)
+	for i := range tdef.Indexes {
+		newKey := encodeIndexKey(tdef, i, values)
+		if exists {
+			oldKey := encodeIndexKey(tdef, i, old)
+			if bytes.Equal(oldKey, newKey) {
+				continue
+			}
+			b.Del(oldKey)
+		}
+		var ival []byte
+		if isUnique(tdef, i) {
+			// the key must be free, the value points to the row
+			if _, dup := db.kv.Get(newKey); dup {
+				return false, &ConstraintError{Table: tdef.Name, Kind: "unique", Cols: tdef.Indexes[i]}
+			}
+			ival = encodeValues(nil, values[:tdef.PKeys])
+		}
+		b.Set(newKey, ival)
+	}
+	if err := dbCommit(db, b); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// commit the writes of a row, or only apply them when the caller
+// flushes a batch of rows, see ImportCSV
+func dbCommit(db *DB, b *Batch) error {
+	if db.batching {
+		db.kv.Apply(b)
+		return nil
+	}
+	_, err := db.kv.Commit(b)
+	return err
+}
+
+// read the stored row of the encoded primary key,
+// the primary key values are copied from pk.
+func dbGetValues(db *DB, tdef *TableDef, key []byte, pk []Value) ([]Value, bool) {
+	val, ok := db.kv.Get(key)
+	if !ok {
+		return nil, false
+	}
+	values := make([]Value, len(tdef.Cols))
+	copy(values, pk[:tdef.PKeys])
+	decodeRow(tdef, val, values)
+	return values, true
+}
+
+// the B-tree key of a secondary index, values are in the table order.
+// NULLs are not duplicates in a unique index, so the primary key is
+// appended to make the key unique.
+func encodeIndexKey(tdef *TableDef, idx int, values []Value) []byte {
+	cols := tdef.Indexes[idx]
+	vals := make([]Value, len(cols))
+	for i, col := range cols {
+		vals[i] = values[colIndex(tdef, col)]
+	}
+	key := encodeCols(encodeKey(nil, tdef.IndexPrefixes[idx], nil), vals, nullableCols(tdef, cols))
+	if isUnique(tdef, idx) && hasNull(tdef, idx, values) {
+		key = encodeValues(key, values[:tdef.PKeys])
+	}
+	return key
+}
+
+// any NULL in the index columns?
+func hasNull(tdef *TableDef, idx int, values []Value) bool {
+	for _, col := range tdef.Indexes[idx] {
+		if values[colIndex(tdef, col)].Type == TYPE_NULL {
+			return true
+		}
+	}
+	return false
 }
 
 func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if mode != MODE_UPDATE_ONLY {
+		if _, err := autoIncrement(db, tdef, &rec); err != nil {
+			return false, err
+		}
 	}
 	return dbUpdate(db, tdef, rec, mode)
 }
-func (db *DB) Insert(table string, rec Record) (bool, error) {
-	return db.Set(table, rec, MODE_INSERT_ONLY)
+
+// insert a new row, returns the AUTO_INCREMENT key, 0 if the table has none
+func (db *DB) Insert(table string, rec Record) (int64, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	id, err := autoIncrement(db, tdef, &rec)
+	if err == nil {
+		_, err = dbUpdate(db, tdef, rec, MODE_INSERT_ONLY)
+	}
+	return id, err
 }
 func (db *DB) Update(table string, rec Record) (bool, error) {
 	return db.Set(table, rec, MODE_UPDATE_ONLY)
@@ -35,55 +144,288 @@ func (db *DB) Update(table string, rec Record) (bool, error) {
 func (db *DB) Upsert(table string, rec Record) (bool, error) {
 	return db.Set(table, rec, MODE_UPSERT)
 }
+
+// remove a row and its index entries in one commit,
+// with the changes to the children by the foreign keys
 func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
 	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	return db.kv.Del(key)
+	old, exists := dbGetValues(db, tdef, key, values)
+	if !exists {
+		return false, nil
+	}
+	d := &fkDelete{db: db, b: &Batch{}, deleted: map[string]bool{}}
+	if err := d.del(tdef, key, old); err != nil {
+		return false, err
+	}
+	if err := d.flush(); err != nil {
+		return false, err
+	}
+	_, err = db.kv.Commit(d.b)
+	return err == nil, err
 }
 func (db *DB) Delete(table string, rec Record) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return dbDelete(db, tdef, rec)
 }
 
 func (db *DB) TableNew(tdef *TableDef) error {
-	// if err := tableDefCheck(tdef); err != nil {
-	// 	return err
-	// }
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+	if err := fkCheck(db, tdef); err != nil {
+		return err
+	}
 	// check the existing table
 	table := (&Record{}).AddStr("name", []byte(tdef.Name))
 	ok, err := dbGet(db, TDEF_TABLE, table)
 	Assert(err == nil)
 	if ok {
-		return fmt.Errorf("table exists: %s", tdef.Name)
+		return fmt.Errorf("%w: %s", ErrTableExists, tdef.Name)
 	}
-	// allocate a new prefix
-	// Assert(tdef.Prefix == 0)
-	tdef.Prefix = TABLE_PREFIX_MIN
+	// allocate new prefixes for the table and its indexes
+	prefix, err := allocPrefixes(db, 1+len(tdef.Indexes))
+	if err != nil {
+		return err
+	}
+	tdef.Prefix = prefix
+	tdef.Building = nil // nothing to backfill
+	tdef.Version, tdef.Schemas = 0, nil
+	tdef.IndexPrefixes = nil
+	for i := range tdef.Indexes {
+		tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix+1+uint32(i))
+	}
+	return tableDefSave(db, tdef)
+}
+
+// remove a table with its rows and indexes in a single commit
+func (db *DB) DropTable(name string) error {
+	tdef := getTableDef(db, name)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	if err := fkReferenced(db, name); err != nil {
+		return err
+	}
+	b := &Batch{}
+	b.Del(encodeKey(nil, TDEF_TABLE.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(name)}}))
+	b.Del(encodeKey(nil, TDEF_META.Prefix, []Value{*seqKey(tableSeq(tdef)).Get("key")}))
+	b.Del(encodeKey(nil, TDEF_META.Prefix, []Value{*statsKey(name).Get("key")}))
+	delPrefixes(b, tablePrefixes(tdef))
+	if _, err := db.kv.Commit(b); err != nil {
+		return err
+	}
+	delete(db.tables, name)
+	delete(db.seqs, tableSeq(tdef))
+	delete(db.stats, name)
+	db.refs = nil
+	return nil
+}
+
+// remove all the rows of a table. the table and its indexes switch to new
+// prefixes, the keys of the old ones are deleted, and the sequence and the
+// statistics are dropped, all in a single commit. the cached definition is
+// replaced after that, the old one is stale for the ongoing index builds.
+func (db *DB) TruncateTable(name string) error {
+	tdef := getTableDef(db, name)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	if err := fkReferenced(db, name); err != nil {
+		return err
+	}
+	old := tablePrefixes(tdef)
+	prefix, meta := nextPrefixes(db, len(old))
+	truncated := *tdef
+	truncated.Prefix = prefix
+	truncated.IndexPrefixes = make([]uint32, len(tdef.IndexPrefixes))
+	for i := range truncated.IndexPrefixes {
+		truncated.IndexPrefixes[i] = prefix + 1 + uint32(i)
+	}
+	truncated.Building = nil // nothing to backfill
+	truncated.Schemas = nil  // no old rows
+	truncated.exprs = nil
+	def, err := json.Marshal(&truncated)
+	Assert(err == nil)
+
+	b := &Batch{}
+	batchRow(b, TDEF_META, []Value{*meta.Get("key"), *meta.Get("val")})
+	batchRow(b, TDEF_TABLE, []Value{{Type: TYPE_BYTES, Str: []byte(name)}, {Type: TYPE_BYTES, Str: def}})
+	// AUTO_INCREMENT starts over, and the statistics are gone
+	b.Del(encodeKey(nil, TDEF_META.Prefix, []Value{*seqKey(tableSeq(tdef)).Get("key")}))
+	b.Del(encodeKey(nil, TDEF_META.Prefix, []Value{*statsKey(name).Get("key")}))
+	delPrefixes(b, old)
+	if _, err := db.kv.Commit(b); err != nil {
+		return err
+	}
+	db.tables[name] = &truncated
+	delete(db.seqs, tableSeq(tdef))
+	delete(db.stats, name)
+	db.refs = nil
+	return nil
+}
+
+// the key prefixes of a table and its indexes
+func tablePrefixes(tdef *TableDef) []uint32 {
+	return append([]uint32{tdef.Prefix}, tdef.IndexPrefixes...)
+}
+
+// delete all the keys of the prefixes in one commit
+func dbDelPrefixes(db *DB, prefixes []uint32) error {
+	b := &Batch{}
+	delPrefixes(b, prefixes)
+	_, err := db.kv.Commit(b)
+	return err
+}
+func delPrefixes(b *Batch, prefixes []uint32) {
+	for _, prefix := range prefixes {
+		b.DelRange(encodeKey(nil, prefix, nil), encodeKey(nil, prefix+1, nil))
+	}
+}
+
+// the current definition of a table, nil if the table was dropped or
+// truncated since the prefix was taken from it. the prefixes are not reused.
+func currentTableDef(db *DB, name string, prefix uint32) *TableDef {
+	tdef := getTableDef(db, name)
+	if tdef == nil || !slices.Contains(tablePrefixes(tdef), prefix) {
+		return nil
+	}
+	return tdef
+}
+
+// allocate n consecutive key prefixes from the @meta counter
+func allocPrefixes(db *DB, n int) (uint32, error) {
+	prefix, meta := nextPrefixes(db, n)
+	_, err := dbUpdate(db, TDEF_META, *meta, 0)
+	return prefix, err
+}
+
+// the next n key prefixes, and the @meta row of the counter past them
+func nextPrefixes(db *DB, n int) (uint32, *Record) {
+	prefix := uint32(TABLE_PREFIX_MIN)
 	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(db, TDEF_META, meta)
+	ok, err := dbGet(db, TDEF_META, meta)
 	Assert(err == nil)
 	if ok {
-		tdef.Prefix = binary.BigEndian.Uint32(meta.Get("val").Str)
-		Assert(tdef.Prefix > TABLE_PREFIX_MIN)
+		prefix = max(prefix, binary.BigEndian.Uint32(meta.Get("val").Str))
 	} else {
 		meta.AddStr("val", make([]byte, 4))
 	}
-	// update the next prefix
-	binary.BigEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+1)
-	_, err = dbUpdate(db, TDEF_META, *meta, 0)
-	if err != nil {
-		return err
-	}
-	// store the definition
+	binary.BigEndian.PutUint32(meta.Get("val").Str, prefix+uint32(n))
+	return prefix, meta
+}
+
+// add the write of a row of an internal table to a batch,
+// the values are in the column order.
+func batchRow(b *Batch, tdef *TableDef, values []Value) {
+	b.Set(encodeKey(nil, tdef.Prefix, values[:tdef.PKeys]), encodeRow(tdef, values))
+}
+
+func tableDefSave(db *DB, tdef *TableDef) error {
 	val, err := json.Marshal(tdef)
 	Assert(err == nil)
-	table.AddStr("def", val)
+	table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
 	_, err = dbUpdate(db, TDEF_TABLE, *table, 0)
+	db.refs = nil    // the foreign keys may change
+	tdef.exprs = nil // the columns may change
 	return err
 }
+
+// sanity checks of a user defined table
+func tableDefCheck(tdef *TableDef) error {
+	bad := tdef.Name == "" || tdef.Name[0] == '@' // reserved for internal tables
+	bad = bad || len(tdef.Cols) == 0
+	bad = bad || len(tdef.Cols) != len(tdef.Types)
+	bad = bad || !(1 <= tdef.PKeys && tdef.PKeys <= len(tdef.Cols))
+	if bad {
+		return fmt.Errorf("bad table definition: %s", tdef.Name)
+	}
+	seen := map[string]bool{}
+	for i, col := range tdef.Cols {
+		if col == "" || seen[col] {
+			return fmt.Errorf("bad column name: %q", col)
+		}
+		seen[col] = true
+		if TypeName(tdef.Types[i]) == "?" {
+			return fmt.Errorf("bad column type: %s", col)
+		}
+	}
+	if len(tdef.Unique) > len(tdef.Indexes) || len(tdef.Building) > len(tdef.Indexes) {
+		return fmt.Errorf("bad unique indexes: %s", tdef.Name)
+	}
+	if len(tdef.Nullable) > len(tdef.Cols) {
+		return fmt.Errorf("bad nullable columns: %s", tdef.Name)
+	}
+	if len(tdef.Defaults) > len(tdef.Cols) {
+		return fmt.Errorf("bad column defaults: %s", tdef.Name)
+	}
+	for i := range tdef.Defaults {
+		if err := checkDefault(tdef, i, tdef.Defaults[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := parseTableExprs(tdef); err != nil {
+		return err
+	}
+	if tdef.AutoIncrement && (tdef.PKeys != 1 || tdef.Types[0] != TYPE_INT64) {
+		return fmt.Errorf("AUTO_INCREMENT needs a single int64 primary key: %s", tdef.Name)
+	}
+	for i := 0; i < tdef.PKeys; i++ {
+		if isNullable(tdef, i) {
+			return fmt.Errorf("the primary key is not nullable: %s", tdef.Cols[i])
+		}
+	}
+	for i, index := range tdef.Indexes {
+		index, err := checkIndexKeys(tdef, index, isUnique(tdef, i))
+		if err != nil {
+			return err
+		}
+		tdef.Indexes[i] = index
+	}
+	return nil
+}
+
+// the default of a column is absent or a valid value of the column type
+func checkDefault(tdef *TableDef, col int, def Value) error {
+	switch {
+	case def.Type == TYPE_ERROR:
+		return nil
+	case col < tdef.PKeys:
+		return fmt.Errorf("the primary key has no default: %s", tdef.Cols[col])
+	case def.Type != tdef.Types[col]:
+		return fmt.Errorf("bad default: %s", tdef.Cols[col])
+	}
+	if err := checkValue(&def); err != nil {
+		return fmt.Errorf("bad default: %s: %w", tdef.Cols[col], err)
+	}
+	return nil
+}
+
+// check the index columns and append the missing primary key columns,
+// so that each index key points to a single row. a unique index keeps
+// its columns since the key is already unique.
+func checkIndexKeys(tdef *TableDef, index []string, unique bool) ([]string, error) {
+	if len(index) == 0 {
+		return nil, fmt.Errorf("empty index: %s", tdef.Name)
+	}
+	seen := map[string]bool{}
+	for _, col := range index {
+		if colIndex(tdef, col) < 0 || seen[col] {
+			return nil, fmt.Errorf("bad index column: %q", col)
+		}
+		seen[col] = true
+	}
+	out := append([]string{}, index...)
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		if !unique && !seen[col] {
+			out = append(out, col)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decimals are fixed-point numbers with DECIMAL_SCALE fractional digits,
+// stored as int64 units, e.g. 1.5 is 1500000 units.
+const DECIMAL_SCALE = 6
+
+var typeNames = map[uint32]string{
+	TYPE_BYTES:     "bytes",
+	TYPE_INT64:     "int64",
+	TYPE_FLOAT64:   "float64",
+	TYPE_BOOL:      "bool",
+	TYPE_TIMESTAMP: "timestamp",
+	TYPE_DECIMAL:   "decimal",
+}
+
+func TypeName(typ uint32) string {
+	if name, ok := typeNames[typ]; ok {
+		return name
+	}
+	return "?"
+}
+
+// the column type by name, TYPE_ERROR if unknown
+func TypeByName(name string) uint32 {
+	for typ, str := range typeNames {
+		if strings.EqualFold(str, name) {
+			return typ
+		}
+	}
+	return TYPE_ERROR
+}
+
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// order-preserving float encoding: flip the sign bit of positive numbers
+// and all bits of negative numbers, so that they compare as unsigned.
+func encodeFloat64(f float64) uint64 {
+	if f == 0 {
+		f = 0 // -0 and +0 are the same key
+	}
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		return ^u
+	}
+	return u | (1 << 63)
+}
+func decodeFloat64(u uint64) float64 {
+	if u&(1<<63) != 0 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+// values that cannot be stored
+func checkValue(val *Value) error {
+	switch {
+	case val.Type == TYPE_FLOAT64 && math.IsNaN(val.F64):
+		return errors.New("NaN is not comparable")
+	case val.Type == TYPE_BOOL && val.I64 != 0 && val.I64 != 1:
+		return errors.New("bad boolean")
+	}
+	return nil
+}
+
+// parse a decimal like -12.345 into units
+func ParseDecimal(str string) (int64, error) {
+	bad := fmt.Errorf("bad decimal: %q", str)
+	neg := strings.HasPrefix(str, "-")
+	digits := strings.TrimLeft(str, "+-")
+	if len(str)-len(digits) > 1 {
+		return 0, bad
+	}
+	ipart, fpart, _ := strings.Cut(digits, ".")
+	if ipart == "" && fpart == "" || len(fpart) > DECIMAL_SCALE {
+		return 0, bad
+	}
+	fpart += strings.Repeat("0", DECIMAL_SCALE-len(fpart))
+	for _, ch := range ipart + fpart {
+		if ch < '0' || ch > '9' {
+			return 0, bad
+		}
+	}
+	// accumulate negatively to cover the minimum
+	units := int64(0)
+	for _, ch := range ipart + fpart {
+		if units < (math.MinInt64+int64(ch-'0'))/10 {
+			return 0, fmt.Errorf("decimal out of range: %q", str)
+		}
+		units = units*10 - int64(ch-'0')
+	}
+	if !neg {
+		if units == math.MinInt64 {
+			return 0, fmt.Errorf("decimal out of range: %q", str)
+		}
+		units = -units
+	}
+	return units, nil
+}
+
+// format decimal units without trailing zeros
+func FormatDecimal(units int64) string {
+	sign := ""
+	u := uint64(units)
+	if units < 0 {
+		sign, u = "-", uint64(-units) // also right for the minimum
+	}
+	str := strconv.FormatUint(u, 10)
+	if len(str) <= DECIMAL_SCALE {
+		str = strings.Repeat("0", DECIMAL_SCALE-len(str)+1) + str
+	}
+	ipart, fpart := str[:len(str)-DECIMAL_SCALE], strings.TrimRight(str[len(str)-DECIMAL_SCALE:], "0")
+	if fpart == "" {
+		return sign + ipart
+	}
+	return sign + ipart + "." + fpart
+}
+
+// compare 2 non-NULL values of the same type, in the order of the keys
+func CompareValues(a *Value, b *Value) (int, error) {
+	return qlCompare(a, b)
+}
+
+// parse the text form of a value
+func ParseValue(typ uint32, str string) (Value, error) {
+	val := Value{Type: typ}
+	var err error
+	switch typ {
+	case TYPE_BYTES:
+		val.Str = []byte(str)
+	case TYPE_INT64:
+		if val.I64, err = strconv.ParseInt(str, 10, 64); err != nil {
+			err = errors.New("expect an integer")
+		}
+	case TYPE_FLOAT64:
+		if val.F64, err = strconv.ParseFloat(str, 64); err != nil || math.IsNaN(val.F64) {
+			err = errors.New("expect a number")
+		}
+	case TYPE_BOOL:
+		var b bool
+		if b, err = strconv.ParseBool(str); err != nil {
+			err = errors.New("expect a boolean")
+		}
+		val.I64 = boolToInt64(b)
+	case TYPE_TIMESTAMP:
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, str); err != nil {
+			err = errors.New("expect an RFC 3339 time")
+		}
+		val.I64 = t.UnixMicro()
+	case TYPE_DECIMAL:
+		val.I64, err = ParseDecimal(str)
+	default:
+		err = errors.New("bad column type")
+	}
+	return val, err
+}
+
+// the text form of a value, the reverse of ParseValue
+func FormatValue(val *Value) string {
+	switch val.Type {
+	case TYPE_BYTES:
+		return string(val.Str)
+	case TYPE_INT64:
+		return strconv.FormatInt(val.I64, 10)
+	case TYPE_FLOAT64:
+		return strconv.FormatFloat(val.F64, 'g', -1, 64)
+	case TYPE_BOOL:
+		return strconv.FormatBool(val.I64 != 0)
+	case TYPE_TIMESTAMP:
+		return time.UnixMicro(val.I64).UTC().Format(time.RFC3339Nano)
+	case TYPE_DECIMAL:
+		return FormatDecimal(val.I64)
+	case TYPE_NULL:
+		return "NULL"
+	}
+	return "?"
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"testing"
+	"time"
+	. "types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecimal(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		units int64
+		out   string
+	}{
+		{"0", 0, "0"},
+		{"1.5", 1500000, "1.5"},
+		{"-1.5", -1500000, "-1.5"},
+		{"+.25", 250000, "0.25"},
+		{"12.000001", 12000001, "12.000001"},
+		{"-0.000001", -1, "-0.000001"},
+		{"3.", 3000000, "3"},
+		{"-9223372036854.775808", math.MinInt64, "-9223372036854.775808"},
+		{"9223372036854.775807", math.MaxInt64, "9223372036854.775807"},
+	} {
+		units, err := ParseDecimal(c.in)
+		assert.NoError(t, err, c.in)
+		assert.Equal(t, c.units, units, c.in)
+		assert.Equal(t, c.out, FormatDecimal(units), c.in)
+	}
+	for _, bad := range []string{"", "-", ".", "1.2.3", "1.0000001", "--1", "1e5", "9223372036854.775808"} {
+		_, err := ParseDecimal(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestValueOrder(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := [][]Value{
+		{
+			{Type: TYPE_FLOAT64, F64: math.Inf(-1)}, {Type: TYPE_FLOAT64, F64: -1e300},
+			{Type: TYPE_FLOAT64, F64: -2.5}, {Type: TYPE_FLOAT64, F64: -1e-300},
+			{Type: TYPE_FLOAT64, F64: 0}, {Type: TYPE_FLOAT64, F64: 1e-300},
+			{Type: TYPE_FLOAT64, F64: 3}, {Type: TYPE_FLOAT64, F64: math.Inf(1)},
+		},
+		{{Type: TYPE_BOOL, I64: 0}, {Type: TYPE_BOOL, I64: 1}},
+		{
+			{Type: TYPE_TIMESTAMP, I64: ts.Add(-time.Hour * 24 * 365 * 100).UnixMicro()},
+			{Type: TYPE_TIMESTAMP, I64: ts.UnixMicro()},
+			{Type: TYPE_TIMESTAMP, I64: ts.Add(time.Microsecond).UnixMicro()},
+		},
+		{{Type: TYPE_DECIMAL, I64: -1500000}, {Type: TYPE_DECIMAL, I64: -1}, {Type: TYPE_DECIMAL, I64: 2}},
+	}
+	for _, vals := range cases {
+		keys := []string{}
+		for i := range vals {
+			key := encodeValues(nil, vals[i:i+1])
+			keys = append(keys, string(key))
+			out := []Value{{Type: vals[i].Type}}
+			decodeValues(key, out)
+			assert.Equal(t, vals[i], out[0])
+		}
+		assert.True(t, sort.StringsAreSorted(keys), TypeName(vals[0].Type))
+	}
+	// -0 is the same key as +0
+	assert.Equal(t, encodeValues(nil, []Value{{Type: TYPE_FLOAT64, F64: math.Copysign(0, -1)}}),
+		encodeValues(nil, []Value{{Type: TYPE_FLOAT64, F64: 0}}))
+}
+
+func TestValueTypes(t *testing.T) {
+	os.Remove("test_types.db")
+	defer os.Remove("test_types.db")
+	db := &DB{Path: "test_types.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:  "readings",
+		Types: []uint32{TYPE_FLOAT64, TYPE_TIMESTAMP, TYPE_BOOL, TYPE_DECIMAL},
+		Cols:  []string{"temp", "at", "ok", "price"},
+		PKeys: 2,
+	}
+	assert.NoError(t, db.TableNew(tdef))
+	data, err := json.Marshal(tdef)
+	assert.NoError(t, err)
+	back := &TableDef{}
+	assert.NoError(t, json.Unmarshal(data, back))
+	assert.Equal(t, tdef, back)
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, temp := range []float64{3.5, -10, 0.25, -0.5, 100} {
+		rec := (&Record{}).AddFloat64("temp", temp).AddTime("at", ts.Add(time.Duration(i)*time.Second)).
+			AddBool("ok", temp > 0).AddDecimal("price", int64(i)*1250000)
+		_, err := db.Insert("readings", *rec)
+		assert.NoError(t, err)
+	}
+	rec := (&Record{}).AddFloat64("temp", math.NaN()).AddTime("at", ts).AddBool("ok", true).AddDecimal("price", 0)
+	_, err = db.Insert("readings", *rec)
+	assert.Error(t, err)
+
+	// primary key order
+	key1 := *(&Record{}).AddFloat64("temp", -5).AddTime("at", time.Unix(0, 0))
+	key2 := *(&Record{}).AddFloat64("temp", 50).AddTime("at", time.Unix(0, 0))
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key1, Key2: key2}
+	assert.NoError(t, db.Scan("readings", &sc))
+	temps := []float64{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		temps = append(temps, rec.Get("temp").F64)
+		assert.Equal(t, rec.Get("temp").F64 > 0, rec.Get("ok").I64 == 1)
+	}
+	assert.Equal(t, []float64{-0.5, 0.25, 3.5}, temps)
+
+	got := (&Record{}).AddFloat64("temp", 0.25).AddTime("at", ts.Add(2*time.Second))
+	ok, err := db.Get("readings", got)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "2.5", FormatValue(got.Get("price")))
+	assert.Equal(t, "2024-05-01T12:00:02Z", FormatValue(got.Get("at")))
+
+	// SQL literals and conversions
+	res, err := db.ExecSQL("select temp, price + 1 as p from readings where temp > -1.0e1 and price >= '2.5' and at < '2024-05-01T12:00:04Z'")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Records))
+	assert.Equal(t, -0.5, res.Records[0].Get("temp").F64)
+	assert.Equal(t, "4.75", FormatValue(res.Records[0].Get("p")))
+	_, err = db.ExecSQL("insert into readings values (1, '2024-01-01T00:00:00Z', true, 9.99)")
+	assert.NoError(t, err)
+	res, err = db.ExecSQL("select ok, price from readings where temp = 1 and at = '2024-01-01T00:00:00Z'")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", FormatValue(res.Records[0].Get("ok")))
+	assert.Equal(t, "9.99", FormatValue(res.Records[0].Get("price")))
+	_, err = db.ExecSQL("select price * price from readings")
+	assert.Error(t, err)
+}
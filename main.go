@@ -1,12 +1,63 @@
 package main
 
 import (
+	"bufio"
+	. "db"
+	"flag"
 	"fmt"
-	. "types"
+	"os"
+	"path/filepath"
 )
 
+// an interactive shell over a database file.
+// when stdin is not a terminal, the commands are run as a script
+// without prompts, and the first error stops the script.
 func main() {
-	node := BNode(make([]byte, BTREE_PAGE_SIZE))
-	node.SetHeader(BNODE_LEAF, 2)
-	fmt.Println(node)
+	histPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		histPath = filepath.Join(home, ".db_history")
+	}
+	path := flag.String("db", "data.db", "the database file")
+	hist := flag.String("history", histPath, "the history file, empty to disable")
+	flag.Parse()
+
+	db := &DB{Path: *path}
+	if err := db.Open(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	sh := NewShell(db, os.Stdout)
+
+	fi, err := os.Stdin.Stat()
+	interactive := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	if interactive && *hist != "" {
+		sh.LoadHistory(*hist)
+	}
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(nil, 1<<20)
+	for {
+		if interactive {
+			fmt.Print("db> ")
+		}
+		if !in.Scan() {
+			break
+		}
+		err := sh.Exec(in.Text())
+		if err == errQuit {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			if !interactive {
+				db.Close()
+				os.Exit(1)
+			}
+		}
+	}
+	if interactive && *hist != "" {
+		if err := sh.SaveHistory(*hist); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 }
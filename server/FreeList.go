@@ -26,6 +26,9 @@ type FreeList struct {
 
 // number of items in the list
 func (fl *FreeList) Total() int {
+	if fl.head == 0 {
+		return 0 // empty list
+	}
 	node := fl.get(fl.head)
 	return int(binary.LittleEndian.Uint64(node[4:12]))
 }
@@ -136,7 +139,9 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 	// phase 3: prepend new nodes
 	flPush(fl, freed, reuse)
 	// done
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+	if fl.head != 0 {
+		flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+	}
 }
 
 func (fl *FreeList) DebugPrint() {
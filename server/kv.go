@@ -57,6 +57,12 @@ type KV struct {
 		// nil value denotes a deallocated page.
 		updates map[uint64][]byte
 	}
+	// replication, see replication.go
+	repl    *Primary // the log shipper, nil if not a primary
+	pending []LogOp  // logical changes of the current commit
+	// the number of keys, counted once by Stats() then kept up to date
+	keys    int
+	counted bool
 }
 
 // extend the mmap by adding new mappings.
@@ -66,7 +72,7 @@ func extendMmap(db *KV, npages int) error {
 	}
 	// double the address space
 	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), 0, db.mmap.total,
+		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
 		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
 	)
 	if err != nil {
@@ -85,12 +91,18 @@ func NewKv(path string) *KV {
 
 	return kv
 }
+
+var (
+	ErrKeyExist    = errors.New("key exist")
+	ErrKeyNotExist = errors.New("key not exist")
+)
+
 func (db *KV) Update(key []byte, val []byte, mode int) (bool, error) {
 	_, ok := db.Get(key)
 	if ok && mode == MODE_INSERT_ONLY {
-		return false, errors.New("key exist")
+		return false, ErrKeyExist
 	} else if !ok && mode == MODE_UPDATE_ONLY {
-		return false, errors.New("key not exist")
+		return false, ErrKeyNotExist
 	}
 	err := db.Set(key, val)
 	if err != nil {
@@ -124,12 +136,16 @@ func pageGetMapped(db *KV, ptr uint64) []byte {
 	panic("bad ptr")
 }
 
-const DB_SIG = "BuildYourOwnDB05"
+const DB_SIG = "BuildYourOwnDB06"
+
+// the previous format has no free list head. it is still read, the pages
+// it freed are not reused, and the first commit rewrites it as DB_SIG.
+const DB_SIG_V05 = "BuildYourOwnDB05"
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B | 8B | 8B |
+// | sig | btree_root | page_used | free_list |
+// | 16B | 8B         | 8B        | 8B        |
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created on the first write.
@@ -142,10 +158,11 @@ func masterLoad(db *KV) error {
 
 // update the master page. it must be atomic.
 func masterStore(db *KV) error {
-	var data [32]byte
+	var data [40]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.head)
 	// NOTE: Updating the page via mmap is not atomic.
 	// Use the pwrite() syscall instead.
 	_, err := db.fp.WriteAt(data[:], 0)
@@ -223,6 +240,7 @@ func (db *KV) Open() error {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
 	db.fp = fp
+	db.counted = false
 	// create the initial mmap
 	sz, chunk, err := mmapInit(db.fp)
 	if err != nil {
@@ -273,16 +291,142 @@ func (db *KV) Get(key []byte) ([]byte, bool) {
 
 // update the db
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
+	kvInsert(db, key, val)
+	db.logOp(LOG_SET, key, val)
 	return flushPages(db)
 }
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
+	deleted := kvDelete(db, key)
+	if deleted {
+		db.logOp(LOG_DEL, key, nil)
+	}
 	return deleted, flushPages(db)
 }
 
+// delete the keys in [start, end) in a single commit,
+// returns the number of deleted keys.
+func (db *KV) DelRange(start []byte, end []byte) (int, error) {
+	b := &Batch{}
+	b.DelRange(start, end)
+	return db.Commit(b)
+}
+
+// a group of updates that are committed together
+type Batch struct {
+	ops []LogOp
+}
+
+func (b *Batch) Set(key []byte, val []byte) {
+	b.ops = append(b.ops, LogOp{Op: LOG_SET, Key: key, Val: val})
+}
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, LogOp{Op: LOG_DEL, Key: key})
+}
+
+// delete the keys in [start, end), an empty end means no upper bound
+func (b *Batch) DelRange(start []byte, end []byte) {
+	b.ops = append(b.ops, LogOp{Op: LOG_DEL_RANGE, Key: start, Val: end})
+}
+
+// apply the updates in order, then flush them in a single commit.
+// returns the number of keys that were actually deleted.
+func (db *KV) Commit(b *Batch) (int, error) {
+	deleted := db.Apply(b)
+	return deleted, flushPages(db)
+}
+
+// apply the updates in order without flushing them; they are visible to
+// the reads at once, and become durable with the next Flush or Commit.
+func (db *KV) Apply(b *Batch) int {
+	deleted := 0
+	for _, op := range b.ops {
+		switch op.Op {
+		case LOG_SET:
+			kvInsert(db, op.Key, op.Val)
+			db.logOp(LOG_SET, op.Key, op.Val)
+		case LOG_DEL:
+			if kvDelete(db, op.Key) {
+				deleted++
+				db.logOp(LOG_DEL, op.Key, nil)
+			}
+		case LOG_DEL_RANGE:
+			if n := kvDeleteRange(db, op.Key, op.Val); n > 0 {
+				deleted += n
+				db.logOp(LOG_DEL_RANGE, op.Key, op.Val)
+			}
+		}
+	}
+	return deleted
+}
+
+// update the tree and the key count
+func kvInsert(db *KV, key []byte, val []byte) {
+	if db.counted {
+		if _, ok := db.tree.Read(key); !ok {
+			db.keys++
+		}
+	}
+	db.tree.Insert(key, val)
+}
+func kvDelete(db *KV, key []byte) bool {
+	deleted := db.tree.Delete(key)
+	if deleted {
+		db.keys--
+	}
+	return deleted
+}
+func kvDeleteRange(db *KV, start []byte, end []byte) int {
+	n := db.tree.DeleteRange(start, end)
+	db.keys -= n
+	return n
+}
+
+// flush the applied updates in a single commit
+func (db *KV) Flush() error {
+	return flushPages(db)
+}
+
+// database statistics
+type KVStats struct {
+	Root     uint64 // the root page
+	Pages    uint64 // pages used by the database, including the master page
+	Free     int    // pages in the free list
+	FileSize int    // the file size in bytes
+	Keys     int    // number of keys, excluding the dummy key
+}
+
+func (db *KV) Stats() KVStats {
+	if !db.counted {
+		// the only full scan, later updates keep the count
+		db.keys = 0
+		if db.tree.Root != 0 {
+			for iter := db.tree.SeekLE(nil); iter.Valid(); iter.Next() {
+				db.keys++
+			}
+			db.keys-- // the dummy key
+		}
+		db.counted = true
+	}
+	return KVStats{
+		Root:     db.tree.Root,
+		Pages:    db.page.flushed,
+		Free:     db.free.Total(),
+		FileSize: db.mmap.file,
+		Keys:     db.keys,
+	}
+}
+
 // persist the newly allocated pages after updates
 func flushPages(db *KV) error {
+	// log the changes before the master page publishes them. a crash in
+	// between is recovered by Primary.Open, which replays the last entry.
+	// if the log fails, nothing is written and the next commit retries.
+	if db.repl != nil && len(db.pending) > 0 {
+		if err := db.repl.append(db.pending); err != nil {
+			return err
+		}
+		db.pending = nil
+	}
 	if err := writePages(db); err != nil {
 		return err
 	}
@@ -316,8 +460,7 @@ func writePages(db *KV) error {
 	}
 	db.free.Update(db.page.nfree, freed)
 	// extend the file & mmap if needed
-	npages := len(db.page.updates)
-	// fmt.Println("npages:", npages)
+	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
 		return err
 	}
@@ -338,8 +481,7 @@ func syncPages(db *KV) error {
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
+	db.page.flushed += uint64(db.page.nappend)
 	// update & flush the master page
 	if err := masterStore(db); err != nil {
 		return err
@@ -347,29 +489,42 @@ func syncPages(db *KV) error {
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
+	// the pages are on disk now, start a new batch of updates
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
 	return nil
 }
 func loadMeta(db *KV, data []byte) error {
 	root := binary.LittleEndian.Uint64(data[16:])
 	used := binary.LittleEndian.Uint64(data[24:])
+	free := uint64(0)
 	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+	switch {
+	case bytes.Equal([]byte(DB_SIG), data[:16]):
+		free = binary.LittleEndian.Uint64(data[32:])
+	case bytes.Equal([]byte(DB_SIG_V05), data[:16]):
+		// | sig | btree_root | page_used |
+	default:
 		return errors.New("Bad signature.")
 	}
 	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
 	bad = bad || !(0 <= root && root < used)
+	bad = bad || !(free < used)
 	if bad {
 		return errors.New("Bad master page.")
 	}
 	db.tree.Root = root
 	db.page.flushed = used
+	db.free.head = free
 	return nil
 }
 func saveMeta(db *KV) []byte {
-	var data [32]byte
+	var data [40]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.head)
 	return data[:]
 }
 func readRoot(db *KV, fileSize int64) error {
@@ -407,8 +562,11 @@ func Print_Btree(b_node *BNode, c *KV, parent *tree.Tree, id uint64) {
 	}
 	parent.AddChild(tree.NodeString(Bnode_to_string(*b_node, id)))
 	new_tree := parent.Children()[len(parent.Children())-1]
+	if b_node.Ntype() != BNODE_NODE {
+		return // leaf nodes have no kids
+	}
 	for i := uint16(0); i < b_node.Nkeys(); i++ {
-		b_node_child := BNode(c.page.updates[b_node.GetPtr(i)])
+		b_node_child := c.pageGet(b_node.GetPtr(i))
 		Print_Btree(&b_node_child, c, new_tree, b_node.GetPtr(i))
 	}
 }
@@ -416,10 +574,24 @@ func Print_Btree(b_node *BNode, c *KV, parent *tree.Tree, id uint64) {
 func (c *KV) Debug(log string) {
 	fmt.Println("Debug:", log)
 	f := tree.NewTree(tree.NodeString("BTree Root"))
-	a := BNode(c.page.updates[c.tree.Root])
+	a := BNode(nil)
+	if c.tree.Root != 0 {
+		a = c.pageGet(c.tree.Root)
+	}
 	Print_Btree(&a, c, f, c.tree.Root)
 	fmt.Println(f)
 }
 func (kv *KV) GetTree() *BTree {
 	return &kv.tree
 }
+func (kv *KV) GetFreeList() *FreeList {
+	return &kv.free
+}
+
+// read a written page for inspection
+func (kv *KV) Page(ptr uint64) (BNode, error) {
+	if ptr >= kv.page.flushed || int(ptr+1)*BTREE_PAGE_SIZE > kv.mmap.file {
+		return nil, fmt.Errorf("page out of range: %d", ptr)
+	}
+	return kv.pageGet(ptr), nil
+}
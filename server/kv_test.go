@@ -78,8 +78,8 @@ func Test_pageGet(t *testing.T) {
 		t.Fatalf("Failed to open file: %v", err)
 	}
 	defer os.Remove("test_page.txt")
-	// Write a dummy page to the file
-	if _, err := fp.Write(make([]byte, BTREE_PAGE_SIZE)); err != nil {
+	// Write two dummy pages to the file, the mapping past its end faults
+	if _, err := fp.Write(make([]byte, 2*BTREE_PAGE_SIZE)); err != nil {
 		t.Fatalf("Failed to write to temp file: %v", err)
 	}
 
@@ -149,6 +149,47 @@ func Test_MasterLoad(t *testing.T) {
 	assert.Equal(t, db.tree.Root, uint64(12), "Expected root index to be 12")            // r
 }
 
+func Test_masterV05(t *testing.T) {
+	os.Remove("test_v05.db")
+	defer os.Remove("test_v05.db")
+	db := NewKv("test_v05.db")
+	assert.NoError(t, db.Open())
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	db.Close()
+
+	// rewrite the master page in the old format
+	fp, err := os.OpenFile("test_v05.db", os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	var old [40]byte
+	_, err = fp.ReadAt(old[:], 0)
+	assert.NoError(t, err)
+	copy(old[:16], DB_SIG_V05)
+	clear(old[32:])
+	_, err = fp.WriteAt(old[:], 0)
+	assert.NoError(t, err)
+	fp.Close()
+
+	db = NewKv("test_v05.db")
+	assert.NoError(t, db.Open())
+	val, ok := db.Get([]byte("k042"))
+	assert.True(t, ok)
+	assert.Equal(t, "v", string(val))
+	assert.NoError(t, db.Set([]byte("k100"), []byte("v")))
+	db.Close()
+
+	// upgraded by the commit
+	data, err := os.ReadFile("test_v05.db")
+	assert.NoError(t, err)
+	assert.Equal(t, DB_SIG, string(data[:16]))
+	db = NewKv("test_v05.db")
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	_, ok = db.Get([]byte("k100"))
+	assert.True(t, ok)
+}
+
 func Test_pageNew(t *testing.T) {
 	_, err := os.Create("test_page.txt")
 	if err != nil {
@@ -449,3 +490,107 @@ func Test_KV(t *testing.T) {
 
 	fmt.Println("\n=== Test Complete ===")
 }
+
+func Test_delRange(t *testing.T) {
+	path := "test_delrange.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	db := NewKv(path)
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	b := &Batch{}
+	for i := 0; i < 3000; i++ {
+		b.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(randomString(40)))
+	}
+	_, err := db.Commit(b)
+	assert.NoError(t, err)
+	stats := db.Stats()
+	assert.Equal(t, 3000, stats.Keys)
+
+	n, err := db.DelRange([]byte("key00100"), []byte("key02900"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2800, n)
+	assert.Equal(t, 200, db.Stats().Keys)
+	assert.Greater(t, db.Stats().Free, stats.Free)
+	_, ok := db.Get([]byte("key01000"))
+	assert.False(t, ok)
+	_, ok = db.Get([]byte("key00099"))
+	assert.True(t, ok)
+	_, ok = db.Get([]byte("key02900"))
+	assert.True(t, ok)
+
+	// mixed with other updates in a batch, to the end of the key space
+	b = &Batch{}
+	b.Set([]byte("zzz"), []byte("gone"))
+	b.DelRange([]byte("key02950"), nil)
+	b.Set([]byte("zzz"), []byte("last"))
+	n, err = db.Commit(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 51, n)
+	assert.Equal(t, 151, db.Stats().Keys)
+	n, err = db.DelRange([]byte("key"), []byte("key99999"))
+	assert.NoError(t, err)
+	assert.Equal(t, 150, n)
+	val, ok := db.Get([]byte("zzz"))
+	assert.True(t, ok)
+	assert.Equal(t, "last", string(val))
+}
+
+func Test_applyFlush(t *testing.T) {
+	path := "test_apply.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	db := NewKv(path)
+	assert.NoError(t, db.Open())
+
+	// the applied updates are read back before the flush
+	for i := 0; i < 100; i++ {
+		b := &Batch{}
+		b.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v"))
+		if i > 0 {
+			b.Del([]byte(fmt.Sprintf("key%03d", i-1)))
+		}
+		db.Apply(b)
+		val, ok := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		assert.True(t, ok)
+		assert.Equal(t, "v", string(val))
+	}
+	assert.NoError(t, db.Flush())
+	db.Close()
+
+	db = NewKv(path)
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, 1, db.Stats().Keys)
+	_, ok := db.Get([]byte("key099"))
+	assert.True(t, ok)
+}
+
+func Test_keyCount(t *testing.T) {
+	path := "test_keys.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	db := NewKv(path)
+	assert.NoError(t, db.Open())
+	defer db.Close()
+
+	// counted once, then kept by the updates
+	assert.Equal(t, 0, db.Stats().Keys)
+	assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	assert.NoError(t, db.Set([]byte("a"), []byte("2")))
+	assert.NoError(t, db.Set([]byte("b"), []byte("1")))
+	_, err := db.Del([]byte("nope"))
+	assert.NoError(t, err)
+	b := &Batch{}
+	for i := 0; i < 50; i++ {
+		b.Set([]byte(fmt.Sprintf("c%02d", i)), nil)
+	}
+	b.Del([]byte("a"))
+	b.DelRange([]byte("c10"), []byte("c20"))
+	_, err = db.Commit(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 41, db.Stats().Keys)
+	db.counted = false
+	assert.Equal(t, 41, db.Stats().Keys)
+}
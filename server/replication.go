@@ -0,0 +1,577 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	. "types"
+)
+
+// Log shipping replication.
+// Every commit of the primary KV is appended to a replication log file as
+// a list of logical changes. Replicas connect over TCP, send the sequence
+// number of the last commit they applied (the checkpoint), and the primary
+// streams every later commit, first from the log file and then live.
+//
+// An entry is written and fsynced before the master page that publishes
+// the commit, so the log is never behind the KV file. A crash in between
+// leaves an entry the file lacks; the primary replays the last entry when
+// it opens the log. The changes are blind writes, so replaying a commit
+// that is already in the file is harmless.
+//
+// The log keeps the last MaxEntries entries, older ones are dropped in the
+// background once there are twice as many. A replica whose checkpoint is older than the
+// log gets a replication gap and must be rebuilt from a copy of the file.
+//
+// The log entry format, both on disk and on the wire:
+// | seq | nops | op | klen | vlen | key | val | ... |
+// | 8B  | 4B   | 1B | 4B   | 4B   | ... | ... | ... |
+
+const (
+	LOG_SET       = 1 // insert or replace a key
+	LOG_DEL       = 2 // delete a key
+	LOG_DEL_RANGE = 3 // delete the keys in [Key, Val)
+)
+
+// a logical change of a key
+type LogOp struct {
+	Op  byte
+	Key []byte
+	Val []byte
+}
+
+// a committed update in the replication log
+type LogEntry struct {
+	Seq uint64
+	Ops []LogOp
+}
+
+// record a logical change for the replication log
+func (db *KV) logOp(op byte, key []byte, val []byte) {
+	if db.repl == nil {
+		return
+	}
+	db.pending = append(db.pending, LogOp{
+		Op:  op,
+		Key: append([]byte(nil), key...),
+		Val: append([]byte(nil), val...),
+	})
+}
+
+func encodeLogEntry(out []byte, entry *LogEntry) []byte {
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[0:], entry.Seq)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(entry.Ops)))
+	out = append(out, buf[:]...)
+	for _, op := range entry.Ops {
+		var hdr [9]byte
+		hdr[0] = op.Op
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(len(op.Key)))
+		binary.LittleEndian.PutUint32(hdr[5:], uint32(len(op.Val)))
+		out = append(out, hdr[:]...)
+		out = append(out, op.Key...)
+		out = append(out, op.Val...)
+	}
+	return out
+}
+
+// read a log entry, a truncated entry results in io.ErrUnexpectedEOF.
+func readLogEntry(r io.Reader) (*LogEntry, error) {
+	var buf [12]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	entry := &LogEntry{Seq: binary.LittleEndian.Uint64(buf[0:])}
+	nops := binary.LittleEndian.Uint32(buf[8:])
+	for i := uint32(0); i < nops; i++ {
+		var hdr [9]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		klen := binary.LittleEndian.Uint32(hdr[1:])
+		vlen := binary.LittleEndian.Uint32(hdr[5:])
+		if klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE {
+			return nil, errors.New("bad log entry")
+		}
+		data := make([]byte, klen+vlen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		op := LogOp{Op: hdr[0], Key: data[:klen], Val: data[klen:]}
+		entry.Ops = append(entry.Ops, op)
+	}
+	return entry, nil
+}
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// the primary side: owns the replication log and serves the replicas.
+type Primary struct {
+	Path       string // the replication log file
+	MaxEntries int    // the entries kept by the log, 0 keeps all
+	// internals
+	kv     *KV
+	fp     *os.File
+	mu     sync.Mutex
+	cond   *sync.Cond          // signaled on new commits
+	seq    uint64              // the last committed sequence number
+	size   int64               // of the log file
+	count  int                 // entries in the log file
+	sent   map[net.Conn]uint64 // the last entry read for each replica
+	gen    int                 // bumped when a truncation replaces the file
+	closed bool
+	ln     net.Listener
+	// the truncation, in the background for MaxEntries
+	trunc      sync.Mutex // one at a time
+	truncating bool
+	bg         sync.WaitGroup
+}
+
+func NewPrimary(kv *KV, path string) *Primary {
+	p := &Primary{Path: path, kv: kv, sent: map[net.Conn]uint64{}}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// open the replication log and start logging the commits of the KV.
+func (p *Primary) Open() error {
+	fp, err := os.OpenFile(p.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	// find the last entry
+	rd := bufio.NewReader(fp)
+	good := int64(0)
+	var last *LogEntry
+	for {
+		entry, err := readLogEntry(rd)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			break // a torn write from a crash, discard it
+		}
+		if err != nil {
+			fp.Close()
+			return fmt.Errorf("Primary.Open: %w", err)
+		}
+		last = entry
+		p.count++
+		good += int64(len(encodeLogEntry(nil, entry)))
+	}
+	if err := fp.Truncate(good); err != nil {
+		fp.Close()
+		return fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := fp.Seek(good, io.SeekStart); err != nil {
+		fp.Close()
+		return fmt.Errorf("seek: %w", err)
+	}
+	// the last commit may not have reached the KV file
+	if last != nil {
+		if err := applyLog(p.kv, last.Ops); err != nil {
+			fp.Close()
+			return fmt.Errorf("Primary.Open: replay %d: %w", last.Seq, err)
+		}
+		p.seq = last.Seq
+	}
+	p.fp = fp
+	p.size = good
+	p.kv.repl = p
+	return nil
+}
+
+// the sequence number of the last commit
+func (p *Primary) Seq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seq
+}
+
+// called by the KV before each commit is published.
+func (p *Primary) append(ops []LogOp) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := &LogEntry{Seq: p.seq + 1, Ops: ops}
+	data := encodeLogEntry(nil, entry)
+	_, err := p.fp.Write(data)
+	if err == nil {
+		err = p.fp.Sync()
+	}
+	if err != nil {
+		// drop a partial entry, the next commit logs the changes again.
+		// the replicas read only up to p.size, they never see it.
+		p.fp.Truncate(p.size)
+		p.fp.Seek(p.size, io.SeekStart)
+		return fmt.Errorf("write log: %w", err)
+	}
+	p.seq = entry.Seq
+	p.size += int64(len(data))
+	p.count++
+	p.cond.Broadcast()
+	if p.MaxEntries > 0 && p.count > 2*p.MaxEntries && !p.truncating {
+		// keep what the connected replicas have yet to read.
+		// the entry is durable, a failed truncation is retried later.
+		seq := p.seq - uint64(p.MaxEntries)
+		for _, sent := range p.sent {
+			seq = min(seq, sent)
+		}
+		p.truncating = true
+		p.bg.Add(1)
+		go func() {
+			defer p.bg.Done()
+			logTruncate(p, seq)
+			p.mu.Lock()
+			p.truncating = false
+			p.mu.Unlock()
+		}()
+	}
+	return nil
+}
+
+// drop the entries up to seq, the last entry is always kept.
+// unlike MaxEntries, it does not wait for the connected replicas.
+func (p *Primary) Truncate(seq uint64) error {
+	return logTruncate(p, seq)
+}
+
+// rewrite the log without the old entries, then replace it. the commits
+// go on while the old entries are copied, the lock is only held to copy
+// the entries appended in the meantime and to switch the files.
+// the replicas reading the old file switch to the new one.
+func logTruncate(p *Primary, seq uint64) error {
+	p.trunc.Lock()
+	defer p.trunc.Unlock()
+	p.mu.Lock()
+	seq = min(seq, p.seq-1)
+	fp, size, count := p.fp, p.size, p.count
+	p.mu.Unlock()
+
+	tmp := p.Path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	kept, nkept := int64(0), 0
+	wr := bufio.NewWriter(out)
+	rd := bufio.NewReader(io.NewSectionReader(fp, 0, size))
+	for {
+		entry, err := readLogEntry(rd)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && entry.Seq > seq {
+			data := encodeLogEntry(nil, entry)
+			_, err = wr.Write(data)
+			kept, nkept = kept+int64(len(data)), nkept+1
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return fail(errors.New("closed"))
+	}
+	_, err = io.Copy(wr, io.NewSectionReader(fp, size, p.size-size))
+	if err == nil {
+		err = wr.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, p.Path)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	p.fp.Close()
+	p.fp = out
+	p.size, p.count = kept+p.size-size, nkept+p.count-count
+	p.gen++
+	return nil
+}
+
+// accept replica connections until the listener is closed.
+func (p *Primary) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go p.ship(conn)
+	}
+}
+
+// stream the log to a replica, starting after its checkpoint.
+func (p *Primary) ship(conn net.Conn) {
+	defer conn.Close()
+	var buf [8]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	ckpt := binary.LittleEndian.Uint64(buf[:])
+	sent := uint64(0) // the last entry read from the log
+	var fp *os.File
+	gen, pos := 0, int64(0) // of the file read
+	defer func() {
+		if fp != nil {
+			fp.Close()
+		}
+		p.mu.Lock()
+		delete(p.sent, conn)
+		p.mu.Unlock()
+	}()
+	for {
+		// wait for new commits
+		p.mu.Lock()
+		p.sent[conn] = max(sent, ckpt)
+		for sent >= p.seq && !p.closed {
+			p.cond.Wait()
+		}
+		closed, size := p.closed, p.size
+		if !closed && (fp == nil || gen != p.gen) {
+			// the first time, or after a truncation
+			if fp != nil {
+				fp.Close()
+			}
+			f, err := os.Open(p.Path)
+			if err != nil {
+				p.mu.Unlock()
+				return
+			}
+			fp, gen, pos = f, p.gen, 0
+		}
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+		// the committed entries only, not a partial one of a failed append
+		rd := bufio.NewReader(io.NewSectionReader(fp, pos, size-pos))
+		for {
+			entry, err := readLogEntry(rd)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+			data := encodeLogEntry(nil, entry)
+			pos += int64(len(data))
+			if entry.Seq <= sent {
+				continue // read before the log was truncated
+			}
+			sent = entry.Seq
+			if entry.Seq <= ckpt {
+				continue // the replica already has it
+			}
+			if _, err := conn.Write(data); err != nil {
+				return // the replica is gone
+			}
+		}
+	}
+}
+
+// stop serving and close the log. the KV is not closed.
+func (p *Primary) Close() {
+	p.mu.Lock()
+	p.closed = true
+	ln := p.ln
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	p.bg.Wait()
+	p.kv.repl = nil
+	p.fp.Close()
+}
+
+// the replica side: applies the log of a primary to its own KV file,
+// and serves read-only queries.
+type Replica struct {
+	// internals
+	kv   *KV
+	ckpt *os.File // the checkpoint file, holds the last applied seq
+	mu   sync.RWMutex
+	seq  uint64
+	conn net.Conn
+}
+
+func NewReplica(kv *KV) *Replica {
+	return &Replica{kv: kv}
+}
+
+// load the checkpoint, which is stored next to the KV file.
+func (r *Replica) Open() error {
+	fp, err := os.OpenFile(r.kv.Path+".ckpt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	var buf [8]byte
+	n, err := fp.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		fp.Close()
+		return fmt.Errorf("read checkpoint: %w", err)
+	}
+	if n == len(buf) {
+		r.seq = binary.LittleEndian.Uint64(buf[:])
+	}
+	r.ckpt = fp
+	return nil
+}
+
+// the sequence number of the last applied commit
+func (r *Replica) Seq() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.seq
+}
+
+// connect to the primary and apply its log until disconnected.
+func (r *Replica) Follow(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	r.conn = conn
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], r.seq)
+	r.mu.Unlock()
+	if _, err := conn.Write(buf[:]); err != nil {
+		return fmt.Errorf("send checkpoint: %w", err)
+	}
+	rd := bufio.NewReader(conn)
+	for {
+		entry, err := readLogEntry(rd)
+		if err != nil {
+			r.mu.Lock()
+			stopped := r.conn == nil
+			r.mu.Unlock()
+			if stopped || err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read log: %w", err)
+		}
+		if err := r.apply(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// drop the connection to the primary, Follow() can be called again later.
+func (r *Replica) Disconnect() {
+	r.mu.Lock()
+	conn := r.conn
+	r.conn = nil
+	r.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// apply a commit of the primary as a single commit of the replica.
+// the checkpoint is written after the KV commit, replaying an entry after
+// a crash in between is harmless since the changes are idempotent.
+func (r *Replica) apply(entry *LogEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry.Seq <= r.seq {
+		return nil
+	}
+	if entry.Seq != r.seq+1 {
+		return fmt.Errorf("replication gap: have %d, got %d", r.seq, entry.Seq)
+	}
+	if err := applyLog(r.kv, entry.Ops); err != nil {
+		return err
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], entry.Seq)
+	if _, err := r.ckpt.WriteAt(buf[:], 0); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := r.ckpt.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	r.seq = entry.Seq
+	return nil
+}
+
+// apply the changes of a log entry as a single commit, which is not logged
+func applyLog(kv *KV, ops []LogOp) error {
+	for _, op := range ops {
+		switch op.Op {
+		case LOG_SET:
+			kvInsert(kv, op.Key, op.Val)
+		case LOG_DEL:
+			kvDelete(kv, op.Key)
+		case LOG_DEL_RANGE:
+			kvDeleteRange(kv, op.Key, op.Val)
+		default:
+			return errors.New("bad log op")
+		}
+	}
+	return flushPages(kv)
+}
+
+// read a key from the replica
+func (r *Replica) Get(key []byte) ([]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.kv.Get(key)
+}
+
+// iterate over the keys in [start, end] in order until fn returns false.
+func (r *Replica) Scan(start []byte, end []byte, fn func(key, val []byte) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.kv.tree.Root == 0 {
+		return
+	}
+	for iter := r.kv.tree.Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !CmpOK(key, CMP_LE, end) {
+			break
+		}
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		if !fn(key, val) {
+			break
+		}
+	}
+}
+
+// stop following the primary and close the checkpoint. the KV is not closed.
+func (r *Replica) Close() {
+	r.Disconnect()
+	r.ckpt.Close()
+}
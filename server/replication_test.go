@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitSeq(t *testing.T, r *Replica, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Seq() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica stuck at %d, want %d", r.Seq(), seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_replication(t *testing.T) {
+	os.Remove("test_primary.db")
+	os.Remove("test_primary.log")
+	os.Remove("test_replica.db")
+	os.Remove("test_replica.db.ckpt")
+	defer os.Remove("test_primary.db")
+	defer os.Remove("test_primary.log")
+	defer os.Remove("test_replica.db")
+	defer os.Remove("test_replica.db.ckpt")
+
+	// the primary
+	kv := NewKv("test_primary.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	primary := NewPrimary(kv, "test_primary.log")
+	assert.NoError(t, primary.Open())
+	defer primary.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go primary.Serve(ln)
+
+	// the replica
+	rkv := NewKv("test_replica.db")
+	assert.NoError(t, rkv.Open())
+	replica := NewReplica(rkv)
+	assert.NoError(t, replica.Open())
+	done := make(chan error, 1)
+	go func() { done <- replica.Follow(ln.Addr().String()) }()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		assert.NoError(t, kv.Set([]byte(key), []byte(fmt.Sprint(i))))
+	}
+	_, err = kv.Del([]byte("key007"))
+	assert.NoError(t, err)
+	n, err := kv.DelRange([]byte("key020"), []byte("key030"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	waitSeq(t, replica, primary.Seq())
+	_, ok := replica.Get([]byte("key025"))
+	assert.False(t, ok)
+
+	val, ok := replica.Get([]byte("key042"))
+	assert.True(t, ok)
+	assert.Equal(t, "42", string(val))
+	_, ok = replica.Get([]byte("key007"))
+	assert.False(t, ok)
+	keys := []string{}
+	replica.Scan([]byte("key005"), []byte("key010"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"key005", "key006", "key008", "key009", "key010"}, keys)
+
+	// catch up from the checkpoint after a disconnection
+	replica.Disconnect()
+	assert.NoError(t, <-done)
+	for i := 50; i < 80; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		assert.NoError(t, kv.Set([]byte(key), []byte(fmt.Sprint(i))))
+	}
+	go func() { done <- replica.Follow(ln.Addr().String()) }()
+	waitSeq(t, replica, primary.Seq())
+	val, ok = replica.Get([]byte("key079"))
+	assert.True(t, ok)
+	assert.Equal(t, "79", string(val))
+	replica.Disconnect()
+	assert.NoError(t, <-done)
+
+	// the replica survives a restart
+	replica.Close()
+	rkv.Close()
+	rkv = NewKv("test_replica.db")
+	assert.NoError(t, rkv.Open())
+	defer rkv.Close()
+	replica = NewReplica(rkv)
+	assert.NoError(t, replica.Open())
+	defer replica.Close()
+	assert.Equal(t, primary.Seq(), replica.Seq())
+	val, ok = replica.Get([]byte("key042"))
+	assert.True(t, ok)
+	assert.Equal(t, "42", string(val))
+}
+
+func Test_reopen(t *testing.T) {
+	os.Remove("test_reopen.db")
+	defer os.Remove("test_reopen.db")
+	kv := NewKv("test_reopen.db")
+	assert.NoError(t, kv.Open())
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		assert.NoError(t, kv.Set([]byte(key), []byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 300; i += 2 {
+		key := fmt.Sprintf("key%03d", i)
+		_, err := kv.Del([]byte(key))
+		assert.NoError(t, err)
+	}
+	kv.Close()
+
+	kv = NewKv("test_reopen.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	for i := 0; i < 300; i++ {
+		val, ok := kv.Get([]byte(fmt.Sprintf("key%03d", i)))
+		assert.Equal(t, i%2 == 1, ok)
+		if ok {
+			assert.Equal(t, fmt.Sprint(i), string(val))
+		}
+	}
+	// freed pages are reused instead of growing the file
+	used := kv.page.flushed
+	for i := 0; i < 300; i += 2 {
+		assert.NoError(t, kv.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("x")))
+	}
+	assert.True(t, kv.page.flushed < used+50)
+}
+
+func Test_replay(t *testing.T) {
+	os.Remove("test_replay.db")
+	os.Remove("test_replay.log")
+	defer os.Remove("test_replay.db")
+	defer os.Remove("test_replay.log")
+	kv := NewKv("test_replay.db")
+	assert.NoError(t, kv.Open())
+	primary := NewPrimary(kv, "test_replay.log")
+	assert.NoError(t, primary.Open())
+	assert.NoError(t, kv.Set([]byte("a"), []byte("1")))
+	// a crash after the log entry, before the master page
+	assert.NoError(t, primary.append([]LogOp{{Op: LOG_SET, Key: []byte("b"), Val: []byte("2")}}))
+	primary.Close()
+	kv.Close()
+
+	kv = NewKv("test_replay.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	_, ok := kv.Get([]byte("b"))
+	assert.False(t, ok)
+	primary = NewPrimary(kv, "test_replay.log")
+	assert.NoError(t, primary.Open())
+	defer primary.Close()
+	assert.Equal(t, uint64(2), primary.Seq())
+	val, ok := kv.Get([]byte("b"))
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(val))
+	val, _ = kv.Get([]byte("a"))
+	assert.Equal(t, "1", string(val))
+}
+
+func Test_logTruncate(t *testing.T) {
+	for _, name := range []string{"test_trunc.db", "test_trunc.log", "test_trunc_r.db", "test_trunc_r.db.ckpt",
+		"test_trunc_o.db", "test_trunc_o.db.ckpt"} {
+		os.Remove(name)
+		defer os.Remove(name)
+	}
+	kv := NewKv("test_trunc.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	primary := NewPrimary(kv, "test_trunc.log")
+	primary.MaxEntries = 5
+	assert.NoError(t, primary.Open())
+	defer primary.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go primary.Serve(ln)
+	set := func(from, to int) {
+		for i := from; i < to; i++ {
+			assert.NoError(t, kv.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v")))
+		}
+	}
+
+	// the 11th entry drops the first 6, in the background
+	set(0, 11)
+	primary.bg.Wait()
+	assert.Equal(t, 5, primary.count)
+
+	// a replica older than the log
+	other := NewKv("test_trunc_o.db")
+	assert.NoError(t, other.Open())
+	defer other.Close()
+	stale := NewReplica(other)
+	assert.NoError(t, stale.Open())
+	defer stale.Close()
+	assert.ErrorContains(t, stale.Follow(ln.Addr().String()), "replication gap")
+
+	// a replica rebuilt from a copy of the file follows across truncations
+	data, err := os.ReadFile("test_trunc.db")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile("test_trunc_r.db", data, 0644))
+	var ckpt [8]byte
+	binary.LittleEndian.PutUint64(ckpt[:], primary.Seq())
+	assert.NoError(t, os.WriteFile("test_trunc_r.db.ckpt", ckpt[:], 0644))
+	rkv := NewKv("test_trunc_r.db")
+	assert.NoError(t, rkv.Open())
+	defer rkv.Close()
+	replica := NewReplica(rkv)
+	assert.NoError(t, replica.Open())
+	defer replica.Close()
+	done := make(chan error, 1)
+	go func() { done <- replica.Follow(ln.Addr().String()) }()
+	set(11, 12)
+	waitSeq(t, replica, primary.Seq())
+	set(12, 60)
+	waitSeq(t, replica, primary.Seq())
+	for _, key := range []string{"key000", "key030", "key059"} {
+		_, ok := replica.Get([]byte(key))
+		assert.True(t, ok, key)
+	}
+	replica.Disconnect()
+	assert.NoError(t, <-done)
+
+	// the log keeps its last entry
+	primary.bg.Wait()
+	assert.NoError(t, primary.Truncate(primary.Seq()))
+	assert.Equal(t, 1, primary.count)
+	set(60, 61)
+	assert.Equal(t, uint64(61), primary.Seq())
+}
+
+func Test_partialEntry(t *testing.T) {
+	for _, name := range []string{"test_part.db", "test_part.log", "test_part_r.db", "test_part_r.db.ckpt"} {
+		os.Remove(name)
+		defer os.Remove(name)
+	}
+	kv := NewKv("test_part.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	primary := NewPrimary(kv, "test_part.log")
+	assert.NoError(t, primary.Open())
+	defer primary.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go primary.Serve(ln)
+	assert.NoError(t, kv.Set([]byte("k1"), []byte("v1")))
+
+	// a failed append leaves a partial entry until the truncation
+	ops := []LogOp{{Op: LOG_SET, Key: []byte("k2"), Val: []byte("x")}, {Op: LOG_DEL, Key: []byte("k1")}}
+	partial := encodeLogEntry(nil, &LogEntry{Seq: 2, Ops: ops})
+	_, err = primary.fp.Write(partial[:len(partial)/2])
+	assert.NoError(t, err)
+
+	// a replica reads the committed entries only
+	rkv := NewKv("test_part_r.db")
+	assert.NoError(t, rkv.Open())
+	defer rkv.Close()
+	replica := NewReplica(rkv)
+	assert.NoError(t, replica.Open())
+	defer replica.Close()
+	done := make(chan error, 1)
+	go func() { done <- replica.Follow(ln.Addr().String()) }()
+	waitSeq(t, replica, 1)
+
+	primary.mu.Lock()
+	assert.NoError(t, primary.fp.Truncate(primary.size))
+	_, err = primary.fp.Seek(primary.size, 0)
+	assert.NoError(t, err)
+	primary.mu.Unlock()
+	assert.NoError(t, kv.Set([]byte("k2"), []byte("v2")))
+	waitSeq(t, replica, 2)
+	val, ok := replica.Get([]byte("k2"))
+	assert.True(t, ok)
+	assert.Equal(t, "v2", string(val))
+	replica.Disconnect()
+	assert.NoError(t, <-done)
+}
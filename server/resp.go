@@ -0,0 +1,463 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	. "types"
+)
+
+// A network front-end speaking a subset of the Redis protocol (RESP).
+// Commands are arrays of bulk strings, inline commands are also accepted.
+// Replies are buffered and flushed once the pipelined requests are drained.
+
+const RESP_MAX_BULK = 1 << 20
+
+type RespServer struct {
+	// internals
+	kv     *KV
+	mu     sync.Mutex // serialize the KV access
+	ln     net.Listener
+	closed bool
+}
+
+func NewRespServer(kv *KV) *RespServer {
+	kv.Stats() // count the keys before serving, INFO then reads the count
+	return &RespServer{kv: kv}
+}
+
+// accept connections until the listener is closed.
+func (s *RespServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// stop accepting connections. the KV is not closed.
+func (s *RespServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	ln := s.ln
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+}
+
+func (s *RespServer) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			if err != io.EOF {
+				respError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.exec(w, args)
+		}
+		// reply to a pipeline in one go
+		if rd.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read a request: either an array of bulk strings or an inline command.
+func readCommand(rd *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil // inline command
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > RESP_MAX_BULK {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("expected '$'")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, errors.New("invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, errors.New("expected CRLF")
+		}
+		args = append(args, data[:size])
+	}
+	return args, nil
+}
+func readLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// reply types
+func respSimple(w *bufio.Writer, msg string) {
+	w.WriteString("+" + msg + "\r\n")
+}
+func respError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+func respInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+func respBulk(w *bufio.Writer, data []byte) {
+	w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+	w.Write(data)
+	w.WriteString("\r\n")
+}
+func respNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+func respArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func checkKey(key []byte) error {
+	if len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE {
+		return errors.New("ERR invalid key length")
+	}
+	return nil
+}
+func checkVal(val []byte) error {
+	if len(val) > BTREE_MAX_VAL_SIZE {
+		return errors.New("ERR value is too large")
+	}
+	return nil
+}
+
+// execute a command and write the reply
+func (s *RespServer) exec(w *bufio.Writer, args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := map[string]int{ // minimal number of arguments
+		"PING": 0, "GET": 1, "SET": 2, "DEL": 1, "EXISTS": 1,
+		"MGET": 1, "MSET": 2, "SCAN": 1, "INFO": 0,
+	}
+	n, ok := arity[name]
+	if !ok {
+		respError(w, fmt.Sprintf("ERR unknown command '%s'", name))
+		return
+	}
+	if len(args) < n {
+		respError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	for _, key := range respKeys(name, args) {
+		if err := checkKey(key); err != nil {
+			respError(w, err.Error())
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			respBulk(w, args[0])
+		} else {
+			respSimple(w, "PONG")
+		}
+	case "GET":
+		if val, ok := s.kv.Get(args[0]); ok {
+			respBulk(w, val)
+		} else {
+			respNull(w)
+		}
+	case "SET":
+		err = s.cmdSet(w, args)
+	case "DEL", "EXISTS":
+		err = s.cmdDel(w, name, args)
+	case "MGET":
+		respArray(w, len(args))
+		for _, key := range args {
+			if val, ok := s.kv.Get(key); ok {
+				respBulk(w, val)
+			} else {
+				respNull(w)
+			}
+		}
+	case "MSET":
+		err = s.cmdMSet(w, args)
+	case "SCAN":
+		err = s.cmdScan(w, args)
+	case "INFO":
+		respBulk(w, s.info())
+	}
+	if err != nil {
+		respError(w, err.Error())
+	}
+}
+
+// the arguments that are keys
+func respKeys(name string, args [][]byte) [][]byte {
+	switch name {
+	case "GET", "SET":
+		return args[:1]
+	case "DEL", "EXISTS", "MGET":
+		return args
+	case "MSET":
+		keys := [][]byte{}
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return nil
+}
+
+// SET key value [NX|XX]
+func (s *RespServer) cmdSet(w *bufio.Writer, args [][]byte) error {
+	if err := checkVal(args[1]); err != nil {
+		return err
+	}
+	mode := MODE_UPSERT
+	for _, opt := range args[2:] {
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			mode = MODE_INSERT_ONLY
+		case "XX":
+			mode = MODE_UPDATE_ONLY
+		default:
+			return errors.New("ERR syntax error")
+		}
+	}
+	if _, ok := s.kv.Get(args[0]); (ok && mode == MODE_INSERT_ONLY) || (!ok && mode == MODE_UPDATE_ONLY) {
+		respNull(w) // the condition is not met
+		return nil
+	}
+	if _, err := s.kv.Update(args[0], args[1], mode); err != nil {
+		return fmt.Errorf("ERR %w", err)
+	}
+	respSimple(w, "OK")
+	return nil
+}
+
+// DEL key [key ...] or EXISTS key [key ...]
+func (s *RespServer) cmdDel(w *bufio.Writer, name string, args [][]byte) error {
+	if name == "EXISTS" {
+		count := 0
+		for _, key := range args {
+			if _, ok := s.kv.Get(key); ok {
+				count++
+			}
+		}
+		respInt(w, count)
+		return nil
+	}
+	b := Batch{}
+	for _, key := range args {
+		b.Del(key)
+	}
+	deleted, err := s.kv.Commit(&b)
+	if err != nil {
+		return fmt.Errorf("ERR %w", err)
+	}
+	respInt(w, deleted)
+	return nil
+}
+
+// MSET key value [key value ...], in one commit
+func (s *RespServer) cmdMSet(w *bufio.Writer, args [][]byte) error {
+	if len(args)%2 != 0 {
+		return errors.New("ERR wrong number of arguments for 'mset' command")
+	}
+	b := Batch{}
+	for i := 0; i < len(args); i += 2 {
+		if err := checkVal(args[i+1]); err != nil {
+			return err
+		}
+		b.Set(args[i], args[i+1])
+	}
+	if _, err := s.kv.Commit(&b); err != nil {
+		return fmt.Errorf("ERR %w", err)
+	}
+	respSimple(w, "OK")
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// the cursor is "0" to start, otherwise the hex encoded key to resume from.
+// a "0" cursor in the reply means the iteration is complete.
+func (s *RespServer) cmdScan(w *bufio.Writer, args [][]byte) error {
+	var start []byte
+	if cursor := string(args[0]); cursor != "0" {
+		key, err := hex.DecodeString(cursor)
+		if err != nil || len(key) == 0 {
+			return errors.New("ERR invalid cursor")
+		}
+		start = key
+	}
+	pattern, count := []byte("*"), 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errors.New("ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				return errors.New("ERR value is not an integer or out of range")
+			}
+			count = n
+		default:
+			return errors.New("ERR syntax error")
+		}
+	}
+	keys, next := [][]byte{}, "0"
+	if s.kv.tree.Root != 0 {
+		iter := s.kv.tree.Seek(start, CMP_GE)
+		for visited := 0; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			if visited == count {
+				next = hex.EncodeToString(key)
+				break
+			}
+			visited++
+			if globMatch(pattern, key) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+		}
+	}
+	respArray(w, 2)
+	respBulk(w, []byte(next))
+	respArray(w, len(keys))
+	for _, key := range keys {
+		respBulk(w, key)
+	}
+	return nil
+}
+
+// the INFO reply
+func (s *RespServer) info() []byte {
+	stats := s.kv.Stats()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Server\r\n")
+	fmt.Fprintf(&buf, "path:%s\r\n", s.kv.Path)
+	fmt.Fprintf(&buf, "page_size:%d\r\n", BTREE_PAGE_SIZE)
+	fmt.Fprintf(&buf, "\r\n# Storage\r\n")
+	fmt.Fprintf(&buf, "file_size:%d\r\n", stats.FileSize)
+	fmt.Fprintf(&buf, "pages_used:%d\r\n", stats.Pages)
+	fmt.Fprintf(&buf, "pages_free:%d\r\n", stats.Free)
+	fmt.Fprintf(&buf, "root_page:%d\r\n", stats.Root)
+	fmt.Fprintf(&buf, "\r\n# Keyspace\r\n")
+	fmt.Fprintf(&buf, "keys:%d\r\n", stats.Keys)
+	return buf.Bytes()
+}
+
+// Redis style glob: * ? [abc] [^a-z] and \ escapes
+func globMatch(pattern []byte, str []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(pattern, str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			end := bytes.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			found := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= str[0] && str[0] <= class[i+2] {
+						found = true
+					}
+					i += 2
+				} else if class[i] == str[0] {
+					found = true
+				}
+			}
+			if found == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || str[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		str = str[1:]
+	}
+	return len(str) == 0
+}
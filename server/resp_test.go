@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func respCmd(args ...string) string {
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return sb.String()
+}
+
+func Test_globMatch(t *testing.T) {
+	assert.True(t, globMatch([]byte("*"), []byte("anything")))
+	assert.True(t, globMatch([]byte("user:*"), []byte("user:42")))
+	assert.False(t, globMatch([]byte("user:*"), []byte("item:42")))
+	assert.True(t, globMatch([]byte("h?llo"), []byte("hello")))
+	assert.True(t, globMatch([]byte("h[ae]llo"), []byte("hallo")))
+	assert.False(t, globMatch([]byte("h[^e]llo"), []byte("hello")))
+	assert.True(t, globMatch([]byte("h[a-c]llo"), []byte("hbllo")))
+	assert.True(t, globMatch([]byte(`a\*b`), []byte("a*b")))
+	assert.False(t, globMatch([]byte(`a\*b`), []byte("axb")))
+}
+
+func Test_resp(t *testing.T) {
+	os.Remove("test_resp.db")
+	defer os.Remove("test_resp.db")
+	kv := NewKv("test_resp.db")
+	assert.NoError(t, kv.Open())
+	defer kv.Close()
+	srv := NewRespServer(kv)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	expect := func(replies ...string) {
+		for _, want := range replies {
+			got := ""
+			for len(got) < len(want) {
+				line, err := rd.ReadString('\n')
+				assert.NoError(t, err)
+				got += line
+			}
+			assert.Equal(t, want, got)
+		}
+	}
+
+	// pipelined requests
+	_, err = conn.Write([]byte(
+		respCmd("PING") +
+			respCmd("SET", "a", "1") +
+			respCmd("SET", "a", "2", "NX") +
+			respCmd("SET", "b", "2", "XX") +
+			respCmd("SET", "a", "3", "XX") +
+			respCmd("GET", "a") +
+			respCmd("GET", "b") +
+			respCmd("MSET", "k1", "v1", "k2", "v2", "k3", "v3") +
+			respCmd("MGET", "k1", "nope", "k3") +
+			respCmd("EXISTS", "k1", "k2", "nope") +
+			respCmd("DEL", "k2", "nope") +
+			respCmd("EXISTS", "k2")))
+	assert.NoError(t, err)
+	expect(
+		"+PONG\r\n",
+		"+OK\r\n",
+		"$-1\r\n",
+		"$-1\r\n",
+		"+OK\r\n",
+		"$1\r\n3\r\n",
+		"$-1\r\n",
+		"+OK\r\n",
+		"*3\r\n$2\r\nv1\r\n$-1\r\n$2\r\nv3\r\n",
+		":2\r\n",
+		":1\r\n",
+		":0\r\n",
+	)
+
+	// inline commands and errors
+	_, err = conn.Write([]byte("ping hello\r\nFOO\r\nGET\r\n"))
+	assert.NoError(t, err)
+	expect(
+		"$5\r\nhello\r\n",
+		"-ERR unknown command 'FOO'\r\n",
+		"-ERR wrong number of arguments for 'get' command\r\n",
+	)
+
+	// scan with a cursor: a, k1, k3
+	_, err = conn.Write([]byte(respCmd("SCAN", "0", "COUNT", "2")))
+	assert.NoError(t, err)
+	expect("*2\r\n$4\r\n6b33\r\n", "*2\r\n$1\r\na\r\n$2\r\nk1\r\n")
+	_, err = conn.Write([]byte(respCmd("SCAN", "6b33", "MATCH", "k*")))
+	assert.NoError(t, err)
+	expect("*2\r\n$1\r\n0\r\n", "*1\r\n$2\r\nk3\r\n")
+
+	_, err = conn.Write([]byte(respCmd("INFO")))
+	assert.NoError(t, err)
+	line, err := rd.ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "$"))
+	info := ""
+	for !strings.Contains(info, "keys:") {
+		line, err = rd.ReadString('\n')
+		assert.NoError(t, err)
+		info += line
+	}
+	assert.Contains(t, info, "keys:3\r\n")
+}
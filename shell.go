@@ -0,0 +1,474 @@
+package main
+
+import (
+	. "db"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	. "server"
+	"strconv"
+	"strings"
+	. "types"
+)
+
+// the command line shell, see the help text for the commands.
+type Shell struct {
+	db      *DB
+	out     io.Writer
+	history []string
+}
+
+const shellHelp = `raw keys:
+  get <key>                   read a key
+  set <key> <val>             write a key
+  del <key>                   delete a key
+  scan <start> [end] [limit]  list the keys in [start, end]
+tables:
+  tables                      list the tables
+  describe <table>            show a table definition
+  create <table> <col>:<type> ... [pkeys=N]
+                              types: bytes int64 float64 bool timestamp decimal
+  insert <table> <col>=<val> ...
+  select <table> [<col>=<val> ...]
+  sql <statement>             run CREATE TABLE, ALTER TABLE, DROP TABLE,
+                              TRUNCATE, CREATE INDEX, INSERT, SELECT,
+                              UPDATE, DELETE, ANALYZE or EXPLAIN
+  dump <file>                 write a logical dump of the database
+  restore <file>              load a dump into the database
+storage:
+  stats                       database statistics
+  dump-page <N>               decode a page
+  free-list                   print the free list
+  tree                        draw the B-tree
+shell:
+  history, !N, !!             list or repeat commands
+  help, quit
+keys and values may be double quoted with Go escapes, e.g. "a\x00b".`
+
+var errQuit = errors.New("quit")
+
+func NewShell(db *DB, out io.Writer) *Shell {
+	return &Shell{db: db, out: out}
+}
+
+// split a command line, double quoted words use the Go escapes.
+func shellSplit(line string) ([]string, error) {
+	args := []string{}
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string: %s", line)
+			}
+			word, _ := strconv.Unquote(quoted)
+			args = append(args, word)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		args = append(args, line[:end])
+		line = line[end:]
+	}
+}
+
+// run a command line
+func (sh *Shell) Exec(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	// history expansion
+	if line[0] == '!' {
+		n := len(sh.history)
+		if line != "!!" {
+			i, err := strconv.Atoi(line[1:])
+			if err != nil || i < 1 || i > len(sh.history) {
+				return fmt.Errorf("no such command in history: %s", line)
+			}
+			n = i
+		}
+		if n == 0 {
+			return errors.New("the history is empty")
+		}
+		line = sh.history[n-1]
+		fmt.Fprintln(sh.out, line)
+	}
+	sh.history = append(sh.history, line)
+	// the SQL text is passed as is
+	if cmd, stmt, _ := strings.Cut(line, " "); strings.EqualFold(cmd, "sql") {
+		return sh.sql(stmt)
+	}
+	args, err := shellSplit(line)
+	if err != nil {
+		return err
+	}
+	return sh.exec(args[0], args[1:])
+}
+
+func (sh *Shell) exec(cmd string, args []string) error {
+	arity := map[string]int{
+		"get": 1, "set": 2, "del": 1, "scan": 1,
+		"describe": 1, "create": 2, "insert": 2, "select": 1, "dump-page": 1,
+		"dump": 1, "restore": 1,
+	}
+	if len(args) < arity[cmd] {
+		return fmt.Errorf("%s: missing arguments", cmd)
+	}
+	kv := sh.db.GetKV()
+	switch cmd {
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+	case "quit", "exit":
+		return errQuit
+	case "history":
+		for i, line := range sh.history {
+			fmt.Fprintf(sh.out, "%5d  %s\n", i+1, line)
+		}
+	case "get":
+		val, ok := kv.Get([]byte(args[0]))
+		if !ok {
+			return fmt.Errorf("key not found: %q", args[0])
+		}
+		fmt.Fprintf(sh.out, "%q\n", val)
+	case "set":
+		if err := kv.Set([]byte(args[0]), []byte(args[1])); err != nil {
+			return err
+		}
+	case "del":
+		deleted, err := kv.Del([]byte(args[0]))
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("key not found: %q", args[0])
+		}
+	case "scan":
+		return sh.scan(kv, args)
+	case "tables":
+		for _, name := range sh.db.ListTables() {
+			fmt.Fprintln(sh.out, name)
+		}
+	case "describe":
+		tdef := sh.db.GetTableDef(args[0])
+		if tdef == nil {
+			return fmt.Errorf("%w: %s", ErrTableNotFound, args[0])
+		}
+		fmt.Fprintf(sh.out, "table %s (prefix %d, version %d)\n", tdef.Name, tdef.Prefix, tdef.Version)
+		for i, col := range tdef.Cols {
+			pk := ""
+			if i < tdef.PKeys {
+				pk = " primary key"
+			} else if i < len(tdef.Nullable) && tdef.Nullable[i] {
+				pk = " null"
+			}
+			if i < len(tdef.Defaults) && tdef.Defaults[i].Type != TYPE_ERROR {
+				pk += " default " + FormatValue(&tdef.Defaults[i])
+			}
+			fmt.Fprintf(sh.out, "  %s %s%s\n", col, TypeName(tdef.Types[i]), pk)
+		}
+		for i, index := range tdef.Indexes {
+			kind := "index"
+			if i < len(tdef.Unique) && tdef.Unique[i] {
+				kind = "unique index"
+			}
+			if i < len(tdef.Building) && tdef.Building[i] {
+				kind += " (building)"
+			}
+			fmt.Fprintf(sh.out, "  %s (%s) prefix %d\n", kind, strings.Join(index, ", "), tdef.IndexPrefixes[i])
+		}
+	case "create":
+		return sh.create(args)
+	case "insert":
+		tdef := sh.db.GetTableDef(args[0])
+		if tdef == nil {
+			return fmt.Errorf("%w: %s", ErrTableNotFound, args[0])
+		}
+		rec, err := parseRecord(tdef, args[1:])
+		if err != nil {
+			return err
+		}
+		_, err = sh.db.Insert(args[0], rec)
+		return err
+	case "select":
+		return sh.query(args)
+	case "dump":
+		return sh.dump(args[0])
+	case "restore":
+		fp, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		return sh.db.Restore(fp)
+	case "stats":
+		stats := kv.Stats()
+		fmt.Fprintf(sh.out, "file:       %s\n", kv.Path)
+		fmt.Fprintf(sh.out, "file size:  %d\n", stats.FileSize)
+		fmt.Fprintf(sh.out, "pages used: %d\n", stats.Pages)
+		fmt.Fprintf(sh.out, "pages free: %d\n", stats.Free)
+		fmt.Fprintf(sh.out, "root page:  %d\n", stats.Root)
+		fmt.Fprintf(sh.out, "keys:       %d\n", stats.Keys)
+	case "dump-page":
+		ptr, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad page number: %s", args[0])
+		}
+		node, err := kv.Page(ptr)
+		if err != nil {
+			return err
+		}
+		sh.dumpPage(ptr, node)
+	case "free-list":
+		kv.GetFreeList().DebugPrint()
+	case "tree":
+		kv.Debug(kv.Path)
+	default:
+		return fmt.Errorf("unknown command: %s, try help", cmd)
+	}
+	return nil
+}
+
+// dump <file>
+func (sh *Shell) dump(path string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := sh.db.Dump(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// sql <statement>
+func (sh *Shell) sql(stmt string) error {
+	res, err := sh.db.ExecSQL(stmt)
+	if err != nil {
+		return err
+	}
+	for i := range res.Records {
+		fmt.Fprintln(sh.out, formatRecord(&res.Records[i]))
+	}
+	if res.Updated > 0 {
+		fmt.Fprintf(sh.out, "%d rows affected\n", res.Updated)
+	}
+	return nil
+}
+
+// scan <start> [end] [limit]
+func (sh *Shell) scan(kv *KV, args []string) error {
+	end, limit := []byte(nil), 100
+	if len(args) > 1 {
+		end = []byte(args[1])
+	}
+	if len(args) > 2 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad limit: %s", args[2])
+		}
+		limit = n
+	}
+	tree := kv.GetTree()
+	if tree.Root == 0 {
+		return nil
+	}
+	for iter := tree.Seek([]byte(args[0]), CMP_GE); iter.Valid() && limit > 0; iter.Next() {
+		key, val := iter.Deref()
+		if end != nil && !CmpOK(key, CMP_LE, end) {
+			break
+		}
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		fmt.Fprintf(sh.out, "%q => %q\n", key, val)
+		limit--
+	}
+	return nil
+}
+
+func (sh *Shell) create(args []string) error {
+	tdef := &TableDef{Name: args[0], PKeys: 1}
+	for _, arg := range args[1:] {
+		if n, ok := strings.CutPrefix(arg, "pkeys="); ok {
+			pkeys, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("bad pkeys: %s", n)
+			}
+			tdef.PKeys = pkeys
+			continue
+		}
+		col, typ, ok := strings.Cut(arg, ":")
+		if !ok {
+			return fmt.Errorf("expect <col>:<type>, got %s", arg)
+		}
+		if TypeByName(typ) == TYPE_ERROR {
+			return fmt.Errorf("unknown type: %s", typ)
+		}
+		tdef.Types = append(tdef.Types, TypeByName(typ))
+		tdef.Cols = append(tdef.Cols, col)
+	}
+	return sh.db.TableNew(tdef)
+}
+
+// parse <col>=<val> arguments according to the column types
+func parseRecord(tdef *TableDef, args []string) (Record, error) {
+	rec := Record{}
+	for _, arg := range args {
+		col, val, ok := strings.Cut(arg, "=")
+		if !ok {
+			return rec, fmt.Errorf("expect <col>=<val>, got %s", arg)
+		}
+		idx := -1
+		for i, name := range tdef.Cols {
+			if name == col {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return rec, fmt.Errorf("unknown column: %s", col)
+		}
+		if val == "NULL" && idx < len(tdef.Nullable) && tdef.Nullable[idx] {
+			rec.AddNull(col) // as printed by formatRecord
+			continue
+		}
+		v, err := ParseValue(tdef.Types[idx], val)
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %w", col, err)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+func formatRecord(rec *Record) string {
+	parts := []string{}
+	for i, col := range rec.Cols {
+		val := &rec.Vals[i]
+		if val.Type == TYPE_BYTES {
+			parts = append(parts, fmt.Sprintf("%s=%q", col, val.Str))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%s", col, FormatValue(val)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// select <table> [<col>=<val> ...]
+// a lookup if the primary key is given, otherwise a filtered full scan.
+// <col>=NULL matches the NULLs of a nullable column.
+func (sh *Shell) query(args []string) error {
+	tdef := sh.db.GetTableDef(args[0])
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, args[0])
+	}
+	cond, err := parseRecord(tdef, args[1:])
+	if err != nil {
+		return err
+	}
+	isKey := len(cond.Cols) == tdef.PKeys
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		isKey = isKey && cond.Get(col).Type != TYPE_ERROR
+	}
+	if isKey {
+		rec := Record{}
+		for _, col := range tdef.Cols[:tdef.PKeys] {
+			rec.Cols = append(rec.Cols, col)
+			rec.Vals = append(rec.Vals, *cond.Get(col))
+		}
+		ok, err := sh.db.Get(tdef.Name, &rec)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fmt.Fprintln(sh.out, formatRecord(&rec))
+		}
+		return nil
+	}
+	return sh.db.ScanAll(tdef.Name, func(rec *Record) bool {
+		for i, col := range cond.Cols {
+			if !valueEqual(&cond.Vals[i], rec.Get(col)) {
+				return true // filtered out
+			}
+		}
+		fmt.Fprintln(sh.out, formatRecord(rec))
+		return true
+	})
+}
+
+// the typed values are equal, NULL only equals NULL
+func valueEqual(a *Value, b *Value) bool {
+	if a.Type == TYPE_NULL || b.Type == TYPE_NULL {
+		return a.Type == b.Type
+	}
+	cmp, err := CompareValues(a, b)
+	return err == nil && cmp == 0
+}
+
+// decode a page by its type
+func (sh *Shell) dumpPage(ptr uint64, node BNode) {
+	if ptr == 0 {
+		fmt.Fprintf(sh.out, "page 0: master page\n%s", hex.Dump(node[:40]))
+		return
+	}
+	switch node.Ntype() {
+	case BNODE_NODE, BNODE_LEAF:
+		kind := map[uint16]string{BNODE_NODE: "internal", BNODE_LEAF: "leaf"}
+		fmt.Fprintf(sh.out, "page %d: %s node, %d keys, %d bytes\n",
+			ptr, kind[node.Ntype()], node.Nkeys(), node.Nbytes())
+		for i := uint16(0); i < node.Nkeys(); i++ {
+			if node.Ntype() == BNODE_NODE {
+				fmt.Fprintf(sh.out, "  [%d] %q -> page %d\n", i, node.GetKey(i), node.GetPtr(i))
+			} else {
+				fmt.Fprintf(sh.out, "  [%d] %q => %q\n", i, node.GetKey(i), node.GetVal(i))
+			}
+		}
+	case BNODE_FREE_LIST:
+		fmt.Fprintf(sh.out, "page %d: free list node\n", ptr)
+		sh.dumpRaw(node)
+	default:
+		fmt.Fprintf(sh.out, "page %d: unknown type %d\n", ptr, node.Ntype())
+		sh.dumpRaw(node)
+	}
+}
+
+// hex dump without the trailing zeros
+func (sh *Shell) dumpRaw(node BNode) {
+	end := len(node)
+	for end > 0 && node[end-1] == 0 {
+		end--
+	}
+	fmt.Fprint(sh.out, hex.Dump(node[:(end+15)/16*16]))
+}
+
+// the history is kept across sessions, one command per line
+func (sh *Shell) LoadHistory(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return // no history yet
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			sh.history = append(sh.history, line)
+		}
+	}
+}
+func (sh *Shell) SaveHistory(path string) error {
+	const keep = 1000
+	lines := sh.history
+	if len(lines) > keep {
+		lines = lines[len(lines)-keep:]
+	}
+	data := strings.Join(lines, "\n") + "\n"
+	return os.WriteFile(path, []byte(data), 0600)
+}
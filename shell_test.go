@@ -0,0 +1,90 @@
+package main
+
+import (
+	. "db"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShell(t *testing.T) {
+	os.Remove("test_shell.db")
+	defer os.Remove("test_shell.db")
+	db := &DB{Path: "test_shell.db"}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	out := &strings.Builder{}
+	sh := NewShell(db, out)
+	run := func(line string) string {
+		out.Reset()
+		assert.NoError(t, sh.Exec(line), line)
+		return out.String()
+	}
+
+	run(`set "k\x001" v1`)
+	run(`set k2 "hello world"`)
+	assert.Equal(t, "\"hello world\"\n", run("get k2"))
+	assert.Equal(t, "\"k\\x001\" => \"v1\"\n\"k2\" => \"hello world\"\n", run(`scan k "k\xff"`))
+	run("del k2")
+	assert.Error(t, sh.Exec("get k2"))
+
+	run("create people id:int64 name:bytes age:int64")
+	run("create pets owner:int64 name:bytes pkeys=2")
+	assert.Equal(t, "people\npets\n", run("tables"))
+	assert.Contains(t, run("describe pets"), "  name bytes primary key\n")
+	run("insert people id=1 name=alice age=30")
+	run("insert people id=2 name=bob age=40")
+	run(`insert people id=3 "name=carol c" age=30`)
+	assert.Error(t, sh.Exec("insert people id=1 name=dup age=1"))
+	assert.Error(t, sh.Exec("insert people id=x name=bad age=1"))
+	assert.Equal(t, "id=2 name=\"bob\" age=40\n", run("select people id=2"))
+	assert.Equal(t, "id=1 name=\"alice\" age=30\nid=3 name=\"carol c\" age=30\n", run("select people age=30"))
+	assert.Equal(t, 3, strings.Count(run("select people"), "\n"))
+
+	assert.Contains(t, run("stats"), "keys:")
+	assert.Contains(t, run("dump-page 0"), "master page")
+	root := db.GetKV().Stats().Root
+	assert.Contains(t, run("dump-page "+strconv.FormatUint(root, 10)), "node")
+	assert.Error(t, sh.Exec("dump-page 100000"))
+
+	// history
+	assert.Equal(t, "select people id=2\nid=2 name=\"bob\" age=40\n", run("!16"))
+	assert.Contains(t, run("history"), "   16  select people id=2\n")
+	assert.Error(t, sh.Exec("nope"))
+
+	// sql
+	assert.Equal(t, "1 rows affected\n", run("sql update people set age = age + 1 where id = 3"))
+	assert.Equal(t, "name=\"carol c\" age=31\n", run("sql SELECT name, age FROM people WHERE age > 30 AND id >= 3"))
+	assert.Error(t, sh.Exec("sql select from"))
+	run("sql create table books (id int64, title bytes, index (title))")
+	assert.Contains(t, run("describe books"), "  index (title, id) prefix ")
+	run("create prices at:timestamp price:decimal up:bool")
+	run("insert prices at=2024-05-01T00:00:00Z price=12.5 up=true")
+	assert.Equal(t, "at=2024-05-01T00:00:00Z price=12.5 up=true\n", run("select prices up=true"))
+	// the filter compares typed values, a NULL is not 0
+	run("sql create table n (id int64, v int64 null, primary key (id))")
+	run("sql insert into n values (1, 0), (2, null)")
+	assert.Equal(t, "id=1 v=0\n", run("select n v=0"))
+	assert.Equal(t, "id=2 v=NULL\n", run("select n v=NULL"))
+	run("insert n id=3 v=NULL")
+	assert.Equal(t, 2, strings.Count(run("select n v=NULL"), "\n"))
+	assert.Contains(t, run("help"), "ANALYZE or EXPLAIN")
+
+	// dump and restore
+	defer os.Remove("test_shell.dump")
+	defer os.Remove("test_shell2.db")
+	run("dump test_shell.dump")
+	os.Remove("test_shell2.db")
+	db2 := &DB{Path: "test_shell2.db"}
+	assert.NoError(t, db2.Open())
+	defer db2.Close()
+	sh2 := NewShell(db2, out)
+	assert.NoError(t, sh2.Exec("restore test_shell.dump"))
+	out.Reset()
+	assert.NoError(t, sh2.Exec("select prices up=true"))
+	assert.Equal(t, "at=2024-05-01T00:00:00Z price=12.5 up=true\n", out.String())
+	assert.Error(t, sh2.Exec("restore nope.dump"))
+}
@@ -10,7 +10,12 @@ type BIter struct {
 
 // precondition of the Deref()
 func (iter *BIter) Valid() bool {
-	return iter.tree.Root != 0 && len(iter.path) > 0
+	if iter.tree.Root == 0 || len(iter.path) == 0 {
+		return false
+	}
+	// moved past the last key?
+	level := len(iter.path) - 1
+	return iter.pos[level] < iter.path[level].Nkeys()
 }
 func (iter *BIter) Init() {
 	checkAssertion(iter.tree.Root != 0)
@@ -30,15 +35,21 @@ func (iter *BIter) HasNext() bool {
 
 // moving backward and forward
 func (iter *BIter) Next() {
-	iterNext(iter, len(iter.path)-1)
+	if !iterNext(iter, len(iter.path)-1) {
+		// no more keys, park the iterator past the end
+		level := len(iter.path) - 1
+		iter.pos[level] = iter.path[level].Nkeys()
+	}
 }
-func iterNext(iter *BIter, level int) {
+func iterNext(iter *BIter, level int) bool {
 	if iter.pos[level] < iter.path[level].Nkeys()-1 {
 		iter.pos[level]++ // move within this node
 	} else if level > 0 {
-		iterNext(iter, level-1) // move to a slibing node
+		if !iterNext(iter, level-1) { // move to a slibing node
+			return false
+		}
 	} else {
-		return // dummy key
+		return false // the last key
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid node
@@ -47,6 +58,7 @@ func iterNext(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = 0
 	}
+	return true
 }
 
 // Moving the iterator is simply moving the positions or nodes to a sibling
@@ -115,3 +115,29 @@ func TestSeek(t *testing.T) {
 		assert.True(t, bytes.Compare(k, buf) >= 0, "buf %d key %d", buf, k)
 	}
 }
+
+func TestNextPastEnd(t *testing.T) {
+	c := newC()
+	for i := 1; i <= 300; i++ {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(i))
+		c.tree.Insert(buf, []byte(randomString(100)))
+	}
+	last := make([]byte, 4)
+	binary.BigEndian.PutUint32(last, 300)
+	biter := c.tree.Seek(last, CMP_GE)
+	assert.True(t, biter.Valid())
+	k, _ := biter.Deref()
+	assert.Equal(t, last, k)
+	// the iterator is no longer valid after the last key
+	biter.Next()
+	assert.False(t, biter.Valid())
+	// and comes back with Prev()
+	biter.Prev()
+	assert.True(t, biter.Valid())
+	k, _ = biter.Deref()
+	assert.Equal(t, last, k)
+	// seeking past the last key gives an invalid iterator
+	binary.BigEndian.PutUint32(last, 301)
+	assert.False(t, c.tree.Seek(last, CMP_GE).Valid())
+}
@@ -280,3 +280,179 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 func (tree *BTree) InsertEx(req *InsertReq) {
 	return
 }
+
+// delete the keys in [start, end), an empty end means no upper bound.
+// the subtrees inside the range are freed as a whole, only the nodes on
+// the 2 boundary paths are rewritten and rebalanced.
+// returns the number of deleted keys.
+func (tree *BTree) DeleteRange(start []byte, end []byte) int {
+	checkAssertion(len(start) != 0) // the dummy key is never deleted
+	if tree.Root == 0 || (len(end) > 0 && bytes.Compare(start, end) >= 0) {
+		return 0
+	}
+	updated, count := treeDeleteRange(tree, tree.Get(tree.Root), start, end)
+	if count == 0 {
+		return 0
+	}
+	tree.Del(tree.Root)
+	nsplit, split := NodeSplit3(updated)
+	if nsplit > 1 {
+		// the root grew with longer keys
+		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root.SetHeader(BNODE_NODE, nsplit)
+		for i, knode := range split[:nsplit] {
+			nodeAppendKV(root, uint16(i), tree.New(knode), knode.GetKey(0), nil)
+		}
+		tree.Root = tree.New(root)
+		return count
+	}
+	tree.Root = tree.New(split[0])
+	// remove the levels with a single kid
+	for {
+		root := tree.Get(tree.Root)
+		if root.Ntype() != BNODE_NODE || root.Nkeys() != 1 {
+			return count
+		}
+		tree.Del(tree.Root)
+		tree.Root = root.GetPtr(0)
+	}
+}
+
+// a kid of an internal node being rebuilt by treeDeleteRange
+type rangeKid struct {
+	node BNode  // the rewritten kid, or nil
+	ptr  uint64 // the unchanged kid
+	key  []byte
+}
+
+func (kid *rangeKid) get(tree *BTree) BNode {
+	if kid.node != nil {
+		return kid.node
+	}
+	return tree.Get(kid.ptr)
+}
+
+// delete the keys in the range from a subtree. the result may be empty,
+// or be bigger than a page when the first keys of the kids got longer.
+func treeDeleteRange(tree *BTree, node BNode, start []byte, end []byte) (BNode, int) {
+	inRange := func(key []byte) bool {
+		return bytes.Compare(key, start) >= 0 && (len(end) == 0 || bytes.Compare(key, end) < 0)
+	}
+	nkeys := node.Nkeys()
+	if node.Ntype() == BNODE_LEAF {
+		lo := uint16(0)
+		for lo < nkeys && !inRange(node.GetKey(lo)) {
+			lo++
+		}
+		hi := lo
+		for hi < nkeys && inRange(node.GetKey(hi)) {
+			hi++
+		}
+		if lo == hi {
+			return BNode{}, 0
+		}
+		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		new.SetHeader(BNODE_LEAF, nkeys-(hi-lo))
+		nodeAppendRange(new, node, 0, 0, lo)
+		nodeAppendRange(new, node, lo, hi, nkeys-hi)
+		return new, int(hi - lo)
+	}
+	checkAssertion(node.Ntype() == BNODE_NODE)
+	kids := []rangeKid{}
+	count := 0
+	for i := uint16(0); i < nkeys; i++ {
+		// the keys of the kid are in [lower, upper)
+		lower, upper := node.GetKey(i), []byte(nil)
+		if i+1 < nkeys {
+			upper = node.GetKey(i + 1)
+		}
+		ptr := node.GetPtr(i)
+		switch {
+		case (upper != nil && bytes.Compare(upper, start) <= 0) || (len(end) > 0 && bytes.Compare(lower, end) >= 0):
+			// outside the range
+			kids = append(kids, rangeKid{ptr: ptr, key: lower})
+		case bytes.Compare(lower, start) >= 0 && (len(end) == 0 || (upper != nil && bytes.Compare(upper, end) <= 0)):
+			// inside the range
+			count += treeFree(tree, ptr)
+		default:
+			// on the boundary
+			updated, n := treeDeleteRange(tree, tree.Get(ptr), start, end)
+			if n == 0 {
+				kids = append(kids, rangeKid{ptr: ptr, key: lower})
+				continue
+			}
+			count += n
+			tree.Del(ptr)
+			if updated.Nkeys() == 0 {
+				continue // emptied
+			}
+			nsplit, split := NodeSplit3(updated)
+			for _, knode := range split[:nsplit] {
+				kids = append(kids, rangeKid{node: knode, key: knode.GetKey(0)})
+			}
+		}
+	}
+	if count == 0 {
+		return BNode{}, 0
+	}
+	kids = rangeMerge(tree, kids)
+	// the new node, possibly oversized
+	size := HEADER
+	for _, kid := range kids {
+		size += 8 + 2 + 4 + len(kid.key)
+	}
+	new := BNode(make([]byte, max(size, BTREE_PAGE_SIZE)))
+	new.SetHeader(BNODE_NODE, uint16(len(kids)))
+	for i, kid := range kids {
+		ptr := kid.ptr
+		if kid.node != nil {
+			ptr = tree.New(kid.node)
+		}
+		nodeAppendKV(new, uint16(i), ptr, kid.key, nil)
+	}
+	return new, count
+}
+
+// merge the small rewritten kids with their siblings
+func rangeMerge(tree *BTree, kids []rangeKid) []rangeKid {
+	for i := 0; i < len(kids); i++ {
+		if kids[i].node == nil || kids[i].node.Nbytes() > BTREE_PAGE_SIZE/4 {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(kids) {
+				continue
+			}
+			sibling := kids[j].get(tree)
+			if sibling.Nbytes()+kids[i].node.Nbytes()-HEADER > BTREE_PAGE_SIZE {
+				continue
+			}
+			lo := min(i, j)
+			merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+			nodeMerge(merged, kids[lo].get(tree), kids[lo+1].get(tree))
+			if kids[j].node == nil {
+				tree.Del(kids[j].ptr)
+			}
+			kids[lo] = rangeKid{node: merged, key: merged.GetKey(0)}
+			kids = append(kids[:lo+1], kids[lo+2:]...)
+			i = lo - 1 // check the merged node again
+			break
+		}
+	}
+	return kids
+}
+
+// free all the pages of a subtree, returns the number of keys
+func treeFree(tree *BTree, ptr uint64) int {
+	node := tree.Get(ptr)
+	count := 0
+	if node.Ntype() == BNODE_LEAF {
+		count = int(node.Nkeys())
+	} else {
+		for i := uint16(0); i < node.Nkeys(); i++ {
+			count += treeFree(tree, node.GetPtr(i))
+		}
+	}
+	tree.Del(ptr)
+	return count
+}
@@ -190,3 +190,72 @@ func Test_btree(t *testing.T) {
 	}
 
 }
+
+// check the structure of a subtree, returns the height
+func (c *C) verify(t *testing.T, node BNode) int {
+	assert.LessOrEqual(t, int(node.Nbytes()), BTREE_PAGE_SIZE)
+	for i := uint16(1); i < node.Nkeys(); i++ {
+		assert.Less(t, string(node.GetKey(i-1)), string(node.GetKey(i)))
+	}
+	if node.Ntype() == BNODE_LEAF {
+		return 1
+	}
+	height := 0
+	for i := uint16(0); i < node.Nkeys(); i++ {
+		kid := c.pages[node.GetPtr(i)]
+		assert.Equal(t, node.GetKey(i), kid.GetKey(0))
+		h := c.verify(t, kid)
+		if i > 0 {
+			assert.Equal(t, height, h) // the leaves are at the same level
+		}
+		height = h
+	}
+	return height + 1
+}
+
+func Test_deleteRange(t *testing.T) {
+	for round := 0; round < 10; round++ {
+		c := newC()
+		n := randomInt(1, 2000)
+		for i := 0; i < n; i++ {
+			c.add(fmt.Sprintf("k%05d", rand.Intn(5000)), randomString(randomInt(1, 100)))
+		}
+		for j := 0; j < 5; j++ {
+			a, b := rand.Intn(5200), rand.Intn(5200)
+			start, end := fmt.Sprintf("k%05d", min(a, b)), fmt.Sprintf("k%05d", max(a, b))
+			if j == 4 {
+				end = "" // to the end
+			}
+			expect := 0
+			for key := range c.ref {
+				if key >= start && (end == "" || key < end) {
+					delete(c.ref, key)
+					expect++
+				}
+			}
+			assert.Equal(t, expect, c.tree.DeleteRange([]byte(start), []byte(end)))
+			c.verify(t, c.pages[c.tree.Root])
+			got := 0
+			for iter := c.tree.Seek([]byte("k"), CMP_GE); iter.Valid(); iter.Next() {
+				key, val := iter.Deref()
+				assert.Equal(t, c.ref[string(key)], string(val))
+				got++
+			}
+			assert.Equal(t, len(c.ref), got)
+		}
+	}
+	// the whole key space but the dummy key
+	c := newC()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("k%05d", i), randomString(50))
+	}
+	assert.Equal(t, 1000, c.tree.DeleteRange([]byte("a"), nil))
+	root := c.pages[c.tree.Root]
+	assert.Equal(t, uint16(BNODE_LEAF), root.Ntype())
+	assert.Equal(t, uint16(1), root.Nkeys())
+	assert.Equal(t, 0, c.tree.DeleteRange([]byte("a"), nil))
+	c.add("k1", "v1")
+	val, ok := c.tree.Read([]byte("k1"))
+	assert.True(t, ok)
+	assert.Equal(t, "v1", string(val))
+}